@@ -7,4 +7,5 @@ sourcePath="$(dirname '$0')"
 cd "$sourcePath"
 
 GOPATH="$(pwd)"
-go build -o "bootchat-server" "src/bootchat-server/server.go" "src/bootchat-server/database.go"
+# sqlite_fts5 compiles SQLite with FTS5, which message search (migration 0007) needs
+go build -tags sqlite_fts5 -o "bootchat-server" src/bootchat-server/*.go
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+	Admin commands
+
+	They run against the configured database (see config.go) and need its
+	schema to be up to date (migrate up).
+
+	 users list                           every account
+	 users delete <username>              remove the account and its
+	                                      sessions, the username stays
+	                                      taken (its messages stay)
+	 users reset-password <username> [p]  set a new password, a random one
+	                                      is generated and printed without p
+	 users disable <username>             refuse logins and revoke sessions
+	 users enable <username>              undo disable
+	 users locked                         usernames and addresses with
+	                                      recent failed logins, and how long
+	                                      they wait
+	 users unlock <username>              forget the failed logins of a
+	                                      username, or of an address with
+	 users unlock --ip <address>          --ip (see lockout.go)
+	 messages purge --before <date>       remove every message sent before
+	                                      date (unix seconds, YYYY-MM-DD or
+	                                      RFC 3339) or at an unknown time
+	 db stats                             row counts and schema version
+
+	A running server keeps serving, a disabled or deleted user's sessions
+	are gone so their next request fails and their websockets are closed
+	at the next ping (see websocket.go). Failed logins are read from the
+	database on every attempt, an unlock applies at once.
+*/
+
+const generatedPasswordBytes = 12
+
+/*
+	require_current_schema - refuse to work on a dirty or partially migrated database
+	 store Store
+
+	 returns (the current schema version, error)
+*/
+func require_current_schema(store Store) (int, error) {
+	statuses, err := store.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for _, status := range statuses {
+		if status.dirty {
+			return 0, errDirtyDatabase
+		}
+		if status.applied == 0 {
+			return 0, fmt.Errorf("migration %04d is pending, run migrate up first", status.version)
+		}
+		version = status.version
+	}
+
+	return version, nil
+}
+
+func generate_password() (string, error) {
+	data := make([]byte, generatedPasswordBytes)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+/*
+	runUsersCommand - the "users" subcommand
+	 store Store
+	 args []string (list | delete <username> | reset-password <username> [password] | disable <username> | enable <username> | locked | unlock [--ip] <name>)
+
+	 returns (process exit code)
+*/
+func runUsersCommand(store Store, args []string) int {
+	const usage = "usage: bootchat-server [-v] users list | delete <username> | reset-password <username> [password] | disable <username> | enable <username> | locked | unlock <username> | unlock --ip <address>"
+
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Println(usage)
+		return 2
+	}
+
+	var valid bool
+	switch args[0] {
+	case "list", "locked":
+		valid = len(args) == 1
+	case "reset-password":
+		valid = len(args) >= 2
+	case "unlock":
+		valid = len(args) == 2 || (len(args) == 3 && args[1] == "--ip")
+	default:
+		valid = len(args) == 2
+	}
+
+	if !valid {
+		fmt.Println(usage)
+		return 2
+	}
+
+	if _, err := require_current_schema(store); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = print_accounts(store)
+
+	case "delete":
+		if err = delete_user(store, args[1]); err == nil {
+			fmt.Printf("Deleted user %s.\n", args[1])
+		}
+
+	case "reset-password":
+		err = reset_password(store, args[1:])
+
+	case "disable":
+		if err = disable_user(store, args[1], true); err == nil {
+			fmt.Printf("Disabled user %s.\n", args[1])
+		}
+
+	case "enable":
+		if err = disable_user(store, args[1], false); err == nil {
+			fmt.Printf("Enabled user %s.\n", args[1])
+		}
+
+	case "locked":
+		err = print_login_failures(store)
+
+	case "unlock":
+		kind, name := loginKindUser, args[1]
+		if len(args) == 3 {
+			kind, name = loginKindAddress, args[2]
+		}
+
+		var cleared bool
+		if cleared, err = unlock_login(store, kind, name); err == nil {
+			if cleared {
+				fmt.Printf("Cleared the failed logins of %s.\n", name)
+			} else {
+				fmt.Printf("%s has no failed logins.\n", name)
+			}
+		}
+
+	default:
+		fmt.Println(usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// reset_password sets args[1], or a generated password, for args[0] and
+// revokes the account's sessions.
+func reset_password(store Store, args []string) error {
+	username := args[0]
+	if !store.UserExists(username) {
+		return errUserNotFound.withDetail(username)
+	}
+
+	var password string
+	if len(args) == 2 {
+		password = args[1]
+	} else {
+		generated, err := generate_password()
+		if err != nil {
+			return err
+		}
+		password = generated
+	}
+
+	if len(password) < 1 {
+		return errMissingParameter.withDetail("password")
+	}
+
+	if err := set_password(store, username, password); err != nil {
+		return err
+	}
+
+	revoked, err := delete_user_sessions(store, username)
+	if err != nil {
+		return err
+	}
+
+	// the new password is known to the user, a lockout would only keep them out
+	if _, err = unlock_login(store, loginKindUser, username); err != nil {
+		return err
+	}
+
+	if len(args) == 2 {
+		fmt.Printf("Password of %s changed, %d session(s) revoked.\n", username, revoked)
+	} else {
+		fmt.Printf("Password of %s changed to %s, %d session(s) revoked.\n", username, password, revoked)
+	}
+
+	return nil
+}
+
+// print_login_failures lists what failed to log in within loginLockout, most recent first.
+func print_login_failures(store Store) error {
+	now := time.Now()
+
+	list, err := store.ListLoginFailures(now.Add(-loginLockout))
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 {
+		fmt.Println("No recent failed logins.")
+		return nil
+	}
+
+	fmt.Printf("%-5s %-32s %8s  %-25s %s\n", "KIND", "NAME", "FAILURES", "LAST", "STATE")
+	for _, entry := range list {
+		failures, _ := strconv.Atoi(entry["failures"])
+		seconds, _ := strconv.ParseInt(entry["last_failure"], 10, 64)
+		last := time.Unix(seconds, 0)
+
+		state := "-"
+		if until := last.Add(loginWait(entry["kind"], failures)); until.After(now) {
+			state = "waits until " + until.Format(time.RFC3339)
+			if failures >= loginLockoutLimit(entry["kind"]) {
+				state = "locked out until " + until.Format(time.RFC3339)
+			}
+		}
+
+		fmt.Printf("%-5s %-32s %8d  %-25s %s\n", entry["kind"], entry["name"], failures, last.Format(time.RFC3339), state)
+	}
+
+	return nil
+}
+
+/*
+	runMessagesCommand - the "messages" subcommand
+	 store Store
+	 args []string (purge --before <date>)
+
+	 returns (process exit code)
+*/
+func runMessagesCommand(store Store, args []string) int {
+	const usage = "usage: bootchat-server [-v] messages purge --before <unix seconds | YYYY-MM-DD | RFC 3339>"
+
+	if len(args) != 3 || args[0] != "purge" || args[1] != "--before" {
+		fmt.Println(usage)
+		return 2
+	}
+
+	before, err := getSearchTimeParam(map[string]interface{}{"before": args[2]}, "before", false)
+	if err != nil || len(args[2]) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+
+	if _, err = require_current_schema(store); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	if err = attachmentFiles.prepare(); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	count, err := store.PurgeMessages(time.Unix(before, 0))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	// the files of attachments that lost their message go too
+	purge_attachments(store)
+
+	fmt.Printf("Purged %d message(s) sent before %s or at an unknown time.\n", count, time.Unix(before, 0).Format(time.RFC3339))
+	return 0
+}
+
+/*
+	runDbCommand - the "db" subcommand
+	 store Store
+	 args []string (stats)
+
+	 returns (process exit code)
+*/
+func runDbCommand(store Store, args []string) int {
+	const usage = "usage: bootchat-server [-v] db stats"
+
+	if len(args) != 1 || args[0] != "stats" {
+		fmt.Println(usage)
+		return 2
+	}
+
+	version, err := require_current_schema(store)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	stats, err := store.GetStats()
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	stats["schema_version"] = strconv.Itoa(version)
+
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Printf("%-20s %s\n", key, stats[key])
+	}
+
+	return 0
+}
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+/*
+	Attachments
+
+	Files are uploaded before the message that carries them, then send
+	references them by id ("attachments": [12, 13]). Until it is sent an
+	attachment is only visible to its owner, afterwards to the participants
+	of its conversation: both peers, or the members of the room. Uploads
+	that are never sent are purged after unsentAttachmentLifetime, files of
+	deleted conversations and rooms right away.
+
+	Small files go up in one multipart request (POST /v1/attachments, one or
+	more "file" parts). Large ones, or uploads over a bad connection, use a
+	chunked upload: startupload announces the name and size, each chunk is
+	a PUT with "Content-Range: bytes first-last/size" starting where the
+	previous one ended (getupload tells a client where to resume) and
+	finishupload turns the upload into an attachment.
+
+	Each distinct content is stored once, under its sha256, in
+	<dir>/<first two hex digits>/<sha256>. The type is sniffed from the
+	content, whatever the client claims, and must be in
+	allowedAttachmentTypes. Downloads support Range requests.
+*/
+
+const defaultAttachmentDir = "./etc/attachments"
+
+// the limits can be changed in the config, see config.go
+var maxAttachmentSize int64 = 25 << 20
+var attachmentQuota int64 = 1 << 30
+var maxAttachmentsPerMessage = 10
+
+const unsentAttachmentLifetime = 24 * time.Hour
+const uploadIdleTimeout = time.Hour
+
+// allowedAttachmentTypes are the sniffed media types accepted, mostly screenshots and logs.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":          true,
+	"image/jpeg":         true,
+	"image/gif":          true,
+	"image/webp":         true,
+	"image/bmp":          true,
+	"text/plain":         true,
+	"application/pdf":    true,
+	"application/zip":    true,
+	"application/x-gzip": true,
+}
+
+type pendingUpload struct {
+	mu sync.Mutex // held while a chunk is written
+
+	id       string
+	owner    string
+	filename string
+	size     int64
+	received int64
+	path     string
+	touched  time.Time
+}
+
+type attachmentStorage struct {
+	dir string
+
+	// mu orders storing a file against purging it, so a purge never
+	// removes a file a new attachment has just started to share
+	mu sync.Mutex
+
+	uploadsMu sync.Mutex
+	uploads   map[string]*pendingUpload
+
+	quotaMu    sync.Mutex
+	quotaLocks map[string]*quotaLock
+}
+
+// quotaLock is held from an owner's quota check until what it allowed is recorded.
+type quotaLock struct {
+	mu    sync.Mutex
+	users int // holders and waiters, the lock is dropped at 0
+}
+
+var attachmentFiles = newAttachmentStorage(defaultAttachmentDir)
+
+func newAttachmentStorage(dir string) *attachmentStorage {
+	return &attachmentStorage{dir: dir, uploads: make(map[string]*pendingUpload), quotaLocks: make(map[string]*quotaLock)}
+}
+
+// prepare creates the storage directories and drops uploads left over from a previous run.
+func (files *attachmentStorage) prepare() error {
+	tmp := filepath.Join(files.dir, "tmp")
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(tmp, 0700)
+}
+
+func (files *attachmentStorage) path(sha256 string) string {
+	return filepath.Join(files.dir, sha256[:2], sha256)
+}
+
+// lockQuota locks owner's quota, so concurrent uploads can not each pass
+// check_attachment_quota and together exceed it. It returns the unlock.
+func (files *attachmentStorage) lockQuota(owner string) func() {
+	files.quotaMu.Lock()
+	lock, exists := files.quotaLocks[owner]
+	if !exists {
+		lock = &quotaLock{}
+		files.quotaLocks[owner] = lock
+	}
+	lock.users++
+	files.quotaMu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		files.quotaMu.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(files.quotaLocks, owner)
+		}
+		files.quotaMu.Unlock()
+	}
+}
+
+func (files *attachmentStorage) tempFile() (*os.File, error) {
+	return os.CreateTemp(filepath.Join(files.dir, "tmp"), "upload-")
+}
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+/*
+	store_attachment - hash, check and keep an uploaded file
+	 store Store
+	 owner string
+	 filename string
+	 tmpPath string (the upload, removed in every case)
+
+	 returns (attachment row, error)
+	 The caller holds owner's quota lock, see lockQuota.
+*/
+func store_attachment(store Store, owner string, filename string, tmpPath string) (map[string]string, error) {
+	defer os.Remove(tmpPath)
+
+	file, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+
+	hash := sha256.New()
+	hash.Write(head[:n])
+	rest, err := io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(n) + rest
+	if size == 0 {
+		return nil, errInvalidParameter.withDetail("file is empty")
+	}
+
+	if size > maxAttachmentSize {
+		return nil, errAttachmentTooLarge
+	}
+
+	content_type := http.DetectContentType(head[:n])
+	if mediaType, _, err := mime.ParseMediaType(content_type); err != nil || !allowedAttachmentTypes[mediaType] {
+		return nil, errAttachmentType.withDetail(content_type)
+	}
+
+	if err = check_attachment_quota(store, owner, size); err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	attachmentFiles.mu.Lock()
+	defer attachmentFiles.mu.Unlock()
+
+	target := attachmentFiles.path(sum)
+	if _, err = os.Stat(target); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return nil, err
+		}
+		if err = os.Rename(tmpPath, target); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	row, err := store.CreateAttachment(owner, sum, size, content_type, filename, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		log.Printf("Stored attachment %s (%d bytes) for %s\n", row["id"], size, owner)
+	}
+
+	return row, nil
+}
+
+// check_attachment_quota fails when size more bytes would put owner over
+// attachmentQuota, pending chunked uploads count with their full size.
+// The caller holds owner's quota lock until the bytes are recorded.
+func check_attachment_quota(store Store, owner string, size int64) error {
+	usage, err := store.GetAttachmentUsage(owner)
+	if err != nil {
+		return err
+	}
+
+	attachmentFiles.uploadsMu.Lock()
+	for _, upload := range attachmentFiles.uploads {
+		if upload.owner == owner {
+			usage += upload.size
+		}
+	}
+	attachmentFiles.uploadsMu.Unlock()
+
+	if usage+size > attachmentQuota {
+		return errAttachmentQuota
+	}
+
+	return nil
+}
+
+/*
+	purge_attachments - drop unsent and orphaned attachments and their unused files
+	 store Store
+*/
+func purge_attachments(store Store) {
+	attachmentFiles.mu.Lock()
+	defer attachmentFiles.mu.Unlock()
+
+	unused, err := store.PurgeAttachments(time.Now().Add(-unsentAttachmentLifetime))
+	if err != nil {
+		log.Printf("Unable to purge attachments: %s", err.Error())
+		return
+	}
+
+	for _, sum := range unused {
+		if !sha256Pattern.MatchString(sum) {
+			continue
+		}
+		path := attachmentFiles.path(sum)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove attachment file %s: %s", sum, err.Error())
+		}
+		// fails unless the directory is now empty
+		os.Remove(filepath.Dir(path))
+	}
+
+	if verbose && len(unused) > 0 {
+		log.Printf("Removed %d unused attachment file(s)\n", len(unused))
+	}
+}
+
+// can_read_attachment reports whether username may see an attachment row from GetAttachment.
+func can_read_attachment(store Store, username string, row map[string]string) bool {
+	if row["message_id"] == "0" {
+		return row["owner"] == username
+	}
+
+	if room, exists := row["room_id"]; exists {
+		room_id, _ := strconv.ParseInt(room, 10, 64)
+		role, err := store.GetRoomRole(room_id, username)
+		return err == nil && len(role) > 0
+	}
+
+	// an attachment whose message is gone has neither
+	return len(username) > 0 && (row["to_user"] == username || row["from_user"] == username)
+}
+
+// attachmentInfo is the part of an attachment row clients get to see.
+func attachmentInfo(row map[string]string) map[string]string {
+	info := make(map[string]string)
+	for _, key := range []string{"id", "message_id", "owner", "filename", "content_type", "size", "sha256", "created"} {
+		info[key] = row[key]
+	}
+	return info
+}
+
+/*
+	add_attachment_info - describe the attachments of fetched messages
+	 store Store
+	 listOfRows []map[string]string (message rows, updated in place)
+
+	 returns (attachment info rows, error)
+	 Messages with attachments get "attachments", their ids separated by
+	 commas, the returned rows describe every one of them.
+*/
+func add_attachment_info(store Store, listOfRows []map[string]string) ([]map[string]string, error) {
+	message_ids := make([]int64, 0, len(listOfRows))
+	for _, row := range listOfRows {
+		id, _ := strconv.ParseInt(row["id"], 10, 64)
+		message_ids = append(message_ids, id)
+	}
+
+	attachments, err := store.GetMessageAttachments(message_ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attachments) == 0 {
+		return attachments, nil
+	}
+
+	byMessage := make(map[string][]string)
+	for i, attachment := range attachments {
+		byMessage[attachment["message_id"]] = append(byMessage[attachment["message_id"]], attachment["id"])
+		attachments[i] = attachmentInfo(attachment)
+	}
+
+	for _, row := range listOfRows {
+		if ids, exists := byMessage[row["id"]]; exists {
+			row["attachments"] = strings.Join(ids, ",")
+		}
+	}
+
+	return attachments, nil
+}
+
+func formatIdList(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// cleanAttachmentName keeps the last path element of a client supplied file name, without control characters.
+func cleanAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	for len(name) > 255 {
+		runes := []rune(name)
+		name = string(runes[:len(runes)-1])
+	}
+
+	if name == "." || name == "/" || len(strings.TrimSpace(name)) == 0 {
+		return "attachment"
+	}
+
+	return name
+}
+
+/* chunked uploads */
+
+func newUploadId() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// findUpload returns a pending upload of owner, expired ones are dropped on the way.
+func findUpload(owner string, id string) (*pendingUpload, error) {
+	attachmentFiles.uploadsMu.Lock()
+	defer attachmentFiles.uploadsMu.Unlock()
+
+	now := time.Now()
+	for key, upload := range attachmentFiles.uploads {
+		if now.Sub(upload.touched) > uploadIdleTimeout && upload.mu.TryLock() {
+			delete(attachmentFiles.uploads, key)
+			os.Remove(upload.path)
+			upload.mu.Unlock()
+		}
+	}
+
+	upload, exists := attachmentFiles.uploads[id]
+	if !exists || upload.owner != owner {
+		return nil, errUploadNotFound
+	}
+
+	return upload, nil
+}
+
+// removeUpload forgets a pending upload, callers hold upload.mu.
+func removeUpload(upload *pendingUpload) {
+	attachmentFiles.uploadsMu.Lock()
+	delete(attachmentFiles.uploads, upload.id)
+	attachmentFiles.uploadsMu.Unlock()
+}
+
+func uploadReply(upload *pendingUpload) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	replyMap["success"] = true
+	replyMap["upload_id"] = upload.id
+	replyMap["filename"] = upload.filename
+	replyMap["size"] = upload.size
+	replyMap["received"] = upload.received
+	return replyMap
+}
+
+/*
+	startupload - begin a chunked upload
+	 filename  the name shown to recipients
+	 size      total bytes, at most maxAttachmentSize
+
+	 reply: upload_id, filename, size, received
+*/
+func handleStartUploadRequest(store Store, username string, params interface{}) map[string]interface{} {
+	p := params.(startUploadParams)
+	filename, size := p.Filename, p.Size
+
+	if size > maxAttachmentSize {
+		return errorReply(errAttachmentTooLarge)
+	}
+
+	// a good moment to forget files nobody sent
+	purge_attachments(store)
+
+	unlock := attachmentFiles.lockQuota(username)
+	defer unlock()
+
+	if err := check_attachment_quota(store, username, size); err != nil {
+		return errorReply(err)
+	}
+
+	id, err := newUploadId()
+	if err != nil {
+		return errorReply(err)
+	}
+
+	file, err := attachmentFiles.tempFile()
+	if err != nil {
+		return errorReply(err)
+	}
+	file.Close()
+
+	upload := &pendingUpload{
+		id:       id,
+		owner:    username,
+		filename: cleanAttachmentName(filename),
+		size:     size,
+		path:     file.Name(),
+		touched:  time.Now(),
+	}
+
+	attachmentFiles.uploadsMu.Lock()
+	attachmentFiles.uploads[id] = upload
+	attachmentFiles.uploadsMu.Unlock()
+
+	return uploadReply(upload)
+}
+
+/*
+	getupload - progress of a chunked upload
+	 upload_id
+
+	 reply: upload_id, filename, size, received (where the next chunk starts)
+*/
+func handleGetUploadRequest(store Store, username string, params interface{}) map[string]interface{} {
+	id := params.(uploadIdParams).UploadId
+
+	upload, err := findUpload(username, id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	return uploadReply(upload)
+}
+
+/*
+	finishupload - turn a complete chunked upload into an attachment
+	 upload_id
+
+	 reply: attachment (id, filename, content_type, size, sha256, ...)
+*/
+func handleFinishUploadRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	id := params.(uploadIdParams).UploadId
+
+	upload, err := findUpload(username, id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if upload.received != upload.size {
+		return errorReply(errUploadIncomplete.withDetail(strconv.FormatInt(upload.received, 10) + " of " + strconv.FormatInt(upload.size, 10) + " bytes received"))
+	}
+
+	// the upload stops counting against the quota when the attachment starts
+	unlock := attachmentFiles.lockQuota(username)
+	defer unlock()
+
+	removeUpload(upload)
+
+	row, err := store_attachment(store, username, upload.filename, upload.path)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["attachment"] = attachmentInfo(row)
+	return replyMap
+}
+
+/*
+	cancelupload - abandon a chunked upload
+	 upload_id
+*/
+func handleCancelUploadRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	id := params.(uploadIdParams).UploadId
+
+	upload, err := findUpload(username, id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	removeUpload(upload)
+	os.Remove(upload.path)
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	getattachment - describe an attachment
+	 attachment_id
+
+	 reply: attachment (id, message_id, owner, filename, content_type, size, sha256, created)
+*/
+func handleGetAttachmentRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	id := params.(attachmentIdParams).AttachmentId
+
+	row, err := store.GetAttachment(id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !can_read_attachment(store, username, row) {
+		return errorReply(errAttachmentNotFound)
+	}
+
+	replyMap["success"] = true
+	replyMap["attachment"] = attachmentInfo(row)
+	return replyMap
+}
+
+/* file routes, see apiFileRoutes */
+
+// handleUploadAttachments stores every "file" part of a multipart/form-data body.
+func handleUploadAttachments(store Store, username string, response http.ResponseWriter, request *http.Request) {
+	request.Body = http.MaxBytesReader(response, request.Body, maxAttachmentSize*int64(maxAttachmentsPerMessage)+1<<20)
+
+	reader, err := request.MultipartReader()
+	if err != nil {
+		writeJsonReply(response, errMalformedRequest.status, errorReply(errMalformedRequest.withDetail("multipart/form-data expected")))
+		return
+	}
+
+	attachments := make([]map[string]string, 0)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeJsonReply(response, errMalformedRequest.status, errorReply(errMalformedRequest))
+			return
+		}
+
+		if part.FormName() != "file" || len(part.FileName()) == 0 {
+			part.Close()
+			continue
+		}
+
+		if len(attachments) == maxAttachmentsPerMessage {
+			err := errInvalidParameter.withDetail("at most " + strconv.Itoa(maxAttachmentsPerMessage) + " files per request")
+			writeJsonReply(response, err.status, errorReply(err))
+			return
+		}
+
+		row, err := receive_attachment_part(store, username, part)
+		part.Close()
+		if err != nil {
+			replyMap := errorReply(err)
+			writeJsonReply(response, replyStatus(replyMap), replyMap)
+			return
+		}
+
+		attachments = append(attachments, attachmentInfo(row))
+	}
+
+	if len(attachments) == 0 {
+		writeJsonReply(response, errMissingParameter.status, errorReply(errMissingParameter.withDetail("file")))
+		return
+	}
+
+	replyMap := make(map[string]interface{})
+	replyMap["success"] = true
+	replyMap["attachments"] = attachments
+	writeJsonReply(response, http.StatusCreated, replyMap)
+}
+
+func receive_attachment_part(store Store, username string, part *multipart.Part) (map[string]string, error) {
+	file, err := attachmentFiles.tempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := io.Copy(file, io.LimitReader(part, maxAttachmentSize+1))
+	file.Close()
+
+	if err != nil {
+		os.Remove(file.Name())
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errAttachmentTooLarge
+		}
+		return nil, errMalformedRequest.withDetail(err.Error())
+	}
+
+	if written > maxAttachmentSize {
+		os.Remove(file.Name())
+		return nil, errAttachmentTooLarge
+	}
+
+	unlock := attachmentFiles.lockQuota(username)
+	defer unlock()
+
+	return store_attachment(store, username, cleanAttachmentName(part.FileName()), file.Name())
+}
+
+var contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// handleUploadChunk appends one "Content-Range: bytes first-last/size" chunk to a pending upload.
+func handleUploadChunk(store Store, username string, response http.ResponseWriter, request *http.Request) {
+	upload, err := findUpload(username, request.PathValue("upload_id"))
+	if err != nil {
+		writeJsonReply(response, errUploadNotFound.status, errorReply(err))
+		return
+	}
+
+	match := contentRangePattern.FindStringSubmatch(request.Header.Get("Content-Range"))
+	if match == nil {
+		writeJsonReply(response, errMissingParameter.status, errorReply(errMissingParameter.withDetail("Content-Range: bytes first-last/size")))
+		return
+	}
+
+	first, _ := strconv.ParseInt(match[1], 10, 64)
+	last, _ := strconv.ParseInt(match[2], 10, 64)
+	total, _ := strconv.ParseInt(match[3], 10, 64)
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if total != upload.size || last < first || last >= total {
+		err := errInvalidParameter.withDetail("Content-Range does not fit an upload of " + strconv.FormatInt(upload.size, 10) + " bytes")
+		writeJsonReply(response, err.status, errorReply(err))
+		return
+	}
+
+	if first != upload.received {
+		err := errUploadOffset.withDetail("expected " + strconv.FormatInt(upload.received, 10))
+		writeJsonReply(response, err.status, errorReply(err))
+		return
+	}
+
+	file, err := os.OpenFile(upload.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		replyMap := errorReply(err)
+		writeJsonReply(response, replyStatus(replyMap), replyMap)
+		return
+	}
+
+	// a chunk cut short still counts, the client resumes from received
+	written, err := io.Copy(file, io.LimitReader(request.Body, last-first+1))
+	file.Close()
+
+	upload.received += written
+	upload.touched = time.Now()
+
+	if err != nil || written != last-first+1 {
+		err := errMalformedRequest.withDetail("chunk is shorter than its Content-Range")
+		writeJsonReply(response, err.status, errorReply(err))
+		return
+	}
+
+	writeJsonReply(response, http.StatusOK, uploadReply(upload))
+}
+
+// handleDownloadAttachment serves an attachment's file to the participants of its conversation.
+func handleDownloadAttachment(store Store, username string, response http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(request.PathValue("attachment_id"), 10, 64)
+	if err != nil {
+		writeJsonReply(response, errAttachmentNotFound.status, errorReply(errAttachmentNotFound))
+		return
+	}
+
+	row, err := store.GetAttachment(id)
+	if err == nil && !can_read_attachment(store, username, row) {
+		err = errAttachmentNotFound
+	}
+	if err != nil {
+		replyMap := errorReply(err)
+		writeJsonReply(response, replyStatus(replyMap), replyMap)
+		return
+	}
+
+	file, err := os.Open(attachmentFiles.path(row["sha256"]))
+	if err != nil {
+		replyMap := errorReply(err)
+		writeJsonReply(response, replyStatus(replyMap), replyMap)
+		return
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(row["content_type"], "image/") {
+		disposition = "inline"
+	}
+
+	created, _ := strconv.ParseInt(row["created"], 10, 64)
+
+	header := response.Header()
+	header.Set("Content-Type", row["content_type"])
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": row["filename"]}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "private")
+	header.Set("ETag", `"`+row["sha256"]+`"`)
+
+	http.ServeContent(response, request, "", time.Unix(created, 0), file)
+}
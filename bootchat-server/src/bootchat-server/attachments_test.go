@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStore widens the window between the quota check and the insert it allowed.
+type slowStore struct {
+	Store
+}
+
+func (store slowStore) CreateAttachment(owner string, sha256 string, size int64, content_type string, filename string, created time.Time) (map[string]string, error) {
+	time.Sleep(10 * time.Millisecond)
+	return store.Store.CreateAttachment(owner, sha256, size, content_type, filename, created)
+}
+
+func TestAttachmentQuotaConcurrent(t *testing.T) {
+	store := slowStore{newTestServer(t).store}
+
+	defer func(quota int64) { attachmentQuota = quota }(attachmentQuota)
+	attachmentQuota = 1000
+
+	// ten different files of 300 bytes at once, three fit
+	var wg sync.WaitGroup
+	statuses := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "a.txt")
+		part.Write([]byte(strings.Repeat(string(rune('a'+i)), 300)))
+		form.Close()
+
+		request := httptest.NewRequest("POST", "/v1/attachments", &body)
+		request.Header.Set("Content-Type", form.FormDataContentType())
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response := httptest.NewRecorder()
+			handleUploadAttachments(store, "alice", response, request)
+			statuses <- response.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	stored := 0
+	for status := range statuses {
+		if status == 201 {
+			stored++
+		} else if status != errAttachmentQuota.status {
+			t.Errorf("upload failed with %d", status)
+		}
+	}
+
+	if stored != 3 {
+		t.Errorf("%d uploads stored, the quota has room for 3", stored)
+	}
+}
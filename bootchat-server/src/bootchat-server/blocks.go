@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	Blocking
+
+	A user can block anyone. Blocking drops the contact and any friend
+	requests between the two, and from then on
+
+	 - send from the blocked user fails with message.blocked, or, with the
+	   blocker's drop_blocked privacy setting, succeeds without an id and
+	   without the message ever being stored
+	 - the blocker is hidden from the blocked user's lookups (friendrequest,
+	   createroom, addmember answer user.not_found)
+	 - the blocker can not message or befriend them either (user.blocked)
+	   until they unblock
+
+	With hide_history the blocker's one-to-one history with the blocked user
+	is left out of getallmsgs, getmsgs, getunread, getconversations and
+	search. Nothing is deleted, unblocking brings it back. Rooms are not
+	affected.
+
+	The blocker's own connections get
+
+	 {"event":"block","username":..,"action":"blocked"|"unblocked"}
+*/
+
+func blockEvent(username string, action string) map[string]interface{} {
+	return map[string]interface{}{"event": "block", "username": username, "action": action}
+}
+
+/*
+	lookup_user - resolve a user on behalf of viewer
+	 store Store
+	 viewer string (who is asking)
+	 username string (who they look for)
+
+	 returns (errUserNotFound for unknown users and for users who blocked
+	 viewer, errUserBlocked when viewer blocked them)
+*/
+func lookup_user(store Store, viewer string, username string) error {
+	if !store.UserExists(username) {
+		return errUserNotFound.withDetail(username)
+	}
+
+	if viewer == username {
+		return nil
+	}
+
+	blockedBy, err := store.IsBlocked(username, viewer)
+	if err != nil {
+		return err
+	}
+
+	if blockedBy {
+		return errUserNotFound.withDetail(username)
+	}
+
+	blocked, err := store.IsBlocked(viewer, username)
+	if err != nil {
+		return err
+	}
+
+	if blocked {
+		return errUserBlocked.withDetail(username)
+	}
+
+	return nil
+}
+
+/*
+	check_blocked - may from_user send to_user a one-to-one message
+	 store Store
+	 from_user string
+	 to_user string
+
+	 returns (drop bool, error)
+	 drop is set when to_user blocked from_user and asked for their
+	 messages to be dropped silently.
+*/
+func check_blocked(store Store, from_user string, to_user string) (bool, error) {
+	if from_user == to_user {
+		return false, nil
+	}
+
+	blocked, err := store.IsBlocked(from_user, to_user)
+	if err != nil {
+		return false, err
+	}
+
+	if blocked {
+		return false, errUserBlocked.withDetail(to_user)
+	}
+
+	blockedBy, err := store.IsBlocked(to_user, from_user)
+	if err != nil || !blockedBy {
+		return false, err
+	}
+
+	settings, err := store.GetPrivacySettings(to_user)
+	if err != nil {
+		return false, err
+	}
+
+	if settings.dropBlocked {
+		return true, nil
+	}
+
+	return false, errSenderBlocked
+}
+
+// checkBlockParam checks the "user" parameter of block and unblock.
+func checkBlockParam(user string, username string) error {
+	if user == username {
+		return errInvalidParameter.withDetail("can not block yourself")
+	}
+
+	return nil
+}
+
+/* request handlers */
+
+/*
+	block - block a user, blocking again updates hide_history
+	 user          the user
+	 hide_history  optional, hide the one-to-one history with them (default false)
+*/
+func handleBlockRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(blockParams)
+
+	user := p.User
+	if err := checkBlockParam(user, username); err != nil {
+		return errorReply(err)
+	}
+
+	if !store.UserExists(user) {
+		return errorReply(errUserNotFound.withDetail(user))
+	}
+
+	if _, err := store.BlockUser(username, user, p.HideHistory, time.Now()); err != nil {
+		return errorReply(err)
+	}
+
+	eventHub.publish(username, blockEvent(user, "blocked"))
+
+	if verbose {
+		log.Printf("%s blocked %s\n", username, user)
+	}
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	unblock - lift a block
+	 user  the user
+*/
+func handleUnblockRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	user := params.(unblockParams).User
+	if err := checkBlockParam(user, username); err != nil {
+		return errorReply(err)
+	}
+
+	removed, err := store.UnblockUser(username, user)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !removed {
+		return errorReply(errBlockNotFound.withDetail(user))
+	}
+
+	eventHub.publish(username, blockEvent(user, "unblocked"))
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	listblocked - the users the caller blocked
+	 reply: blocked [{username, nickname, hide_history, since}] by username
+*/
+func handleListBlockedRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	blocked, err := store.GetBlockedUsers(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["blocked"] = blocked
+	return replyMap
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	Configuration
+
+	Every setting has a default and can be set, from lowest to highest
+	precedence, in
+
+	 the config file    -config, BOOTCHAT_CONFIG or ./etc/bootchat.toml if
+	                    it exists
+	 the environment    BOOTCHAT_...
+	 the command line   -...
+
+	The config file is TOML, tables with strings, integers and booleans:
+
+	 listen = "0.0.0.0:8443"
+
+	 [tls]
+	 enabled = true
+
+	 [limits]
+	 session_lifetime = "72h"
+
+	configSettings lists every setting with its key, variable and flag.
+	Durations are strings such as "90s" or "1h", sizes are in bytes.
+	Everything is checked before the server or a subcommand starts, the
+	first problem is reported with where the value came from. The TLS files
+	are only loaded by the server, see tls.go.
+*/
+
+const defaultConfigFile = "./etc/bootchat.toml"
+
+type serverConfig struct {
+	listen string
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	maxHeaderSize     int
+
+	tlsEnabled  bool
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	dbDriver string
+	dbDsn    string
+
+	logLevel string
+
+	unknownParams string
+
+	attachmentDir string
+
+	passwordHasher string
+	bcryptCost     int
+}
+
+func defaultServerConfig() *serverConfig {
+	return &serverConfig{
+		listen: "127.0.0.1:8443",
+
+		readHeaderTimeout: 10 * time.Second,
+		readTimeout:       30 * time.Second,
+		writeTimeout:      30 * time.Second,
+		idleTimeout:       2 * time.Minute,
+		shutdownTimeout:   30 * time.Second,
+		maxHeaderSize:     64 << 10,
+
+		tlsEnabled: true,
+		tlsCert:    "./etc/server.crt",
+		tlsKey:     "./etc/server.key",
+
+		dbDriver:       defaultStoreDriver,
+		dbDsn:          defaultStoreDSN,
+		logLevel:       "info",
+		unknownParams:  "reject",
+		attachmentDir:  defaultAttachmentDir,
+		passwordHasher: "argon2id",
+	}
+}
+
+/* setting values, they parse what the file, the environment or a flag says */
+
+type configValue interface {
+	set(value string) error
+	String() string
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) set(value string) error {
+	*v.p = value
+	return nil
+}
+
+func (v stringValue) String() string { return *v.p }
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("must be true or false")
+	}
+	*v.p = b
+	return nil
+}
+
+func (v boolValue) String() string { return strconv.FormatBool(*v.p) }
+
+// intValue takes integers from min up.
+type intValue struct {
+	p   *int
+	min int
+}
+
+func (v intValue) set(value string) error {
+	n, err := strconv.Atoi(strings.Replace(value, "_", "", -1))
+	if err != nil || n < v.min {
+		return fmt.Errorf("must be an integer of at least %d", v.min)
+	}
+	*v.p = n
+	return nil
+}
+
+func (v intValue) String() string { return strconv.Itoa(*v.p) }
+
+// countValue takes a positive integer, sizes are counted in bytes.
+type countValue struct{ p *int64 }
+
+func (v countValue) set(value string) error {
+	n, err := strconv.ParseInt(strings.Replace(value, "_", "", -1), 10, 64)
+	if err != nil || n < 1 {
+		return errors.New("must be a positive integer")
+	}
+	*v.p = n
+	return nil
+}
+
+func (v countValue) String() string { return strconv.FormatInt(*v.p, 10) }
+
+// durationValue takes a positive duration, or 0 too with allowZero.
+type durationValue struct {
+	p         *time.Duration
+	allowZero bool
+}
+
+func (v durationValue) set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || (d == 0 && !v.allowZero) {
+		if v.allowZero {
+			return errors.New("must be a duration such as 1h, or 0 for no limit")
+		}
+		return errors.New("must be a positive duration such as 1h")
+	}
+	*v.p = d
+	return nil
+}
+
+func (v durationValue) String() string { return v.p.String() }
+
+type configSetting struct {
+	key   string // in the config file, "table.name"
+	env   string
+	flag  string
+	usage string
+	value configValue
+}
+
+/*
+	configSettings - every setting of config and the limits
+	 config *serverConfig
+
+	 returns ([]configSetting)
+	 The limits are package variables, their initial values are the defaults.
+*/
+func configSettings(config *serverConfig) []configSetting {
+	return []configSetting{
+		{"listen", "BOOTCHAT_LISTEN", "listen", "address to listen on, host:port", stringValue{&config.listen}},
+
+		{"server.read_header_timeout", "BOOTCHAT_READ_HEADER_TIMEOUT", "read-header-timeout", "time to read the request headers", durationValue{&config.readHeaderTimeout, false}},
+		{"server.read_timeout", "BOOTCHAT_READ_TIMEOUT", "read-timeout", "time to read a whole request", durationValue{&config.readTimeout, false}},
+		{"server.write_timeout", "BOOTCHAT_WRITE_TIMEOUT", "write-timeout", "time to write a reply", durationValue{&config.writeTimeout, false}},
+		{"server.idle_timeout", "BOOTCHAT_IDLE_TIMEOUT", "idle-timeout", "how long an idle keep-alive connection stays open", durationValue{&config.idleTimeout, false}},
+		{"server.transfer_timeout", "BOOTCHAT_TRANSFER_TIMEOUT", "transfer-timeout", "read and write time of an attachment upload or download", durationValue{&fileTransferTimeout, false}},
+		{"server.shutdown_timeout", "BOOTCHAT_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long a shutdown waits for requests and websockets", durationValue{&config.shutdownTimeout, false}},
+
+		{"tls.enabled", "BOOTCHAT_TLS", "tls", "serve https", boolValue{&config.tlsEnabled}},
+		{"tls.cert", "BOOTCHAT_TLS_CERT", "tls-cert", "certificate file (PEM)", stringValue{&config.tlsCert}},
+		{"tls.key", "BOOTCHAT_TLS_KEY", "tls-key", "private key file (PEM)", stringValue{&config.tlsKey}},
+		{"tls.client_ca", "BOOTCHAT_TLS_CLIENT_CA", "tls-client-ca", "CA certificates (PEM) client certificates must be signed by, empty for none", stringValue{&config.tlsClientCA}},
+
+		{"database.driver", "BOOTCHAT_DB_DRIVER", "db-driver", "sqlite3, postgres or memory", stringValue{&config.dbDriver}},
+		{"database.dsn", "BOOTCHAT_DB_DSN", "db-dsn", "database file for sqlite3, connection string for postgres", stringValue{&config.dbDsn}},
+
+		{"log.level", "BOOTCHAT_LOG_LEVEL", "log-level", "info or debug", stringValue{&config.logLevel}},
+
+		{"requests.unknown_params", "BOOTCHAT_UNKNOWN_PARAMS", "unknown-params", "reject or ignore request parameters a request does not take", stringValue{&config.unknownParams}},
+
+		{"attachments.dir", "BOOTCHAT_ATTACHMENT_DIR", "attachment-dir", "where attachment files are stored", stringValue{&config.attachmentDir}},
+
+		{"passwords.hasher", "BOOTCHAT_PASSWORD_HASHER", "password-hasher", "argon2id or bcrypt, for new hashes", stringValue{&config.passwordHasher}},
+		{"passwords.bcrypt_cost", "BOOTCHAT_BCRYPT_COST", "bcrypt-cost", "bcrypt cost, 0 for the default", intValue{&config.bcryptCost, 0}},
+
+		{"limits.max_request_size", "BOOTCHAT_MAX_REQUEST_SIZE", "max-request-size", "largest JSON request body in bytes", countValue{&maxRequestSize}},
+		{"limits.max_header_size", "BOOTCHAT_MAX_HEADER_SIZE", "max-header-size", "largest request header block in bytes", intValue{&config.maxHeaderSize, 4096}},
+		{"limits.max_attachment_size", "BOOTCHAT_MAX_ATTACHMENT_SIZE", "max-attachment-size", "largest attachment in bytes", countValue{&maxAttachmentSize}},
+		{"limits.attachment_quota", "BOOTCHAT_ATTACHMENT_QUOTA", "attachment-quota", "attachment bytes per user", countValue{&attachmentQuota}},
+		{"limits.max_attachments_per_message", "BOOTCHAT_MAX_ATTACHMENTS", "max-attachments", "attachments per message", intValue{&maxAttachmentsPerMessage, 1}},
+		{"limits.max_page_size", "BOOTCHAT_MAX_PAGE_SIZE", "max-page-size", "most messages per history or search page", countValue{&maxPageSize}},
+		{"limits.session_lifetime", "BOOTCHAT_SESSION_LIFETIME", "session-lifetime", "how long a login stays valid", durationValue{&sessionLifetime, false}},
+		{"limits.message_delete_window", "BOOTCHAT_DELETE_WINDOW", "delete-window", "how long a message can be deleted for everyone, 0 for no limit", durationValue{&messageDeleteWindow, true}},
+		{"limits.conversation_undo_window", "BOOTCHAT_UNDO_WINDOW", "undo-window", "how long a deleted conversation can be restored", durationValue{&conversationUndoWindow, false}},
+		{"limits.login_backoff", "BOOTCHAT_LOGIN_BACKOFF", "login-backoff", "wait after a failed login, doubled with every further failure", durationValue{&loginBackoff, false}},
+		{"limits.login_max_backoff", "BOOTCHAT_LOGIN_MAX_BACKOFF", "login-max-backoff", "longest wait between failed logins", durationValue{&loginMaxBackoff, false}},
+		{"limits.login_lockout_failures", "BOOTCHAT_LOCKOUT_FAILURES", "lockout-failures", "failed logins of a username before it is locked out", intValue{&loginLockoutFailures, 1}},
+		{"limits.login_ip_lockout_failures", "BOOTCHAT_IP_LOCKOUT_FAILURES", "ip-lockout-failures", "failed logins from an address before it is locked out", intValue{&loginIpLockoutFailures, 1}},
+		{"limits.login_lockout", "BOOTCHAT_LOCKOUT", "lockout", "how long a lockout lasts, older failures are forgotten", durationValue{&loginLockout, false}},
+	}
+}
+
+// configFlag is a flag given on the command line, applied after the file
+// and the environment.
+type configFlag struct {
+	setting *configSetting
+	name    string
+	value   string
+}
+
+/*
+	load_config - read the config file, environment and flags
+	 args []string (the command line without the program name)
+
+	 returns (the config, the arguments after the flags, error)
+	 flag.ErrHelp when -h was given, the usage has been printed then.
+*/
+func load_config(args []string) (*serverConfig, []string, error) {
+	config := defaultServerConfig()
+	settings := configSettings(config)
+
+	flags := flag.NewFlagSet("bootchat-server", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: bootchat-server [flags] [migrate|users|messages|db|gen-cert ...]")
+		flags.PrintDefaults()
+	}
+
+	configFile := os.Getenv("BOOTCHAT_CONFIG")
+	flags.StringVar(&configFile, "config", configFile, "config file (env BOOTCHAT_CONFIG, default "+defaultConfigFile+" if it exists)")
+
+	var given []configFlag
+	flags.BoolFunc("v", "verbose, same as -log-level debug", func(value string) error {
+		if b, err := strconv.ParseBool(value); err != nil || !b {
+			return errors.New("-v takes no value")
+		}
+		given = append(given, configFlag{&settings[indexOfSetting(settings, "log.level")], "v", "debug"})
+		return nil
+	})
+
+	for i := range settings {
+		setting := &settings[i]
+		usage := fmt.Sprintf("%s (env %s, file %s)", setting.usage, setting.env, setting.key)
+		record := func(value string) error {
+			given = append(given, configFlag{setting, setting.flag, value})
+			return nil
+		}
+
+		if _, isBool := setting.value.(boolValue); isBool {
+			flags.BoolFunc(setting.flag, usage, record)
+		} else {
+			flags.Func(setting.flag, usage+", default "+setting.value.String(), record)
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	explicit := len(configFile) > 0
+	if !explicit {
+		configFile = defaultConfigFile
+	}
+
+	entries, err := read_config_file(configFile)
+	if os.IsNotExist(err) && !explicit {
+		entries, err = nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range entries {
+		i := indexOfSetting(settings, entry.key)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: unknown setting %s", configFile, entry.line, entry.key)
+		}
+		if err = settings[i].value.set(entry.value); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %s %s", configFile, entry.line, entry.key, err.Error())
+		}
+	}
+
+	for _, setting := range settings {
+		if value, exists := os.LookupEnv(setting.env); exists {
+			if err = setting.value.set(value); err != nil {
+				return nil, nil, fmt.Errorf("%s %s", setting.env, err.Error())
+			}
+		}
+	}
+
+	for _, option := range given {
+		if err = option.setting.value.set(option.value); err != nil {
+			return nil, nil, fmt.Errorf("-%s %s", option.name, err.Error())
+		}
+	}
+
+	if err = config.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return config, flags.Args(), nil
+}
+
+func indexOfSetting(settings []configSetting, key string) int {
+	for i := range settings {
+		if settings[i].key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// validate checks what the values cannot check alone.
+func (config *serverConfig) validate() error {
+	_, port, err := net.SplitHostPort(config.listen)
+	if err != nil {
+		return fmt.Errorf("listen must be host:port, got %q", config.listen)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("listen port must be 1 to 65535, got %q", port)
+	}
+
+	if len(config.tlsClientCA) > 0 && !config.tlsEnabled {
+		return errors.New("tls.client_ca needs tls.enabled")
+	}
+
+	switch config.dbDriver {
+	case "sqlite3", "postgres":
+		if len(config.dbDsn) == 0 {
+			return errors.New("database.dsn is empty")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("database.driver must be sqlite3, postgres or memory, got %q", config.dbDriver)
+	}
+
+	if config.logLevel != "info" && config.logLevel != "debug" {
+		return fmt.Errorf("log.level must be info or debug, got %q", config.logLevel)
+	}
+
+	if loginMaxBackoff < loginBackoff {
+		return fmt.Errorf("limits.login_max_backoff (%s) is shorter than limits.login_backoff (%s)", loginMaxBackoff, loginBackoff)
+	}
+
+	if config.unknownParams != "reject" && config.unknownParams != "ignore" {
+		return fmt.Errorf("requests.unknown_params must be reject or ignore, got %q", config.unknownParams)
+	}
+
+	if len(config.attachmentDir) == 0 {
+		return errors.New("attachments.dir is empty")
+	}
+
+	if config.bcryptCost != 0 && (config.bcryptCost < bcrypt.MinCost || config.bcryptCost > bcrypt.MaxCost) {
+		return fmt.Errorf("passwords.bcrypt_cost must be 0 or %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if err = select_password_hasher(config.passwordHasher, config.bcryptCost); err != nil {
+		return fmt.Errorf("passwords.hasher must be argon2id or bcrypt, got %q", config.passwordHasher)
+	}
+
+	return nil
+}
+
+/* config file */
+
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+/*
+	read_config_file - parse the TOML subset described above
+	 path string
+
+	 returns (the settings in file order, error)
+	 A missing file is an os.IsNotExist error.
+*/
+func read_config_file(path string) ([]configEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []configEntry
+	seen := make(map[string]bool)
+	table := ""
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || !isConfigComment(line[end+1:]) || !isConfigKey(strings.TrimSpace(line[1:end])) {
+				return nil, fmt.Errorf("%s:%d: malformed table header", path, number)
+			}
+			table = strings.TrimSpace(line[1:end])
+			continue
+		}
+
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, number)
+		}
+
+		key := strings.TrimSpace(line[:equals])
+		if !isConfigKey(key) {
+			return nil, fmt.Errorf("%s:%d: malformed key %q", path, number, key)
+		}
+		if len(table) > 0 {
+			key = table + "." + key
+		}
+
+		value, err := parseConfigValue(strings.TrimSpace(line[equals+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s %s", path, number, key, err.Error())
+		}
+
+		if seen[key] {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, number, key)
+		}
+		seen[key] = true
+
+		entries = append(entries, configEntry{key, value, number})
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// parseConfigValue returns a string without its quotes, an integer or a
+// boolean as written, the rest of the line may only be a comment.
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) {
+		for end := 1; end < len(raw); end++ {
+			if raw[end] == '\\' {
+				end++
+				continue
+			}
+			if raw[end] == '"' {
+				value, err := strconv.Unquote(raw[:end+1])
+				if err != nil || !isConfigComment(raw[end+1:]) {
+					break
+				}
+				return value, nil
+			}
+		}
+		return "", errors.New("has a malformed string")
+	}
+
+	if strings.HasPrefix(raw, "'") {
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 || !isConfigComment(raw[end+2:]) {
+			return "", errors.New("has a malformed string")
+		}
+		return raw[1 : end+1], nil
+	}
+
+	if hash := strings.IndexByte(raw, '#'); hash >= 0 {
+		raw = strings.TrimSpace(raw[:hash])
+	}
+
+	if raw == "true" || raw == "false" {
+		return raw, nil
+	}
+
+	if _, err := strconv.ParseInt(strings.Replace(raw, "_", "", -1), 10, 64); err == nil {
+		return raw, nil
+	}
+
+	return "", errors.New("must be a quoted string, an integer, true or false")
+}
+
+func isConfigComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return len(rest) == 0 || rest[0] == '#'
+}
+
+func isConfigKey(key string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, c := range key {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	Contacts - friends kept on the server
+
+	A user sends a friend request, the other side accepts or declines it and
+	an accepted request makes the two contacts of each other. Requests that
+	cross (both asked) are accepted right away. Either side can remove the
+	contact again, which removes it for both.
+
+	With the contacts_only privacy setting a user only receives one-to-one
+	messages from their contacts, send fails with message.contacts_only for
+	everybody else. Rooms are not affected.
+
+	Both sides are told about changes:
+
+	 {"event":"friend_request","username":..,"action":"received"|"accepted"|"declined"|"cancelled"}
+	 {"event":"contact","username":..,"action":"added"|"removed"}
+*/
+
+// privacySettings are the per-account switches of setprivacy.
+type privacySettings struct {
+	contactsOnly bool
+	dropBlocked  bool // see blocks.go
+}
+
+func friendRequestEvent(username string, action string) map[string]interface{} {
+	return map[string]interface{}{"event": "friend_request", "username": username, "action": action}
+}
+
+func contactEvent(username string, action string) map[string]interface{} {
+	return map[string]interface{}{"event": "contact", "username": username, "action": action}
+}
+
+// getContactParam reads the other user of a contact request, it must not be username.
+func getContactParam(params interface{}, username string) (string, error) {
+	contact := params.(contactParams).Contact
+
+	if contact == username {
+		return "", errContactSelf
+	}
+
+	return contact, nil
+}
+
+/*
+	check_contacts_only - may from_user send to_user a one-to-one message
+	 store Store
+	 from_user string
+	 to_user string
+
+	 returns (errContactsOnly when to_user only accepts contacts and from_user is none)
+*/
+func check_contacts_only(store Store, from_user string, to_user string) error {
+	if from_user == to_user {
+		return nil
+	}
+
+	settings, err := store.GetPrivacySettings(to_user)
+	if err != nil || !settings.contactsOnly {
+		return err
+	}
+
+	isContact, err := store.IsContact(to_user, from_user)
+	if err != nil {
+		return err
+	}
+
+	if !isContact {
+		return errContactsOnly
+	}
+
+	return nil
+}
+
+// acceptFriendRequest makes from_user and to_user contacts and tells both.
+func acceptFriendRequest(store Store, from_user string, to_user string) error {
+	if err := store.AcceptFriendRequest(from_user, to_user, time.Now()); err != nil {
+		return err
+	}
+
+	eventHub.publish(from_user, friendRequestEvent(to_user, "accepted"))
+	eventHub.publish(from_user, contactEvent(to_user, "added"))
+	eventHub.publish(to_user, contactEvent(from_user, "added"))
+
+	if verbose {
+		log.Printf("%s and %s are now contacts\n", from_user, to_user)
+	}
+
+	return nil
+}
+
+/* request handlers */
+
+/*
+	friendrequest - ask another user to become a contact
+	 contact  the user
+
+	 reply: status "pending", or "accepted" when contact had already asked
+*/
+func handleFriendRequestRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	contact, err := getContactParam(params, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err = lookup_user(store, username, contact); err != nil {
+		return errorReply(err)
+	}
+
+	isContact, err := store.IsContact(username, contact)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if isContact {
+		return errorReply(errContactExists.withDetail(contact))
+	}
+
+	crossed, err := store.HasFriendRequest(contact, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if crossed {
+		if err = acceptFriendRequest(store, contact, username); err != nil {
+			return errorReply(err)
+		}
+
+		replyMap["success"] = true
+		replyMap["status"] = "accepted"
+		return replyMap
+	}
+
+	created, err := store.CreateFriendRequest(username, contact, time.Now())
+	if err != nil {
+		return errorReply(err)
+	}
+
+	// asking twice is not an error and does not notify again
+	if created {
+		eventHub.publish(contact, friendRequestEvent(username, "received"))
+	}
+
+	replyMap["success"] = true
+	replyMap["status"] = "pending"
+	return replyMap
+}
+
+/*
+	acceptfriend - accept a friend request
+	 contact  the user who sent it
+*/
+func handleAcceptFriendRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	contact, err := getContactParam(params, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err = acceptFriendRequest(store, contact, username); err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	declinefriend - decline a friend request
+	 contact  the user who sent it
+*/
+func handleDeclineFriendRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	contact, err := getContactParam(params, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	deleted, err := store.DeleteFriendRequest(contact, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !deleted {
+		return errorReply(errNoFriendRequest)
+	}
+
+	eventHub.publish(contact, friendRequestEvent(username, "declined"))
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	cancelfriend - withdraw a friend request you sent
+	 contact  the user it was sent to
+*/
+func handleCancelFriendRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	contact, err := getContactParam(params, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	deleted, err := store.DeleteFriendRequest(username, contact)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !deleted {
+		return errorReply(errNoFriendRequest)
+	}
+
+	eventHub.publish(contact, friendRequestEvent(username, "cancelled"))
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	getfriendreqs - pending friend requests
+	 reply: incoming and outgoing [{username, nickname, created}] newest first
+*/
+func handleGetFriendRequestsRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	incoming, outgoing, err := store.GetFriendRequests(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["incoming"] = incoming
+	replyMap["outgoing"] = outgoing
+	return replyMap
+}
+
+/*
+	getcontacts - the caller's contacts
+	 reply: contacts [{username, nickname, since}] by username
+*/
+func handleGetContactsRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	contacts, err := store.GetContacts(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["contacts"] = contacts
+	return replyMap
+}
+
+/*
+	removecontact - remove a contact, for both sides
+	 contact  the user
+*/
+func handleRemoveContactRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	contact, err := getContactParam(params, username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	removed, err := store.RemoveContact(username, contact)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !removed {
+		return errorReply(errContactNotFound.withDetail(contact))
+	}
+
+	eventHub.publish(username, contactEvent(contact, "removed"))
+	eventHub.publish(contact, contactEvent(username, "removed"))
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	getprivacy - the caller's privacy settings
+	 reply: contacts_only, drop_blocked
+*/
+func handleGetPrivacyRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	settings, err := store.GetPrivacySettings(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["contacts_only"] = settings.contactsOnly
+	replyMap["drop_blocked"] = settings.dropBlocked
+	return replyMap
+}
+
+/*
+	setprivacy - change privacy settings, absent ones keep their value
+	 contacts_only  only accept one-to-one messages from contacts
+	 drop_blocked   silently drop messages from blocked users instead of rejecting them
+
+	 reply: the settings as getprivacy
+*/
+func handleSetPrivacyRequest(store Store, username string, params interface{}) map[string]interface{} {
+	p := params.(privacyParams)
+
+	settings, err := store.GetPrivacySettings(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if p.ContactsOnly != nil {
+		settings.contactsOnly = *p.ContactsOnly
+	}
+
+	if p.DropBlocked != nil {
+		settings.dropBlocked = *p.DropBlocked
+	}
+
+	if err = store.SetPrivacySettings(username, settings); err != nil {
+		return errorReply(err)
+	}
+
+	return handleGetPrivacyRequest(store, username, nil)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+	Conversation list
+
+	getconversations returns everything a client needs to draw its sidebar
+	in one call: a row per peer the user has exchanged one-to-one messages
+	with and per room they are a member of, newest activity first, each with
+	the last message (sender, first conversationSnippetLength characters,
+	date), the unread count and the user's mute and archive settings. Mute
+	and archive are only stored for the client, the server still delivers
+	and pushes every message.
+
+	deleteconv deletes a one-to-one conversation for the caller only: their
+	history, search, unread counts and this list leave out everything up to
+	the newest message at that moment, the other side keeps theirs. Within
+	conversationUndoWindow restoreconv brings it back. Once both sides
+	deleted and neither can undo anymore, the messages both deleted are
+	removed for good by the purge every conversationPurgeInterval.
+*/
+
+const conversationSnippetLength = 100
+
+// conversationUndoWindow can be changed in the config, see config.go
+var conversationUndoWindow = 5 * time.Minute
+
+const conversationPurgeInterval = 10 * time.Minute
+
+// purge_conversations removes the messages every participant deleted.
+func purge_conversations(store Store) {
+	removed, err := store.PurgeConversations(time.Now().Add(-conversationUndoWindow))
+	if err != nil {
+		log.Printf("Unable to purge deleted conversations: %s", err.Error())
+		return
+	}
+
+	if removed > 0 {
+		purge_attachments(store)
+
+		if verbose {
+			log.Printf("Purged %d deleted message(s)\n", removed)
+		}
+	}
+}
+
+// run_conversation_purge purges every conversationPurgeInterval, it never returns.
+func run_conversation_purge(store Store) {
+	ticker := time.NewTicker(conversationPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purge_conversations(store)
+	}
+}
+
+// sortConversations orders conversation rows by last_id, newest first.
+func sortConversations(conversations []map[string]string) []map[string]string {
+	sort.SliceStable(conversations, func(i, j int) bool {
+		a, _ := strconv.ParseInt(conversations[i]["last_id"], 10, 64)
+		b, _ := strconv.ParseInt(conversations[j]["last_id"], 10, 64)
+		return a > b
+	})
+
+	return conversations
+}
+
+/*
+	getconversations - the user's conversations, newest first
+	 archived  optional, true for only archived conversations, false for
+	           only the others (default: all)
+
+	 reply: conversations [{type, peer | room_id and name, last_id, last_from,
+	 snippet, date, unread, muted, archived}]
+*/
+func handleGetConversationsRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	archived := params.(conversationsParams).Archived
+
+	conversations, err := store.GetConversations(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if archived != nil {
+		want := strconv.Itoa(boolToInt(*archived))
+		kept := make([]map[string]string, 0, len(conversations))
+		for _, conversation := range conversations {
+			if conversation["archived"] == want {
+				kept = append(kept, conversation)
+			}
+		}
+		conversations = kept
+	}
+
+	replyMap["success"] = true
+	replyMap["conversations"] = conversations
+	return replyMap
+}
+
+/*
+	setconversation - mute or archive a conversation
+	 peer or room_id  the conversation
+	 muted            optional bool
+	 archived         optional bool
+
+	 reply: muted, archived (the stored state)
+*/
+func handleSetConversationRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(setConversationParams)
+
+	peer, room_id := p.Peer, p.RoomId
+
+	if (len(peer) > 0) == (room_id > 0) {
+		return errorReply(errMissingParameter.withDetail("exactly one of peer and room_id"))
+	}
+
+	if room_id > 0 {
+		if err := requireRoomRole(store, room_id, username, false); err != nil {
+			return errorReply(err)
+		}
+	} else if !store.UserExists(peer) {
+		return errorReply(errUserNotFound.withDetail(peer))
+	}
+
+	muted, archived, err := store.GetConversationState(username, peer, room_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if p.Muted != nil {
+		muted = *p.Muted
+	}
+
+	if p.Archived != nil {
+		archived = *p.Archived
+	}
+
+	if err = store.SetConversationState(username, peer, room_id, muted, archived); err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["muted"] = muted
+	replyMap["archived"] = archived
+	return replyMap
+}
@@ -2,13 +2,9 @@ package main
 
 import (
 	"crypto/md5"
-	"database/sql"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"log"
-	"strconv"
 	"time"
 )
 
@@ -18,142 +14,120 @@ func md5Sum(str string) string {
 	return hex.EncodeToString(csum[:])
 }
 
-func open_database(verboseEnable bool) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./etc/bootchat.db")
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
-}
-
 /*
 	add_user - Add a new user to the accounts TABLE
-	 db sql.DB
+	 store Store
 	 username string
-	 nickname string
-	 gender string (max length = 1)
+	 nickname string (optional)
 	 question string
 	 answer string
 	 password string
 
 	 returns (error)
 */
-func add_user(db *sql.DB, username string, question string, answer string, password string) error {
+func add_user(store Store, username string, nickname string, question string, answer string, password string) error {
 
-	exists := user_exists(db, username)
+	exists := store.UserExists(username)
 	if exists {
-		return errors.New("User already exists.")
+		return errUserExists
 	}
 
 	if verbose {
 		log.Printf("Creating new user: %s\n", username)
 	}
 
-	password = md5Sum(password)
-
-	statement := "INSERT INTO accounts(username,security_question,security_answer,password) VALUES(?,?,?,?)"
-
-	stmt, err := db.Prepare(statement)
+	password, err := hash_password(password)
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(username, question, answer, password)
-	stmt.Close()
-
-	return err
+	return store.CreateAccount(username, nickname, question, answer, password)
 }
 
-func set_password(db *sql.DB, username string, password string) error {
+func set_password(store Store, username string, password string) error {
 
-	statement := "UPDATE accounts SET password = ? WHERE username = ?"
-	stmt, err := db.Prepare(statement)
+	encoded, err := hash_password(password)
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(md5Sum(password), username)
-	stmt.Close()
-
-	return err
+	return store.SetPasswordHash(username, encoded)
 }
 
 /*
-	user_exists - check if a user exists in accounts
-	 db *sql.DB
+	veriy_user_login - checks if a username and password combo is valid
+	 store Store
 	 username string
-
-	 returns (bool)
+	 password string
+	 remote string (the client address, see clientAddress)
+	 returns (bool, error)
+	 A valid combo of a disabled account is (false, errAccountDisabled).
+	 Too many failures are refused with errTooManyAttempts or errLockedOut
+	 without checking the password, see lockout.go.
 */
-func user_exists(db *sql.DB, username string) bool {
-	statement := "SELECT EXISTS(SELECT id FROM accounts WHERE username = ? LIMIT 1)"
-
-	stmt, err := db.Prepare(statement)
-	if err != nil {
-		return false
-	}
-
-	row, err := stmt.Query(username)
+func verify_user_login(store Store, username string, password string, remote string) (bool, error) {
+	attempt, err := begin_login_attempt(store, username, remote)
 	if err != nil {
-		return false
+		if verbose {
+			log.Printf("Refused login of %s from %s: %s", username, remote, err.Error())
+		}
+		return false, err
 	}
 
-	var result bool
+	success, err := check_user_login(store, username, password)
+	attempt.finish(store, success, err)
 
-	row.Next()
-	row.Scan(&result)
-	row.Close()
-	stmt.Close()
-
-	return result
+	return success, err
 }
 
-/*
-	veriy_user_login - checks if a username and password combo is valid
-	 db *sql.DB
-	 username string
-	 password string
-	 returns (bool)
-*/
-func verify_user_login(db *sql.DB, username string, password string) (bool, error) {
+func check_user_login(store Store, username string, password string) (bool, error) {
 
 	if verbose {
 		log.Printf("Attempting to login user: %s  ", username)
 	}
 
-	statement := "SELECT id,password FROM accounts WHERE username = ?"
-
-	stmt, err := db.Prepare(statement)
+	password_, err := store.GetPasswordHash(username)
 	if err != nil {
 		if verbose {
 			log.Println("Failed (breakpoint 1)")
 		}
-		stmt.Close()
 		return false, err
 	}
 
-	row, err := stmt.Query(username)
+	// an unknown username takes as long as a wrong password
+	if len(password_) == 0 {
+		check_dummy_password(password)
+	}
+
+	match, rehash, err := check_password(password, password_)
 	if err != nil {
 		if verbose {
-			log.Println("Failed (breakpoint 2)")
+			log.Printf("Failed (breakpoint 4): %s", err.Error())
 		}
-		row.Close()
-		stmt.Close()
 		return false, err
 	}
 
-	row.Next()
+	if match {
+		disabled, err := store.AccountDisabled(username)
+		if err != nil {
+			return false, err
+		}
 
-	var id int
-	var password_ string
-	row.Scan(&id, &password_)
-	row.Close()
-	stmt.Close()
+		if disabled {
+			if verbose {
+				log.Println("Failed (account disabled)")
+			}
+			return false, errAccountDisabled
+		}
 
-	if password_ == md5Sum(password) {
 		if verbose {
 			log.Println("Success")
 		}
+
+		if rehash {
+			upgradeLegacyPassword(store, username, password)
+		}
+
 		return true, nil
 	}
 
@@ -163,296 +137,153 @@ func verify_user_login(db *sql.DB, username string, password string) (bool, erro
 	return false, nil
 }
 
-func get_control_user_row(db *sql.DB, username string) (map[string]string, error) {
-	statement := "SELECT id,security_question,security_answer FROM accounts WHERE username = ?"
-
-	stmt, err := db.Prepare(statement)
-
-	if err != nil {
-		return nil, err
-	}
-
-	row, err := stmt.Query(username)
-
-	if err != nil {
-		return nil, err
-	}
-
-	var id int
-	var security_question string
-	var security_answer string
-
-	row.Next()
-
-	row.Scan(&id, &security_question, &security_answer)
-	row.Close()
-	stmt.Close()
-
-	userRow := make(map[string]string)
-	userRow["id"] = strconv.Itoa(id)
-	userRow["security_question"] = security_question
-	userRow["security_answer"] = security_answer
-
-	if verbose {
-		log.Printf("Got control user row: %s", username)
-	}
-
-	return userRow, nil
-}
-
-func get_user_row(db *sql.DB, username string) (map[string]string, error) {
-	statement := "SELECT id,nickname,gender,new_message FROM accounts WHERE username = ?"
-
-	stmt, err := db.Prepare(statement)
-
-	if err != nil {
-		return nil, err
+// upgradeLegacyPassword re-hashes a verified password with the current hasher.
+// A failure here must not fail the login, the old hash is still valid.
+func upgradeLegacyPassword(store Store, username string, password string) {
+	encoded, err := hash_password(password)
+	if err == nil {
+		err = store.SetPasswordHash(username, encoded)
 	}
 
-	row, err := stmt.Query(username)
-
 	if err != nil {
-		return nil, err
+		log.Printf("Unable to upgrade password hash for %s: %s", username, err.Error())
+		return
 	}
 
-	var id int
-	var nickname string
-	var gender string
-	var new_message int
-
-	row.Next()
-
-	row.Scan(&id, &nickname, &gender, &new_message)
-	row.Close()
-	stmt.Close()
-
-	userRow := make(map[string]string)
-	userRow["id"] = strconv.Itoa(id)
-	userRow["nickname"] = nickname
-	userRow["gender"] = gender
-	userRow["new_message"] = strconv.Itoa(new_message)
-
 	if verbose {
-		log.Printf("Got user row: %s, %s", nickname, gender)
+		log.Printf("Upgraded password hash for %s to %s", username, passwordHasher.Name())
 	}
-
-	return userRow, nil
 }
 
 /*
-	delete_user - deletes a user from the account TABLE
-	 db *sql.DB
+	delete_convo - delete username's side of the conversation with to_user
+	 store Store
+	 to_user string
 	 username string
 
-	 returns (error)
+	 returns (the id it was deleted up to, error)
 */
-func delete_user(db *sql.DB, username string) error {
-	statement := "DELETE FROM accounts WHERE username = ?"
-
-	stmt, err := db.Prepare(statement)
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(username)
-	stmt.Close()
-	return err
-}
-
-func delete_convo(db *sql.DB, to_user string, username string) error {
-	exists := user_exists(db, to_user)
+func delete_convo(store Store, to_user string, username string) (int64, error) {
+	exists := store.UserExists(to_user)
 	if !exists {
-		return errors.New("user does not exist")
+		return 0, errUserNotFound
 	}
 
-	statement := "DELETE FROM messages WHERE (to_user = ? AND from_user = ?) OR (to_user = ? AND from_user = ?)"
-
 	if verbose {
 		log.Printf("Deleting conversation for user %s to user %s.", username, to_user)
 	}
 
-	stmt, err := db.Prepare(statement)
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(to_user, username, username, to_user)
-	stmt.Close()
-
-	if err == nil {
-		return nil
-	}
-
-	return err
+	return store.DeleteConversation(username, to_user, time.Now())
 }
 
 /*
 	print_accounts - dumps the account table to stdout
-	 db *sql.DB
+	 store Store
 	 returns (error)
 */
-func print_accounts(db *sql.DB) error {
-	statement := "SELECT id,username,nickname,password FROM accounts"
-
-	stmt, err := db.Prepare(statement)
+func print_accounts(store Store) error {
+	accounts, err := store.ListAccounts()
 	if err != nil {
 		return err
 	}
 
-	rows, _ := stmt.Query()
-
-	var id int
-	var account string
-	var nickname string
-	var password string
-
-	fmt.Println("-------------------------------------\n")
-	for rows.Next() {
-		rows.Scan(&id, &account, &nickname, &password)
-		fmt.Printf("User ID: %d\n\tUsername: %s\n\tNickname: %s\n\tPassword: %s\n", id, account, nickname, password)
+	fmt.Println("-------------------------------------")
+	for _, account := range accounts {
+		disabled := "no"
+		if account["disabled"] == "1" {
+			disabled = "yes"
+		}
+		fmt.Printf("User ID: %s\n\tUsername: %s\n\tNickname: %s\n\tDisabled: %s\n", account["id"], account["username"], account["nickname"], disabled)
 	}
-	fmt.Println("-------------------------------------\n")
+	fmt.Println("-------------------------------------")
 
-	rows.Close()
-	stmt.Close()
 	return nil
 }
 
-func set_new_message_flag(db *sql.DB, username string, value int) error {
-	statement := "UPDATE accounts SET new_message = ? WHERE username = ?"
+/*
+	delete_user - remove an account, its sessions, contacts, blocks, room
+	memberships and conversation settings
+	 store Store
+	 username string
 
-	stmt, err := db.Prepare(statement)
-	if err != nil {
-		return err
+	 returns (error)
+	 Messages stay, the other side of each conversation keeps its history,
+	 and so the username can not be registered again.
+	 Rooms are left like leaveroom, an emptied room is deleted. A running
+	 server closes its websockets at their next ping (see websocket.go).
+*/
+func delete_user(store Store, username string) error {
+	if !store.UserExists(username) {
+		return errUserNotFound.withDetail(username)
 	}
 
-	_, err = stmt.Exec(value, username)
-	stmt.Close()
-
-	return err
-}
-
-func get_new_message_flag(db *sql.DB, username string) (int, error) {
-	statement := "SELECT new_message FROM accounts WHERE username = ?"
-
-	stmt, err := db.Prepare(statement)
-	if err != nil {
-		return 0, err
+	if _, err := delete_user_sessions(store, username); err != nil {
+		return err
 	}
 
-	row, err := stmt.Query(username)
-	if err != nil {
-		stmt.Close()
-		return 0, err
+	if verbose {
+		log.Printf("Deleting user: %s\n", username)
 	}
 
-	var new_message int
-	row.Next()
-	row.Scan(&new_message)
-	row.Close()
-	stmt.Close()
+	if err := store.DeleteUser(username); err != nil {
+		return err
+	}
 
-	return new_message, nil
+	// the rooms it emptied leave their attachments behind
+	purge_attachments(store)
+	return nil
 }
 
-func get_all_messages(db *sql.DB, username string) ([]map[string]string, error) {
-	statement := "SELECT to_user,from_user,body,time FROM messages WHERE to_user = ? OR from_user = ? ORDER BY ID ASC LIMIT 100"
-
-	stmt, err := db.Prepare(statement)
-	if err != nil {
-		return nil, err
-	}
+/*
+	disable_user - lock an account out, or let it back in
+	 store Store
+	 username string
+	 disabled bool
 
-	rows, err := stmt.Query(username, username)
-	if err != nil {
-		stmt.Close()
-		return nil, err
+	 returns (error)
+	 Disabling also revokes every session of the account. This runs in the
+	 users command, a running server closes the websockets of a revoked
+	 session at their next ping (see websocket.go).
+*/
+func disable_user(store Store, username string, disabled bool) error {
+	if err := store.SetAccountDisabled(username, disabled); err != nil {
+		return err
 	}
 
-	var to_user string
-	var from_user string
-	var body string
-	var msgtime string
-
-	listOfRows := make([]map[string]string, 0)
-	var i int = 0
-
-	for rows.Next() {
-		if i >= 100 {
-			break
-		}
-		rows.Scan(&to_user, &from_user, &body, &msgtime)
-		row := make(map[string]string)
-		row["to_user"] = to_user
-		row["from_user"] = from_user
-		row["body"] = body
-		row["date"] = msgtime
-		listOfRows = append(listOfRows, row)
-		i += 1
+	if !disabled {
+		return nil
 	}
 
-	rows.Close()
-	stmt.Close()
-
-	return listOfRows, nil
+	_, err := delete_user_sessions(store, username)
+	return err
 }
 
-func send_message(db *sql.DB, to_user string, from_user string, body string) error {
-	statement := "INSERT INTO messages(to_user,from_user,body,time) VALUES(?,?,?,?)"
-
+/*
+	send_message - store a message and raise the recipient's new message flag
+	 store Store
+	 to_user string
+	 from_user string
+	 body string
+	 attachments []int64 (unsent uploads of from_user)
+
+	 returns (the stored message row, error)
+*/
+func send_message(store Store, to_user string, from_user string, body string, attachments []int64) (map[string]string, error) {
 	if verbose {
 		log.Printf("Sending message to %s from %s...", to_user, from_user)
 	}
 
-	stmt, err := db.Prepare(statement)
+	row, err := store.SendMessage(to_user, from_user, body, attachments)
 	if err != nil {
 		if verbose {
 			log.Printf("Failed: %s", err.Error())
 		}
-		return err
+		return nil, err
 	}
 
-	_, err = stmt.Exec(to_user, from_user, body, time.Now().String())
-	stmt.Close()
-
-	if err == nil {
-		err = set_new_message_flag(db, to_user, 1)
-		if verbose {
-			log.Println("Success")
-		}
+	if verbose {
+		log.Println("Success")
 	}
 
-	return err
+	return row, nil
 }
-
-/*
-func init_tables(db *sql.DB) (error){
-
-	db.Exec("DROP TABLE IF EXISTS accounts")
-	statement := "CREATE TABLE IF NOT EXISTS accounts (\n"
-	statement += "id INTEGER PRIMARY KEY AUTOINCREMENT,\n"
-	statement += "username VARCHAR(32) UNIQUE,\n"
-	statement += "nickname VARCHAR(32) UNIQUE,\n"
-	statement += "gender CHARACTER(1),\n"
-	statement += "picture TEXT,\n"
-	statement += "security_question VARCHAR(256),\n"
-	statement += "security_answer VARCHAR(256),\n"
-	statement += "password VARCHAR(128)\n"
-	statement += ");"
-
-	db.Exec(statement)
-
-	db.Exec("DROP TABLE IF EXISTS messages")
-	statement = "CREATE TABLE IF NOT EXISTS messages (\n"
-	statement += "id INTEGER PRIMARY KEY AUTOINCREMENT,\n"
-	statement += "to_user VARCHAR(32),\n"
-	statement += "from_user VARCHAR(32),\n"
-	statement += "body VARCHAR(10000),\n"
-	statement += "time VARCHAR(32)\n"
-	statement += ");"
-
-	db.Exec(statement)
-
-	return nil
-}
-*/
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+	Editing and deleting messages
+
+	send replies with the id of the new message, editmsg and deletemsg take
+	it as message_id. Both work on one-to-one and room messages alike.
+
+	Only the sender can edit. Every edit keeps the replaced body as a
+	revision (getrevisions lists them) and stamps edited_at, which history,
+	search and the events carry from then on.
+
+	deletemsg deletes
+
+	 for me        any message the caller can see, at any time. It is left
+	               out of their history and search only.
+	 for everyone  only the sender's own messages, and only within
+	               messageDeleteWindow of sending. The message stays as a
+	               tombstone with an empty body and deleted_at, its
+	               revisions and attachments are removed.
+
+	Everyone in the conversation gets
+
+	 {"event":"message_edited","message":{..}}
+	 {"event":"message_deleted","id":..,"scope":"everyone"}
+
+	and a delete for me only goes to the caller's own connections, with
+	scope "me".
+*/
+
+const defaultMessageDeleteWindow = time.Hour
+
+// messageDeleteWindow is how long after sending a message can be deleted
+// for everyone, 0 for no limit. It can be changed in the config, see
+// config.go.
+var messageDeleteWindow = defaultMessageDeleteWindow
+
+const deleteScopeMe = "me"
+const deleteScopeEveryone = "everyone"
+
+func messageEditedEvent(message map[string]string) map[string]interface{} {
+	return map[string]interface{}{"event": "message_edited", "message": message}
+}
+
+func messageDeletedEvent(id int64, scope string) map[string]interface{} {
+	return map[string]interface{}{"event": "message_deleted", "id": id, "scope": scope}
+}
+
+/*
+	lookup_message - load a message on behalf of username
+	 store Store
+	 username string
+	 id int64
+
+	 returns (the message row with created, error)
+	 errMessageNotFound unless username sent or received it or is a member
+	 of its room.
+*/
+func lookup_message(store Store, username string, id int64) (map[string]string, error) {
+	message, err := store.GetMessage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message["room_id"]) > 0 {
+		room_id, _ := strconv.ParseInt(message["room_id"], 10, 64)
+
+		role, err := store.GetRoomRole(room_id, username)
+		if err != nil {
+			return nil, err
+		}
+		if len(role) == 0 {
+			return nil, errMessageNotFound
+		}
+	} else if message["to_user"] != username && message["from_user"] != username {
+		return nil, errMessageNotFound
+	}
+
+	return message, nil
+}
+
+// publishMessageEvent sends event to everyone in message's conversation.
+func publishMessageEvent(store Store, message map[string]string, event map[string]interface{}) {
+	if len(message["room_id"]) > 0 {
+		room_id, _ := strconv.ParseInt(message["room_id"], 10, 64)
+		publishRoomEvent(store, room_id, event)
+		return
+	}
+
+	eventHub.publish(message["from_user"], event)
+	if message["to_user"] != message["from_user"] {
+		eventHub.publish(message["to_user"], event)
+	}
+}
+
+/* request handlers */
+
+/*
+	editmsg - replace the body of a message the caller sent
+	 message_id  the message
+	 body        the new body
+
+	 reply: message, the updated row
+*/
+func handleEditMessageRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(editMessageParams)
+
+	message_id, body := p.MessageId, p.Body
+
+	if len(body) < 1 {
+		return errorReply(errEmptyMessage)
+	}
+
+	message, err := lookup_message(store, username, message_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if message["from_user"] != username {
+		return errorReply(errNotMessageSender)
+	}
+
+	if len(message["deleted_at"]) > 0 {
+		return errorReply(errMessageDeleted)
+	}
+
+	delete(message, "created")
+
+	// an unchanged body is not a revision
+	if body != message["body"] {
+		now := time.Now()
+		if err = store.EditMessage(message_id, body, now); err != nil {
+			return errorReply(err)
+		}
+
+		message["body"] = body
+		message["edited_at"] = strconv.FormatInt(now.Unix(), 10)
+
+		publishMessageEvent(store, message, messageEditedEvent(message))
+
+		if verbose {
+			log.Printf("%s edited message %d\n", username, message_id)
+		}
+	}
+
+	replyMap["success"] = true
+	replyMap["message"] = message
+	return replyMap
+}
+
+/*
+	deletemsg - delete a message
+	 message_id  the message
+	 scope       "me" (default) or "everyone", see above
+*/
+func handleDeleteMessageRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(deleteMessageParams)
+
+	message_id := p.MessageId
+
+	// the validate tag only lets me and everyone through
+	scope := p.Scope
+	if len(scope) == 0 {
+		scope = deleteScopeMe
+	}
+
+	message, err := lookup_message(store, username, message_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if scope == deleteScopeMe {
+		if err = store.HideMessage(username, message_id); err != nil {
+			return errorReply(err)
+		}
+
+		eventHub.publish(username, messageDeletedEvent(message_id, deleteScopeMe))
+
+		replyMap["success"] = true
+		return replyMap
+	}
+
+	if message["from_user"] != username {
+		return errorReply(errNotMessageSender)
+	}
+
+	// deleting twice changes nothing
+	if len(message["deleted_at"]) > 0 {
+		replyMap["success"] = true
+		return replyMap
+	}
+
+	created, _ := strconv.ParseInt(message["created"], 10, 64)
+	if messageDeleteWindow > 0 && time.Since(time.Unix(created, 0)) > messageDeleteWindow {
+		return errorReply(errDeleteWindowClosed)
+	}
+
+	if err = store.DeleteMessage(message_id, time.Now()); err != nil {
+		return errorReply(err)
+	}
+
+	purge_attachments(store)
+
+	publishMessageEvent(store, message, messageDeletedEvent(message_id, deleteScopeEveryone))
+
+	if verbose {
+		log.Printf("%s deleted message %d for everyone\n", username, message_id)
+	}
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+/*
+	getrevisions - the earlier bodies of a message
+	 message_id  the message
+
+	 reply: revisions [{body, replaced}] oldest first, replaced is when the
+	 body was edited away
+*/
+func handleGetRevisionsRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	message_id := params.(messageIdParams).MessageId
+
+	if _, err := lookup_message(store, username, message_id); err != nil {
+		return errorReply(err)
+	}
+
+	revisions, err := store.GetMessageRevisions(message_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["revisions"] = revisions
+	return replyMap
+}
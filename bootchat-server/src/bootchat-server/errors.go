@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Error catalog
+
+	A failed reply looks like
+
+	 {"success":false,"code":"user.not_found","exception":"user does not exist"}
+
+	Clients branch on "code", which never changes once published. "exception"
+	is a human readable message kept for older clients, its wording may
+	change. The /v1 routes answer with the HTTP status listed here, the
+	legacy "/" dispatcher always answers 200 because the original client
+	treats any other status as a transport failure. Parameter validation
+	adds "fields", the problem with each parameter (see validation.go), and
+	throttled logins "retry_after", the seconds to wait (see lockout.go).
+
+	 code                          status  meaning
+	 request.malformed             400     body is not a JSON object
+	 request.too_large             413     body is larger than limits.max_request_size
+	 request.missing               400     legacy body without "request"
+	 request.unknown               404     legacy "request" is not implemented
+	 request.missing_parameter     400     a required parameter is absent
+	 request.invalid_parameter     400     a parameter is unknown or has the wrong type, range or characters
+	 route.not_found               404     no /v1 route for the path
+	 route.method_not_allowed      405     the path exists with other methods (see Allow)
+	 auth.missing_credentials      401     no session token and no username/password
+	 auth.invalid_credentials      401     wrong username or password
+	 auth.invalid_session          401     unknown, revoked or expired session token
+	 auth.security_answer_mismatch 403     forgotpass question/answer do not match
+	 auth.account_disabled         403     an administrator disabled the account
+	 auth.too_many_attempts        429     failed logins, wait retry_after seconds
+	 auth.locked_out               429     too many failed logins, locked for retry_after seconds
+	 user.not_found                404     the named user does not exist
+	 user.exists                   409     the username is or was registered
+	 user.nickname_taken           409     another account uses the nickname
+	 user.blocked                  403     the caller has blocked that user (unblock first)
+	 message.empty                 400     message body is empty
+	 message.contacts_only         403     the recipient only accepts messages from contacts
+	 message.blocked               403     the recipient has blocked the sender
+	 message.not_found             404     no such message (or one you may not see)
+	 message.not_sender            403     only the sender may edit or delete it for everyone
+	 message.deleted               409     the message was deleted for everyone
+	 message.delete_window_closed  403     too late to delete the message for everyone
+	 conversation.not_deleted      404     no deleteconv to undo, or its undo window has passed
+	 room.not_found                404     no such room (or a private room you are not in)
+	 room.invalid_name             400     room name is not 1 to 64 characters
+	 room.invalid_role             400     role is not "owner" or "member"
+	 room.not_member               403     caller is not a member of the public room
+	 room.not_owner                403     only an owner may do this
+	 room.member_not_found         404     target user is not a member of the room
+	 room.kick_self                400     owners leave with leaveroom, not kickmember
+	 room.kick_owner               403     owners can not kick other owners
+	 room.demote_self              409     an owner can not demote themselves
+	 attachment.not_found          404     no such attachment (or one you may not see)
+	 attachment.too_large          413     the file is larger than maxAttachmentSize
+	 attachment.type_not_allowed   415     the sniffed type is not in allowedAttachmentTypes
+	 attachment.quota_exceeded     403     the upload would exceed the user's attachmentQuota
+	 upload.not_found              404     no such pending chunked upload
+	 upload.offset_mismatch        409     a chunk does not start where the upload ends
+	 upload.incomplete             409     finishupload before every byte arrived
+	 contact.self                  400     users can not befriend themselves
+	 contact.not_found             404     the user is not a contact
+	 contact.already_exists        409     the user is already a contact
+	 contact.request_not_found     404     no pending friend request between the users
+	 block.not_found               404     the user is not blocked
+	 internal.error                500     anything unexpected, details are only logged
+*/
+
+type apiError struct {
+	code    string
+	status  int
+	message string
+	fields  map[string]string // parameter -> problem, see validation.go
+
+	retryAfter time.Duration // see lockout.go
+}
+
+func (err *apiError) Error() string {
+	return err.message
+}
+
+// withDetail returns a copy of err with detail appended to its message, the code is unchanged.
+func (err *apiError) withDetail(detail string) *apiError {
+	return &apiError{code: err.code, status: err.status, message: err.message + ": " + detail}
+}
+
+// withFields returns a copy of err for the parameters that failed validation.
+func (err *apiError) withFields(fields map[string]string) *apiError {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	details := make([]string, len(keys))
+	for i, key := range keys {
+		details[i] = key + " " + fields[key]
+	}
+
+	detailed := err.withDetail(strings.Join(details, "; "))
+	detailed.fields = fields
+	return detailed
+}
+
+// withRetryAfter returns a copy of err telling the client to wait for wait.
+func (err *apiError) withRetryAfter(wait time.Duration) *apiError {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+
+	detailed := err.withDetail("try again in " + (time.Duration(seconds) * time.Second).String())
+	detailed.retryAfter = time.Duration(seconds) * time.Second
+	return detailed
+}
+
+// errorCatalog maps every code to its error, see newApiError.
+var errorCatalog = make(map[string]*apiError)
+
+func newApiError(code string, status int, message string) *apiError {
+	err := &apiError{code: code, status: status, message: message}
+	errorCatalog[code] = err
+	return err
+}
+
+var (
+	errMalformedRequest   = newApiError("request.malformed", http.StatusBadRequest, "can not unserialize the request")
+	errRequestTooLarge    = newApiError("request.too_large", http.StatusRequestEntityTooLarge, "request is too large")
+	errMissingRequest     = newApiError("request.missing", http.StatusBadRequest, "missing request")
+	errUnknownRequest     = newApiError("request.unknown", http.StatusNotFound, "unimplemented request")
+	errMissingParameter   = newApiError("request.missing_parameter", http.StatusBadRequest, "missing parameter")
+	errInvalidParameter   = newApiError("request.invalid_parameter", http.StatusBadRequest, "invalid parameter")
+	errRouteNotFound      = newApiError("route.not_found", http.StatusNotFound, "no such route")
+	errMethodNotAllowed   = newApiError("route.method_not_allowed", http.StatusMethodNotAllowed, "method not allowed")
+	errMissingCredentials = newApiError("auth.missing_credentials", http.StatusUnauthorized, "missing session token")
+	errInvalidCredentials = newApiError("auth.invalid_credentials", http.StatusUnauthorized, "invalid username or password")
+	errInvalidSession     = newApiError("auth.invalid_session", http.StatusUnauthorized, "invalid or expired session token")
+	errSecurityAnswer     = newApiError("auth.security_answer_mismatch", http.StatusForbidden, "invalid question/answer")
+	errAccountDisabled    = newApiError("auth.account_disabled", http.StatusForbidden, "account is disabled")
+	errTooManyAttempts    = newApiError("auth.too_many_attempts", http.StatusTooManyRequests, "too many failed logins")
+	errLockedOut          = newApiError("auth.locked_out", http.StatusTooManyRequests, "locked out after too many failed logins")
+	errUserNotFound       = newApiError("user.not_found", http.StatusNotFound, "user does not exist")
+	errUserExists         = newApiError("user.exists", http.StatusConflict, "user already exists")
+	errNicknameTaken      = newApiError("user.nickname_taken", http.StatusConflict, "nickname is already taken")
+	errUserBlocked        = newApiError("user.blocked", http.StatusForbidden, "you have blocked this user")
+	errEmptyMessage       = newApiError("message.empty", http.StatusBadRequest, "can not send empty message")
+	errContactsOnly       = newApiError("message.contacts_only", http.StatusForbidden, "recipient only accepts messages from contacts")
+	errSenderBlocked      = newApiError("message.blocked", http.StatusForbidden, "recipient does not accept your messages")
+	errMessageNotFound    = newApiError("message.not_found", http.StatusNotFound, "message does not exist")
+	errNotMessageSender   = newApiError("message.not_sender", http.StatusForbidden, "only the sender can do this")
+	errMessageDeleted     = newApiError("message.deleted", http.StatusConflict, "message was deleted")
+	errDeleteWindowClosed = newApiError("message.delete_window_closed", http.StatusForbidden, "message is too old to delete for everyone")
+	errNothingToRestore   = newApiError("conversation.not_deleted", http.StatusNotFound, "no deleted conversation to restore")
+	errRoomNotFound       = newApiError("room.not_found", http.StatusNotFound, "room does not exist")
+	errInvalidRoomName    = newApiError("room.invalid_name", http.StatusBadRequest, "room name must be 1 to 64 characters")
+	errInvalidRoomRole    = newApiError("room.invalid_role", http.StatusBadRequest, "role must be owner or member")
+	errNotRoomMember      = newApiError("room.not_member", http.StatusForbidden, "not a member of this room")
+	errNotRoomOwner       = newApiError("room.not_owner", http.StatusForbidden, "only a room owner can do that")
+	errRoomMemberNotFound = newApiError("room.member_not_found", http.StatusNotFound, "user is not a member of this room")
+	errKickSelf           = newApiError("room.kick_self", http.StatusBadRequest, "use leaveroom to leave a room")
+	errKickOwner          = newApiError("room.kick_owner", http.StatusForbidden, "can not kick another owner")
+	errDemoteSelf         = newApiError("room.demote_self", http.StatusConflict, "an owner can not demote themselves")
+	errAttachmentNotFound = newApiError("attachment.not_found", http.StatusNotFound, "attachment does not exist")
+	errAttachmentTooLarge = newApiError("attachment.too_large", http.StatusRequestEntityTooLarge, "attachment is too large")
+	errAttachmentType     = newApiError("attachment.type_not_allowed", http.StatusUnsupportedMediaType, "file type is not allowed")
+	errAttachmentQuota    = newApiError("attachment.quota_exceeded", http.StatusForbidden, "attachment quota exceeded")
+	errUploadNotFound     = newApiError("upload.not_found", http.StatusNotFound, "upload does not exist")
+	errUploadOffset       = newApiError("upload.offset_mismatch", http.StatusConflict, "chunk does not start where the upload ends")
+	errUploadIncomplete   = newApiError("upload.incomplete", http.StatusConflict, "upload is not complete")
+	errContactSelf        = newApiError("contact.self", http.StatusBadRequest, "can not add yourself as a contact")
+	errContactNotFound    = newApiError("contact.not_found", http.StatusNotFound, "user is not a contact")
+	errContactExists      = newApiError("contact.already_exists", http.StatusConflict, "user is already a contact")
+	errNoFriendRequest    = newApiError("contact.request_not_found", http.StatusNotFound, "friend request does not exist")
+	errBlockNotFound      = newApiError("block.not_found", http.StatusNotFound, "user is not blocked")
+	errInternal           = newApiError("internal.error", http.StatusInternalServerError, "internal server error")
+)
+
+/*
+	errorReply - build the reply for a failed request
+	 err error
+
+	 returns (reply map)
+	 Errors outside the catalog (database, I/O) are logged and reported as
+	 internal.error so their details do not leak to clients.
+*/
+func errorReply(err error) map[string]interface{} {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		log.Printf("Internal error: %s", err.Error())
+		apiErr = errInternal
+	}
+
+	replyMap := map[string]interface{}{"success": false, "code": apiErr.code, "exception": apiErr.message}
+	if len(apiErr.fields) > 0 {
+		replyMap["fields"] = apiErr.fields
+	}
+	if apiErr.retryAfter > 0 {
+		replyMap["retry_after"] = int64(apiErr.retryAfter / time.Second)
+	}
+	return replyMap
+}
+
+// replyStatus is the HTTP status for a handler reply, 200 unless it failed.
+func replyStatus(replyMap map[string]interface{}) int {
+	if replyMap["success"] == true {
+		return http.StatusOK
+	}
+
+	code, _ := replyMap["code"].(string)
+	if err, exists := errorCatalog[code]; exists {
+		return err.status
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	Hub - in-process fan-out of live events to websocket clients
+
+	Every authenticated websocket connection registers under its username, a
+	user may hold several connections (one per device). Handlers publish an
+	event to a username once the change it describes has been committed.
+
+	Delivery never blocks the publisher: each client owns a bounded send
+	queue and a client whose queue is full is considered a slow consumer and
+	disconnected. It can reconnect and resync with getmsgs.
+
+	A connection lives no longer than the session it opened with: revoking
+	a session (logout) or all of a user's (logoutall, a password reset)
+	disconnects them here. Whatever another process revokes (the users
+	command disabling or deleting an account, see admin.go) or runs out is
+	noticed by writePump at its next ping.
+*/
+
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[string]map[*wsClient]bool
+	closed  bool // after closeAll every new client is closed right away
+}
+
+var eventHub = newHub()
+
+func newHub() *Hub {
+	return &Hub{clients: make(map[string]map[*wsClient]bool)}
+}
+
+func (hub *Hub) register(client *wsClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.closed {
+		close(client.send)
+		return
+	}
+
+	userClients, exists := hub.clients[client.username]
+	if !exists {
+		userClients = make(map[*wsClient]bool)
+		hub.clients[client.username] = userClients
+	}
+	userClients[client] = true
+
+	if verbose {
+		log.Printf("Websocket connected for %s (%d open)\n", client.username, len(userClients))
+	}
+}
+
+// unregister removes client and closes its send queue, it is safe to call more than once.
+func (hub *Hub) unregister(client *wsClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	userClients, exists := hub.clients[client.username]
+	if !exists || !userClients[client] {
+		return
+	}
+
+	delete(userClients, client)
+	close(client.send)
+
+	if len(userClients) == 0 {
+		delete(hub.clients, client.username)
+	}
+
+	if verbose {
+		log.Printf("Websocket disconnected for %s\n", client.username)
+	}
+}
+
+/*
+	publish - queue an event for every connection of username
+	 username string
+	 event map[string]interface{} (must contain "event")
+*/
+func (hub *Hub) publish(username string, event map[string]interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Unable to encode %v event: %s", event["event"], err.Error())
+		return
+	}
+
+	var slow []*wsClient
+
+	hub.mu.RLock()
+	for client := range hub.clients[username] {
+		select {
+		case client.send <- payload:
+		default:
+			slow = append(slow, client)
+		}
+	}
+	hub.mu.RUnlock()
+
+	for _, client := range slow {
+		log.Printf("Dropping slow websocket consumer for %s\n", client.username)
+		hub.unregister(client)
+	}
+}
+
+// disconnectUser closes every connection of username.
+func (hub *Hub) disconnectUser(username string) {
+	hub.disconnect(func(client *wsClient) bool { return client.username == username })
+}
+
+// disconnectSession closes the connections opened with the session tokenHash.
+func (hub *Hub) disconnectSession(tokenHash string) {
+	hub.disconnect(func(client *wsClient) bool { return client.session == tokenHash })
+}
+
+func (hub *Hub) disconnect(match func(client *wsClient) bool) {
+	var revoked []*wsClient
+
+	hub.mu.RLock()
+	for _, userClients := range hub.clients {
+		for client := range userClients {
+			if match(client) {
+				revoked = append(revoked, client)
+			}
+		}
+	}
+	hub.mu.RUnlock()
+
+	// closing the send queue makes writePump say goodbye and hang up
+	for _, client := range revoked {
+		if verbose {
+			log.Printf("Closing websocket of %s, its session is gone\n", client.username)
+		}
+		hub.unregister(client)
+	}
+}
+
+// connectionCount returns the number of live connections held by username.
+func (hub *Hub) connectionCount(username string) int {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	return len(hub.clients[username])
+}
+
+// closeAll disconnects every client, used on shutdown.
+func (hub *Hub) closeAll() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.closed = true
+	for username, userClients := range hub.clients {
+		for client := range userClients {
+			close(client.send)
+		}
+		delete(hub.clients, username)
+	}
+}
+
+/* event constructors */
+
+func messageEvent(message map[string]string) map[string]interface{} {
+	return map[string]interface{}{"event": "message", "message": message}
+}
+
+func convoDeletedEvent(peer string, upto_id int64) map[string]interface{} {
+	return map[string]interface{}{"event": "convo_deleted", "peer": peer, "up_to_id": upto_id}
+}
+
+func convoRestoredEvent(peer string) map[string]interface{} {
+	return map[string]interface{}{"event": "convo_restored", "peer": peer}
+}
+
+func newMessageFlagEvent(value int) map[string]interface{} {
+	return map[string]interface{}{"event": "new_message", "value": value}
+}
+
+// receiptEvent tells a sender that peer has received or read their messages up to upto_id.
+func receiptEvent(status string, peer string, upto_id int64, at time.Time) map[string]interface{} {
+	return map[string]interface{}{"event": "receipt", "status": status, "peer": peer, "up_to_id": upto_id, "at": at.Unix()}
+}
+
+func conversationReadEvent(peer string, upto_id int64) map[string]interface{} {
+	return map[string]interface{}{"event": "conversation_read", "peer": peer, "up_to_id": upto_id}
+}
+
+func roomReadEvent(room_id int64, upto_id int64) map[string]interface{} {
+	return map[string]interface{}{"event": "conversation_read", "room_id": room_id, "up_to_id": upto_id}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	Login throttling
+
+	Every password check goes through begin_login_attempt: login, the
+	legacy username/password pair any request may carry, and the security
+	answer of forgotpass. Failures are counted per username and per client
+	address (an IPv6 address by its /64) in login_failures, so a restart
+	does not forget them.
+
+	 after n failures in a row   the next attempt waits login_backoff *
+	                             2^(n-1), at most login_max_backoff
+	 login_lockout_failures      of a username, or login_ip_lockout_failures
+	                             from an address, lock it out for
+	                             login_lockout
+
+	The settings are in the [limits] config table. Failures older than
+	login_lockout are forgotten and a correct password clears those of its
+	username, an address only recovers with time. An attempt inside the
+	wait is refused with auth.too_many_attempts or auth.locked_out and a
+	retry_after (seconds) before the password is looked at, so it does not
+	count either.
+
+	At most maxLoginsInFlight checks run at once per username and per
+	address, a burst of parallel requests can not all get in before the
+	first failure is recorded. Across all of them the hashes are verified
+	one per CPU at a time, see passwordChecks in password.go.
+
+	"users locked" lists what is throttled, "users unlock" clears a
+	username or an address, see admin.go.
+*/
+
+const maxLoginsInFlight = 4
+
+const (
+	loginKindUser    = "user"
+	loginKindAddress = "addr"
+)
+
+// the limits can be changed in the config, see config.go
+var loginBackoff = time.Second
+var loginMaxBackoff = time.Minute
+var loginLockout = 15 * time.Minute
+var loginLockoutFailures = 10
+var loginIpLockoutFailures = 100
+
+type loginKey struct {
+	kind string
+	name string
+}
+
+// loginThrottle counts the password checks in flight, the failures are in the store.
+type loginThrottle struct {
+	mu       sync.Mutex
+	inFlight map[loginKey]int
+}
+
+var logins = &loginThrottle{inFlight: make(map[loginKey]int)}
+
+// loginAttempt is a password check begin_login_attempt let through.
+type loginAttempt struct {
+	keys        []loginKey
+	userFailing bool // the username had failures, a success clears them
+}
+
+/*
+	begin_login_attempt - ask whether a password may be checked now
+	 store Store
+	 username string
+	 remote string (the client address, "" when there is none)
+
+	 returns (*loginAttempt, error)
+	 errTooManyAttempts or errLockedOut with the time to wait when it may
+	 not, the password must not be checked then. Otherwise the attempt has
+	 to be ended with finish.
+*/
+func begin_login_attempt(store Store, username string, remote string) (*loginAttempt, error) {
+	attempt := &loginAttempt{keys: []loginKey{{loginKindUser, username}}}
+	if len(remote) > 0 {
+		attempt.keys = append(attempt.keys, loginKey{loginKindAddress, remote})
+	}
+
+	if !logins.enter(attempt.keys) {
+		return nil, errTooManyAttempts.withRetryAfter(loginBackoff)
+	}
+
+	now := time.Now()
+	for _, key := range attempt.keys {
+		failures, last, err := store.GetLoginFailures(key.kind, key.name)
+		if err != nil {
+			logins.leave(attempt.keys)
+			return nil, err
+		}
+
+		if failures == 0 || now.Sub(last) >= loginLockout {
+			continue
+		}
+
+		if key.kind == loginKindUser {
+			attempt.userFailing = true
+		}
+
+		if wait := last.Add(loginWait(key.kind, failures)).Sub(now); wait > 0 {
+			logins.leave(attempt.keys)
+			if failures >= loginLockoutLimit(key.kind) {
+				return nil, errLockedOut.withRetryAfter(wait)
+			}
+			return nil, errTooManyAttempts.withRetryAfter(wait)
+		}
+	}
+
+	return attempt, nil
+}
+
+/*
+	finish - record how a login attempt ended
+	 store Store
+	 success bool (the password was right)
+	 err error (of the check, nothing is recorded for an unexpected one)
+*/
+func (attempt *loginAttempt) finish(store Store, success bool, err error) {
+	defer logins.leave(attempt.keys)
+
+	// a disabled account with the right password is not a failure
+	if err == errAccountDisabled {
+		success, err = true, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	if success {
+		if attempt.userFailing {
+			if _, err = store.ClearLoginFailures(loginKindUser, attempt.keys[0].name); err != nil {
+				log.Printf("Unable to clear failed logins of %s: %s", attempt.keys[0].name, err.Error())
+			}
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, key := range attempt.keys {
+		failures, err := store.RecordLoginFailure(key.kind, key.name, now, now.Add(-loginLockout))
+		if err != nil {
+			log.Printf("Unable to record a failed login of %s %s: %s", key.kind, key.name, err.Error())
+			continue
+		}
+
+		if failures == loginLockoutLimit(key.kind) {
+			log.Printf("Locked out %s %s for %s after %d failed logins", key.kind, key.name, loginLockout, failures)
+		}
+	}
+}
+
+// isLoginThrottled reports whether err is begin_login_attempt refusing an attempt.
+func isLoginThrottled(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && (apiErr.code == errTooManyAttempts.code || apiErr.code == errLockedOut.code)
+}
+
+// loginWait is how long to wait after the last of failures.
+func loginWait(kind string, failures int) time.Duration {
+	if failures >= loginLockoutLimit(kind) {
+		return loginLockout
+	}
+
+	wait := loginBackoff
+	for i := 1; i < failures && wait < loginMaxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > loginMaxBackoff {
+		wait = loginMaxBackoff
+	}
+
+	return wait
+}
+
+func loginLockoutLimit(kind string) int {
+	if kind == loginKindAddress {
+		return loginIpLockoutFailures
+	}
+	return loginLockoutFailures
+}
+
+// enter takes a place for every key, or none when one of them is full.
+func (throttle *loginThrottle) enter(keys []loginKey) bool {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	for _, key := range keys {
+		if throttle.inFlight[key] >= maxLoginsInFlight {
+			return false
+		}
+	}
+
+	for _, key := range keys {
+		throttle.inFlight[key] += 1
+	}
+
+	return true
+}
+
+func (throttle *loginThrottle) leave(keys []loginKey) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	for _, key := range keys {
+		if throttle.inFlight[key] <= 1 {
+			delete(throttle.inFlight, key)
+		} else {
+			throttle.inFlight[key] -= 1
+		}
+	}
+}
+
+/*
+	unlock_login - forget the failed logins of a username or an address
+	 store Store
+	 kind string (loginKindUser or loginKindAddress)
+	 name string
+
+	 returns (whether there were any, error)
+*/
+func unlock_login(store Store, kind string, name string) (bool, error) {
+	if kind == loginKindAddress {
+		name = normalizeAddress(name)
+	}
+
+	return store.ClearLoginFailures(kind, name)
+}
+
+// purge_login_failures forgets failures older than loginLockout, they no longer count.
+func purge_login_failures(store Store) error {
+	return store.PurgeLoginFailures(time.Now().Add(-loginLockout))
+}
+
+// clientAddress is the address failed logins of request are counted for.
+func clientAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	return normalizeAddress(host)
+}
+
+// normalizeAddress keeps an IPv4 address and reduces an IPv6 one to its
+// /64, a single host usually has a whole one.
+func normalizeAddress(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		if _, network, err := net.ParseCIDR(address); err == nil {
+			ip = network.IP
+		} else {
+			return address
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
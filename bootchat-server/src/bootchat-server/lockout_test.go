@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// useLoginLimits sets the login limits until the test ends.
+func useLoginLimits(t *testing.T, backoff time.Duration, maxBackoff time.Duration, failures int, ipFailures int) {
+	previous := []interface{}{loginBackoff, loginMaxBackoff, loginLockout, loginLockoutFailures, loginIpLockoutFailures}
+	t.Cleanup(func() {
+		loginBackoff = previous[0].(time.Duration)
+		loginMaxBackoff = previous[1].(time.Duration)
+		loginLockout = previous[2].(time.Duration)
+		loginLockoutFailures = previous[3].(int)
+		loginIpLockoutFailures = previous[4].(int)
+	})
+
+	loginBackoff, loginMaxBackoff, loginLockout = backoff, maxBackoff, 15*time.Minute
+	loginLockoutFailures, loginIpLockoutFailures = failures, ipFailures
+}
+
+// newLoginStore is a store with alice, whose password is 123456.
+func newLoginStore(t *testing.T) Store {
+	useHasher(t, newBcryptHasher(4))
+
+	store := newMemStore()
+	encoded, _ := hash_password("123456")
+	store.CreateAccount("alice", "alice", "question", "answer", encoded)
+	return store
+}
+
+// expectThrottled fails unless err is want with a retry_after of about wait.
+func expectThrottled(t *testing.T, err error, want *apiError, wait time.Duration) {
+	t.Helper()
+
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.code != want.code {
+		t.Fatalf("got %v, want %s", err, want.code)
+	}
+	if apiErr.retryAfter < wait-time.Second || apiErr.retryAfter > wait {
+		t.Errorf("%s: retry after %s, want %s", want.code, apiErr.retryAfter, wait)
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	useLoginLimits(t, time.Second, time.Minute, 10, 100)
+
+	tests := []struct {
+		kind     string
+		failures int
+		wait     time.Duration
+	}{
+		{loginKindUser, 1, time.Second},
+		{loginKindUser, 2, 2 * time.Second},
+		{loginKindUser, 3, 4 * time.Second},
+		{loginKindUser, 6, 32 * time.Second},
+		{loginKindUser, 7, time.Minute},
+		{loginKindUser, 9, time.Minute},
+		{loginKindUser, 10, 15 * time.Minute},
+		{loginKindUser, 50, 15 * time.Minute},
+		{loginKindAddress, 10, time.Minute},
+		{loginKindAddress, 99, time.Minute},
+		{loginKindAddress, 100, 15 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if wait := loginWait(test.kind, test.failures); wait != test.wait {
+			t.Errorf("%s after %d failures: waits %s, want %s", test.kind, test.failures, wait, test.wait)
+		}
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	useLoginLimits(t, 10*time.Second, time.Minute, 10, 100)
+	store := newLoginStore(t)
+
+	if success, err := verify_user_login(store, "alice", "654321", ""); success || err != nil {
+		t.Fatalf("wrong password: %v %v", success, err)
+	}
+
+	// even the right password waits, it is not looked at
+	_, err := verify_user_login(store, "alice", "123456", "")
+	expectThrottled(t, err, errTooManyAttempts, 10*time.Second)
+
+	if failures, _, _ := store.GetLoginFailures(loginKindUser, "alice"); failures != 1 {
+		t.Errorf("a refused attempt counted, %d failures", failures)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	useLoginLimits(t, 0, 0, 3, 5)
+	store := newLoginStore(t)
+
+	for i := 0; i < 3; i++ {
+		if success, err := verify_user_login(store, "alice", "654321", "192.0.2.1"); success || err != nil {
+			t.Fatalf("failure %d: %v %v", i+1, success, err)
+		}
+	}
+
+	_, err := verify_user_login(store, "alice", "123456", "192.0.2.1")
+	expectThrottled(t, err, errLockedOut, loginLockout)
+
+	// the address is not locked yet, another username gets in from it
+	if _, err = verify_user_login(store, "bob", "654321", "192.0.2.1"); err != nil {
+		t.Fatalf("bob: %v", err)
+	}
+	if _, err = verify_user_login(store, "carol", "654321", "192.0.2.1"); err != nil {
+		t.Fatalf("carol: %v", err)
+	}
+
+	// five failures from it lock the address for every username
+	_, err = verify_user_login(store, "dave", "654321", "192.0.2.1")
+	expectThrottled(t, err, errLockedOut, loginLockout)
+
+	if _, err = verify_user_login(store, "dave", "654321", "192.0.2.2"); err != nil {
+		t.Errorf("another address: %v", err)
+	}
+}
+
+func TestLoginsInFlight(t *testing.T) {
+	useLoginLimits(t, 0, 0, 10, 100)
+	store := newLoginStore(t)
+
+	var attempts []*loginAttempt
+	defer func() {
+		for _, attempt := range attempts {
+			attempt.finish(store, true, nil)
+		}
+	}()
+
+	for i := 0; i < maxLoginsInFlight; i++ {
+		attempt, err := begin_login_attempt(store, "alice", "")
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	_, err := begin_login_attempt(store, "alice", "")
+	expectThrottled(t, err, errTooManyAttempts, loginBackoff)
+
+	// a place is free again once one ends
+	attempts[0].finish(store, true, nil)
+	attempt, err := begin_login_attempt(store, "alice", "")
+	if err != nil {
+		t.Fatalf("after one ended: %v", err)
+	}
+	attempts[0] = attempt
+
+	// the cap of an address is shared by its usernames
+	for i := 0; i < maxLoginsInFlight; i++ {
+		attempt, err := begin_login_attempt(store, "user"+string(rune('a'+i)), "192.0.2.1")
+		if err != nil {
+			t.Fatalf("address attempt %d: %v", i+1, err)
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	if _, err = begin_login_attempt(store, "bob", "192.0.2.1"); !isLoginThrottled(err) {
+		t.Errorf("a fifth username from one address: %v", err)
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+		{"2001:db8:1:2::/64", "2001:db8:1:2::/64"},
+		{"not an address", "not an address"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeAddress(test.address); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.address, got, test.want)
+		}
+	}
+}
+
+func TestUsersUnlock(t *testing.T) {
+	useLoginLimits(t, 0, 0, 1, 1)
+	store := newLoginStore(t)
+
+	verify_user_login(store, "alice", "654321", normalizeAddress("2001:db8::1"))
+	if _, err := verify_user_login(store, "alice", "123456", ""); err == nil {
+		t.Fatalf("alice is not locked out")
+	}
+	if _, err := verify_user_login(store, "bob", "123456", normalizeAddress("2001:db8::2")); err == nil {
+		t.Fatalf("the address is not locked out")
+	}
+
+	if code := runUsersCommand(store, []string{"unlock", "alice"}); code != 0 {
+		t.Fatalf("users unlock exited with %d", code)
+	}
+	if success, err := verify_user_login(store, "alice", "123456", ""); !success || err != nil {
+		t.Errorf("alice after the unlock: %v %v", success, err)
+	}
+
+	// any address of the /64 unlocks it
+	if code := runUsersCommand(store, []string{"unlock", "--ip", "2001:db8::3"}); code != 0 {
+		t.Fatalf("users unlock --ip exited with %d", code)
+	}
+	if failures, _, _ := store.GetLoginFailures(loginKindAddress, normalizeAddress("2001:db8::2")); failures != 0 {
+		t.Errorf("the address still has %d failures", failures)
+	}
+	if success, err := verify_user_login(store, "alice", "123456", normalizeAddress("2001:db8::2")); !success || err != nil {
+		t.Errorf("the address after the unlock: %v %v", success, err)
+	}
+}
+
+func TestPasswordChecksBounded(t *testing.T) {
+	encoded, _ := newBcryptHasher(4).Hash("123456")
+
+	// every place taken, as by that many logins at once
+	for i := 0; i < cap(passwordChecks); i++ {
+		passwordChecks <- struct{}{}
+	}
+
+	done := make(chan bool)
+	go func() {
+		match, _, _ := check_password("123456", encoded)
+		done <- match
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("a password was checked with no place free")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < cap(passwordChecks); i++ {
+		<-passwordChecks
+	}
+
+	if match := <-done; !match {
+		t.Errorf("the waiting check did not match")
+	}
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Schema migrations
+
+	The server owns its schema. Every change is a numbered migration, either
+	a pair of embedded SQL files per dialect
+
+	 migrations/sqlite/0002_sessions.up.sql
+	 migrations/sqlite/0002_sessions.down.sql
+	 migrations/postgres/0002_sessions.up.sql
+	 ...
+
+	or a Go migration registered in goMigrations for changes SQL alone can
+	not express safely (e.g. adding a column that may already exist). Both
+	dialects must define the same versions.
+
+	Applied versions are recorded in schema_migrations. A row is inserted
+	with dirty = 1 before a migration runs and cleared once it commits, so a
+	crash part way leaves a dirty row behind and the server refuses to start
+	until an operator repairs the database and runs "migrate force <version>".
+*/
+
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	upSQL   string
+	downSQL string
+	up      func(tx *sql.Tx) error
+	down    func(tx *sql.Tx) error
+}
+
+type migrationStatus struct {
+	version int
+	name    string
+	applied int64 // unix time, 0 when pending
+	dirty   bool
+}
+
+var errDirtyDatabase = errors.New("database is in a dirty migration state")
+
+// goMigrations are the migrations written in Go rather than SQL, by dialect.
+var goMigrations = map[string][]migration{
+	"sqlite": {
+		{version: 3, name: "rooms", up: migrateRoomsUp, down: migrateRoomsDown},
+		{version: 7, name: "search", up: migrateSearchUp, down: migrateSearchDown},
+	},
+}
+
+/*
+	load_migrations - collect embedded SQL and Go migrations in version order
+	 dialect string ("sqlite" or "postgres")
+
+	 returns ([]migration, error)
+*/
+func load_migrations(dialect string) ([]migration, error) {
+	byVersion := make(map[int]*migration)
+	dir := path.Join("migrations", dialect)
+
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// 0002_sessions.up.sql
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql", fileName)
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		separator := strings.Index(base, "_")
+		if separator < 1 {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>", fileName)
+		}
+
+		version, err := strconv.Atoi(base[:separator])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: bad version", fileName)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{version: version, name: base[separator+1:]}
+			byVersion[version] = m
+		} else if m.name != base[separator+1:] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.name, base[separator+1:])
+		}
+
+		if direction == "up" {
+			m.upSQL = string(data)
+		} else {
+			m.downSQL = string(data)
+		}
+	}
+
+	for i := range goMigrations[dialect] {
+		m := goMigrations[dialect][i]
+		if _, exists := byVersion[m.version]; exists {
+			return nil, fmt.Errorf("migration %d is defined twice", m.version)
+		}
+		byVersion[m.version] = &m
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if len(m.upSQL) == 0 && m.up == nil {
+			return nil, fmt.Errorf("migration %d (%s) has no up step", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+func (store *sqlStore) initMigrationsTable() error {
+	statement := "CREATE TABLE IF NOT EXISTS schema_migrations (\n"
+	statement += "version INTEGER PRIMARY KEY,\n"
+	statement += "name VARCHAR(128),\n"
+	statement += "applied INTEGER,\n"
+	statement += "dirty INTEGER\n"
+	statement += ");"
+
+	_, err := store.exec(store.db, statement)
+	return err
+}
+
+/*
+	MigrationStatus - every known migration with its applied state
+
+	 returns ([]migrationStatus, error)
+	 versions recorded in the database but unknown to this binary are included
+	 with an empty name.
+*/
+func (store *sqlStore) MigrationStatus() ([]migrationStatus, error) {
+	if err := store.initMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	migrations, err := load_migrations(store.dialect.name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.query(store.db, "SELECT version,applied,dirty FROM schema_migrations ORDER BY version ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationStatus)
+	for rows.Next() {
+		var status migrationStatus
+		var dirty int
+		if err := rows.Scan(&status.version, &status.applied, &dirty); err != nil {
+			return nil, err
+		}
+		status.dirty = dirty != 0
+		applied[status.version] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := applied[m.version]
+		status.version = m.version
+		status.name = m.name
+		statuses = append(statuses, status)
+		delete(applied, m.version)
+	}
+
+	for _, status := range applied {
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].version < statuses[j].version })
+
+	return statuses, nil
+}
+
+// checkMigrationState refuses to continue on a dirty or newer-than-known database.
+func checkMigrationState(statuses []migrationStatus) error {
+	for _, status := range statuses {
+		if status.dirty {
+			return fmt.Errorf("%w at version %d; repair it and run \"migrate force %d\"", errDirtyDatabase, status.version, status.version)
+		}
+		if len(status.name) == 0 {
+			return fmt.Errorf("database has migration %d which this server does not know, refusing to continue", status.version)
+		}
+	}
+	return nil
+}
+
+/*
+	MigrateUp - apply pending migrations up to target
+	 target int (0 for the latest version)
+
+	 returns (number of migrations applied, error)
+*/
+func (store *sqlStore) MigrateUp(target int) (int, error) {
+	statuses, err := store.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkMigrationState(statuses); err != nil {
+		return 0, err
+	}
+
+	migrations, err := load_migrations(store.dialect.name)
+	if err != nil {
+		return 0, err
+	}
+
+	if target == 0 {
+		target = len(migrations)
+	}
+
+	if target < 0 || target > len(migrations) {
+		return 0, fmt.Errorf("unknown migration version %d", target)
+	}
+
+	count := 0
+	for i, m := range migrations {
+		if m.version > target || statuses[i].applied != 0 {
+			continue
+		}
+
+		log.Printf("Applying migration %04d_%s...", m.version, m.name)
+
+		if err = store.runMigration(m, true); err != nil {
+			return count, fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		count += 1
+	}
+
+	return count, nil
+}
+
+/*
+	MigrateDown - roll back the most recently applied migrations
+	 steps int
+
+	 returns (number of migrations rolled back, error)
+*/
+func (store *sqlStore) MigrateDown(steps int) (int, error) {
+	statuses, err := store.MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkMigrationState(statuses); err != nil {
+		return 0, err
+	}
+
+	migrations, err := load_migrations(store.dialect.name)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if statuses[i].applied == 0 {
+			continue
+		}
+
+		if len(m.downSQL) == 0 && m.down == nil {
+			return count, fmt.Errorf("migration %d (%s) can not be rolled back", m.version, m.name)
+		}
+
+		log.Printf("Rolling back migration %04d_%s...", m.version, m.name)
+
+		if err = store.runMigration(m, false); err != nil {
+			return count, fmt.Errorf("rollback of migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		count += 1
+	}
+
+	return count, nil
+}
+
+/*
+	MigrateForce - record version as the clean current state after a manual repair
+	 version int
+
+	 returns (error)
+
+	 Every known migration up to version is marked applied and clean, any
+	 record above it is removed.
+*/
+func (store *sqlStore) MigrateForce(version int) error {
+	if err := store.initMigrationsTable(); err != nil {
+		return err
+	}
+
+	migrations, err := load_migrations(store.dialect.name)
+	if err != nil {
+		return err
+	}
+
+	if version < 0 || version > len(migrations) {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM schema_migrations WHERE version > ?", version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, m := range migrations[:version] {
+		statement := "INSERT INTO schema_migrations(version,name,applied,dirty) VALUES(?,?,?,0) ON CONFLICT DO NOTHING"
+		if _, err = store.exec(tx, statement, m.version, m.name, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err = store.exec(tx, "UPDATE schema_migrations SET dirty = 0"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runMigration applies or rolls back a single migration inside a transaction guarded by the dirty flag.
+func (store *sqlStore) runMigration(m migration, up bool) error {
+	var err error
+
+	if up {
+		_, err = store.exec(store.db, "INSERT INTO schema_migrations(version,name,applied,dirty) VALUES(?,?,?,1)", m.version, m.name, time.Now().Unix())
+	} else {
+		_, err = store.exec(store.db, "UPDATE schema_migrations SET dirty = 1 WHERE version = ?", m.version)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case up && m.up != nil:
+		err = m.up(tx)
+	case up:
+		_, err = tx.Exec(m.upSQL)
+	case m.down != nil:
+		err = m.down(tx)
+	default:
+		_, err = tx.Exec(m.downSQL)
+	}
+
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			// leave the dirty marker, the schema state is unknown
+			return err
+		}
+		store.restoreMigrationMarker(m, up)
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = store.exec(store.db, "UPDATE schema_migrations SET dirty = 0 WHERE version = ?", m.version)
+	} else {
+		_, err = store.exec(store.db, "DELETE FROM schema_migrations WHERE version = ?", m.version)
+	}
+
+	return err
+}
+
+// restoreMigrationMarker undoes the dirty marker after a migration was rolled back cleanly.
+func (store *sqlStore) restoreMigrationMarker(m migration, up bool) {
+	if up {
+		store.exec(store.db, "DELETE FROM schema_migrations WHERE version = ?", m.version)
+	} else {
+		store.exec(store.db, "UPDATE schema_migrations SET dirty = 0 WHERE version = ?", m.version)
+	}
+}
+
+/*
+	runMigrateCommand - the "migrate" subcommand
+	 store Store
+	 args []string (up [version] | down [steps] | status | force <version>)
+
+	 returns (process exit code)
+*/
+func runMigrateCommand(store Store, args []string) int {
+	const usage = "usage: bootchat-server [-v] migrate up [version] | down [steps] | status | force <version>"
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println(usage)
+		return 2
+	}
+
+	var number int
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			fmt.Println(usage)
+			return 2
+		}
+		number = n
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := store.MigrateUp(number)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		fmt.Printf("Applied %d migration(s).\n", count)
+
+	case "down":
+		if len(args) == 1 {
+			number = 1
+		}
+		count, err := store.MigrateDown(number)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		fmt.Printf("Rolled back %d migration(s).\n", count)
+
+	case "status":
+		statuses, err := store.MigrationStatus()
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.applied != 0 {
+				state = "applied " + time.Unix(status.applied, 0).Format(time.RFC3339)
+			}
+			if status.dirty {
+				state += " (DIRTY)"
+			}
+			name := status.name
+			if len(name) == 0 {
+				name = "(unknown)"
+			}
+			fmt.Printf("%04d  %-24s %s\n", status.version, name, state)
+		}
+
+	case "force":
+		if len(args) != 2 {
+			fmt.Println(usage)
+			return 2
+		}
+		if err := store.MigrateForce(number); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		fmt.Printf("Forced schema to version %d.\n", number)
+
+	default:
+		fmt.Println(usage)
+		return 2
+	}
+
+	return 0
+}
+
+/*
+	column_exists - check a TABLE for a column
+	 db sqlRunner (*sql.DB or *sql.Tx)
+	 table string
+	 column string
+
+	 returns (bool, error)
+*/
+func column_exists(db sqlRunner, table string, column string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var name string
+	for rows.Next() {
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+/* Go migrations */
+
+// migrateRoomsUp creates the room tables; messages.room_id may already exist
+// on databases that ran the pre-migration room code.
+func migrateRoomsUp(tx *sql.Tx) error {
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS rooms (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(64), owner VARCHAR(32), public INTEGER, created INTEGER)",
+		"CREATE TABLE IF NOT EXISTS room_members (room_id INTEGER, username VARCHAR(32), role VARCHAR(8), joined INTEGER, PRIMARY KEY(room_id, username))",
+		"CREATE INDEX IF NOT EXISTS room_members_username ON room_members(username)",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	exists, err := column_exists(tx, "messages", "room_id")
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if _, err = tx.Exec("ALTER TABLE messages ADD COLUMN room_id INTEGER"); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS messages_room_id ON messages(room_id, id)")
+	return err
+}
+
+func migrateRoomsDown(tx *sql.Tx) error {
+	statements := []string{
+		"DELETE FROM messages WHERE room_id IS NOT NULL",
+		"DROP INDEX IF EXISTS messages_room_id",
+		"ALTER TABLE messages DROP COLUMN room_id",
+		"DROP INDEX IF EXISTS room_members_username",
+		"DROP TABLE IF EXISTS room_members",
+		"DROP TABLE IF EXISTS rooms",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateSearchUp adds messages.created, filled from the time column, and
+// the FTS5 index over message bodies with the triggers keeping it current.
+func migrateSearchUp(tx *sql.Tx) error {
+	exists, err := column_exists(tx, "messages", "created")
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if _, err = tx.Exec("ALTER TABLE messages ADD COLUMN created INTEGER"); err != nil {
+			return err
+		}
+	}
+
+	if err = backfillMessageCreated(tx); err != nil {
+		return err
+	}
+
+	statements := []string{
+		"CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(body, content='messages', content_rowid='id', tokenize='unicode61 remove_diacritics 2')",
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, body) VALUES (new.id, new.body);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, body) VALUES ('delete', old.id, old.body);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF body ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, body) VALUES ('delete', old.id, old.body);
+			INSERT INTO messages_fts(rowid, body) VALUES (new.id, new.body);
+		END`,
+		"INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("%w (build with -tags sqlite_fts5, see compile.sh)", err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateSearchDown(tx *sql.Tx) error {
+	statements := []string{
+		"DROP TRIGGER IF EXISTS messages_fts_update",
+		"DROP TRIGGER IF EXISTS messages_fts_delete",
+		"DROP TRIGGER IF EXISTS messages_fts_insert",
+		"DROP TABLE IF EXISTS messages_fts",
+		"ALTER TABLE messages DROP COLUMN created",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfillMessageCreated sets created from the time.String() text in time
+// for messages that have none, rows whose time does not parse stay NULL.
+func backfillMessageCreated(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, time FROM messages WHERE created IS NULL")
+	if err != nil {
+		return err
+	}
+
+	created := make(map[int64]int64)
+	for rows.Next() {
+		var id int64
+		var msgtime string
+		if err := rows.Scan(&id, &msgtime); err != nil {
+			rows.Close()
+			return err
+		}
+		if t, err := parseMessageTime(msgtime); err == nil {
+			created[id] = t.Unix()
+		}
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, unix := range created {
+		if _, err := tx.Exec("UPDATE messages SET created = ? WHERE id = ?", unix, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseMessageTime reads the time.String() format messages.time is stored in.
+func parseMessageTime(value string) (time.Time, error) {
+	// drop the monotonic clock reading, " m=+1.234"
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", value)
+}
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS sessions_username;
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash CHARACTER(64) UNIQUE,
+    username VARCHAR(32),
+    created BIGINT,
+    expires BIGINT,
+    last_seen BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS sessions_username ON sessions(username);
@@ -0,0 +1,6 @@
+DELETE FROM messages WHERE room_id IS NOT NULL;
+DROP INDEX IF EXISTS messages_room_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS room_id;
+DROP INDEX IF EXISTS room_members_username;
+DROP TABLE IF EXISTS room_members;
+DROP TABLE IF EXISTS rooms;
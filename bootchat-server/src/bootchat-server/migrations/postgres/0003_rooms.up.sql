@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS rooms (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(64),
+    owner VARCHAR(32),
+    public INTEGER,
+    created BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS room_members (
+    room_id BIGINT,
+    username VARCHAR(32),
+    role VARCHAR(8),
+    joined BIGINT,
+    PRIMARY KEY(room_id, username)
+);
+
+CREATE INDEX IF NOT EXISTS room_members_username ON room_members(username);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS room_id BIGINT;
+CREATE INDEX IF NOT EXISTS messages_room_id ON messages(room_id, id);
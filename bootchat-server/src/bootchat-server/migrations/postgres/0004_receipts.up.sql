@@ -0,0 +1,7 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS delivered_at BIGINT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS read_at BIGINT;
+
+-- history from before receipts counts as read
+UPDATE messages SET delivered_at = CAST(EXTRACT(EPOCH FROM now()) AS BIGINT), read_at = CAST(EXTRACT(EPOCH FROM now()) AS BIGINT);
+
+CREATE INDEX IF NOT EXISTS messages_unread ON messages(to_user, read_at);
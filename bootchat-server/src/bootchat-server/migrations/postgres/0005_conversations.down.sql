@@ -0,0 +1,4 @@
+ALTER TABLE room_members DROP COLUMN IF EXISTS last_read_id;
+DROP TABLE IF EXISTS conversation_settings;
+DROP INDEX IF EXISTS messages_from_to;
+DROP INDEX IF EXISTS messages_to_from;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS attachments (
+    id BIGSERIAL PRIMARY KEY,
+    owner VARCHAR(32),
+    message_id BIGINT DEFAULT 0,
+    sha256 CHARACTER(64),
+    size BIGINT,
+    content_type VARCHAR(128),
+    filename VARCHAR(255),
+    created BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS attachments_message_id ON attachments(message_id);
+CREATE INDEX IF NOT EXISTS attachments_owner ON attachments(owner);
+CREATE INDEX IF NOT EXISTS attachments_sha256 ON attachments(sha256);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS messages_body_search;
+ALTER TABLE messages DROP COLUMN IF EXISTS created;
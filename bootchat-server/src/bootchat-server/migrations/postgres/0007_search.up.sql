@@ -0,0 +1,7 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS created BIGINT;
+
+-- time holds Go's time.String(): "2017-12-05 00:20:27.016763231 +0000 UTC"
+UPDATE messages SET created = EXTRACT(EPOCH FROM (split_part(time, ' ', 1) || ' ' || split_part(time, ' ', 2) || ' ' || split_part(time, ' ', 3))::timestamptz)::BIGINT
+    WHERE created IS NULL;
+
+CREATE INDEX IF NOT EXISTS messages_body_search ON messages USING GIN (to_tsvector('simple', body));
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS blocks (
+    username VARCHAR(32),
+    blocked VARCHAR(32),
+    created BIGINT,
+    hide_history INTEGER DEFAULT 0,
+    PRIMARY KEY(username, blocked)
+);
+
+CREATE INDEX IF NOT EXISTS blocks_blocked ON blocks(blocked);
+
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS drop_blocked INTEGER DEFAULT 0;
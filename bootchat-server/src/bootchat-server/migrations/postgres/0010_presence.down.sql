@@ -0,0 +1,3 @@
+ALTER TABLE accounts DROP COLUMN IF EXISTS invisible;
+ALTER TABLE accounts DROP COLUMN IF EXISTS status_text;
+ALTER TABLE accounts DROP COLUMN IF EXISTS last_seen;
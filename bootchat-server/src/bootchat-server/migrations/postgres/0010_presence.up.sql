@@ -0,0 +1,3 @@
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS last_seen BIGINT;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status_text VARCHAR(140) DEFAULT '';
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS invisible INTEGER DEFAULT 0;
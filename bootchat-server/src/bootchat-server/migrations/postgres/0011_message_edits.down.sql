@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS hidden_messages;
+DROP INDEX IF EXISTS message_revisions_message_id;
+DROP TABLE IF EXISTS message_revisions;
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
@@ -0,0 +1,17 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at BIGINT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at BIGINT;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    message_id BIGINT,
+    body VARCHAR(10000),
+    replaced BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS message_revisions_message_id ON message_revisions(message_id);
+
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    username VARCHAR(32),
+    message_id BIGINT,
+    PRIMARY KEY(username, message_id)
+);
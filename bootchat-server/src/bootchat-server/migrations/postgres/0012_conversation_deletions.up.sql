@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS conversation_deletions (
+    username VARCHAR(32),
+    peer VARCHAR(32),
+    upto_id BIGINT,
+    previous_id BIGINT DEFAULT 0,
+    deleted BIGINT,
+    PRIMARY KEY(username, peer)
+);
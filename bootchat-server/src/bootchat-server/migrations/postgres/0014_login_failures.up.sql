@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    kind VARCHAR(8),
+    name VARCHAR(255),
+    failures INTEGER,
+    last_failure BIGINT,
+    PRIMARY KEY(kind, name)
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_last_failure ON login_failures(last_failure);
@@ -0,0 +1,12 @@
+ALTER TABLE accounts ALTER COLUMN username TYPE VARCHAR(32), ALTER COLUMN nickname TYPE VARCHAR(32);
+ALTER TABLE messages ALTER COLUMN to_user TYPE VARCHAR(32), ALTER COLUMN from_user TYPE VARCHAR(32);
+ALTER TABLE sessions ALTER COLUMN username TYPE VARCHAR(32);
+ALTER TABLE rooms ALTER COLUMN owner TYPE VARCHAR(32);
+ALTER TABLE room_members ALTER COLUMN username TYPE VARCHAR(32);
+ALTER TABLE conversation_settings ALTER COLUMN username TYPE VARCHAR(32), ALTER COLUMN peer TYPE VARCHAR(32);
+ALTER TABLE attachments ALTER COLUMN owner TYPE VARCHAR(32);
+ALTER TABLE contacts ALTER COLUMN username TYPE VARCHAR(32), ALTER COLUMN contact TYPE VARCHAR(32);
+ALTER TABLE friend_requests ALTER COLUMN from_user TYPE VARCHAR(32), ALTER COLUMN to_user TYPE VARCHAR(32);
+ALTER TABLE blocks ALTER COLUMN username TYPE VARCHAR(32), ALTER COLUMN blocked TYPE VARCHAR(32);
+ALTER TABLE hidden_messages ALTER COLUMN username TYPE VARCHAR(32);
+ALTER TABLE conversation_deletions ALTER COLUMN username TYPE VARCHAR(32), ALTER COLUMN peer TYPE VARCHAR(32);
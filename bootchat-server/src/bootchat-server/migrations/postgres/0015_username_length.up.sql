@@ -0,0 +1,13 @@
+-- usernames and nicknames may be up to 64 characters (see params.go)
+ALTER TABLE accounts ALTER COLUMN username TYPE VARCHAR(64), ALTER COLUMN nickname TYPE VARCHAR(64);
+ALTER TABLE messages ALTER COLUMN to_user TYPE VARCHAR(64), ALTER COLUMN from_user TYPE VARCHAR(64);
+ALTER TABLE sessions ALTER COLUMN username TYPE VARCHAR(64);
+ALTER TABLE rooms ALTER COLUMN owner TYPE VARCHAR(64);
+ALTER TABLE room_members ALTER COLUMN username TYPE VARCHAR(64);
+ALTER TABLE conversation_settings ALTER COLUMN username TYPE VARCHAR(64), ALTER COLUMN peer TYPE VARCHAR(64);
+ALTER TABLE attachments ALTER COLUMN owner TYPE VARCHAR(64);
+ALTER TABLE contacts ALTER COLUMN username TYPE VARCHAR(64), ALTER COLUMN contact TYPE VARCHAR(64);
+ALTER TABLE friend_requests ALTER COLUMN from_user TYPE VARCHAR(64), ALTER COLUMN to_user TYPE VARCHAR(64);
+ALTER TABLE blocks ALTER COLUMN username TYPE VARCHAR(64), ALTER COLUMN blocked TYPE VARCHAR(64);
+ALTER TABLE hidden_messages ALTER COLUMN username TYPE VARCHAR(64);
+ALTER TABLE conversation_deletions ALTER COLUMN username TYPE VARCHAR(64), ALTER COLUMN peer TYPE VARCHAR(64);
@@ -0,0 +1 @@
+ALTER TABLE conversation_deletions DROP COLUMN IF EXISTS previous_deleted;
@@ -0,0 +1,20 @@
+-- accounts and messages as shipped in etc/bootchat.db before migrations existed
+CREATE TABLE IF NOT EXISTS accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(32) UNIQUE,
+    nickname VARCHAR(32) UNIQUE,
+    gender CHARACTER(1),
+    picture TEXT,
+    security_question VARCHAR(256),
+    security_answer VARCHAR(256),
+    password VARCHAR(128),
+    new_message INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    to_user VARCHAR(32),
+    from_user VARCHAR(32),
+    body VARCHAR(10000),
+    time VARCHAR(32)
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash CHARACTER(64) UNIQUE,
+    username VARCHAR(32),
+    created INTEGER,
+    expires INTEGER,
+    last_seen INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS sessions_username ON sessions(username);
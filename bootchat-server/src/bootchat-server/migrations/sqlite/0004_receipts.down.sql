@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS messages_unread;
+ALTER TABLE messages DROP COLUMN read_at;
+ALTER TABLE messages DROP COLUMN delivered_at;
@@ -0,0 +1,7 @@
+ALTER TABLE messages ADD COLUMN delivered_at INTEGER;
+ALTER TABLE messages ADD COLUMN read_at INTEGER;
+
+-- history from before receipts counts as read
+UPDATE messages SET delivered_at = CAST(strftime('%s','now') AS INTEGER), read_at = CAST(strftime('%s','now') AS INTEGER);
+
+CREATE INDEX IF NOT EXISTS messages_unread ON messages(to_user, read_at);
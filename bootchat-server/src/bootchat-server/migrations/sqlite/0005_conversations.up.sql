@@ -0,0 +1,16 @@
+CREATE INDEX IF NOT EXISTS messages_to_from ON messages(to_user, from_user, id);
+CREATE INDEX IF NOT EXISTS messages_from_to ON messages(from_user, to_user, id);
+
+CREATE TABLE IF NOT EXISTS conversation_settings (
+    username VARCHAR(32),
+    peer VARCHAR(32),
+    room_id INTEGER,
+    muted INTEGER,
+    archived INTEGER,
+    PRIMARY KEY(username, peer, room_id)
+);
+
+ALTER TABLE room_members ADD COLUMN last_read_id INTEGER DEFAULT 0;
+
+-- members have read everything sent before this migration
+UPDATE room_members SET last_read_id = COALESCE((SELECT MAX(id) FROM messages WHERE messages.room_id = room_members.room_id), 0);
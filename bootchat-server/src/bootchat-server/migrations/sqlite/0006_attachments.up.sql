@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner VARCHAR(32),
+    message_id INTEGER DEFAULT 0,
+    sha256 CHARACTER(64),
+    size INTEGER,
+    content_type VARCHAR(128),
+    filename VARCHAR(255),
+    created INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS attachments_message_id ON attachments(message_id);
+CREATE INDEX IF NOT EXISTS attachments_owner ON attachments(owner);
+CREATE INDEX IF NOT EXISTS attachments_sha256 ON attachments(sha256);
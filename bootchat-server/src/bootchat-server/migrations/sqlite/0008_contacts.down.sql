@@ -0,0 +1,4 @@
+ALTER TABLE accounts DROP COLUMN contacts_only;
+DROP INDEX IF EXISTS friend_requests_to_user;
+DROP TABLE IF EXISTS friend_requests;
+DROP TABLE IF EXISTS contacts;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS contacts (
+    username VARCHAR(32),
+    contact VARCHAR(32),
+    created INTEGER,
+    PRIMARY KEY(username, contact)
+);
+
+CREATE TABLE IF NOT EXISTS friend_requests (
+    from_user VARCHAR(32),
+    to_user VARCHAR(32),
+    created INTEGER,
+    PRIMARY KEY(from_user, to_user)
+);
+
+CREATE INDEX IF NOT EXISTS friend_requests_to_user ON friend_requests(to_user);
+
+ALTER TABLE accounts ADD COLUMN contacts_only INTEGER DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE accounts DROP COLUMN drop_blocked;
+DROP INDEX IF EXISTS blocks_blocked;
+DROP TABLE IF EXISTS blocks;
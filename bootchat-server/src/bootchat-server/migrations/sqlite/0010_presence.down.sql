@@ -0,0 +1,3 @@
+ALTER TABLE accounts DROP COLUMN invisible;
+ALTER TABLE accounts DROP COLUMN status_text;
+ALTER TABLE accounts DROP COLUMN last_seen;
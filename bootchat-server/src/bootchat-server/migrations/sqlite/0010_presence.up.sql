@@ -0,0 +1,3 @@
+ALTER TABLE accounts ADD COLUMN last_seen INTEGER;
+ALTER TABLE accounts ADD COLUMN status_text VARCHAR(140) DEFAULT '';
+ALTER TABLE accounts ADD COLUMN invisible INTEGER DEFAULT 0;
@@ -0,0 +1,17 @@
+ALTER TABLE messages ADD COLUMN edited_at INTEGER;
+ALTER TABLE messages ADD COLUMN deleted_at INTEGER;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER,
+    body VARCHAR(10000),
+    replaced INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS message_revisions_message_id ON message_revisions(message_id);
+
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    username VARCHAR(32),
+    message_id INTEGER,
+    PRIMARY KEY(username, message_id)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS conversation_deletions (
+    username VARCHAR(32),
+    peer VARCHAR(32),
+    upto_id INTEGER,
+    previous_id INTEGER DEFAULT 0,
+    deleted INTEGER,
+    PRIMARY KEY(username, peer)
+);
@@ -0,0 +1 @@
+ALTER TABLE accounts ADD COLUMN disabled INTEGER DEFAULT 0;
@@ -0,0 +1,2 @@
+-- nothing to undo, see 0015_username_length.up.sql
+SELECT 1;
@@ -0,0 +1,3 @@
+-- SQLite does not enforce VARCHAR lengths, usernames of up to 64 characters
+-- already fit, see postgres/0015_username_length.up.sql
+SELECT 1;
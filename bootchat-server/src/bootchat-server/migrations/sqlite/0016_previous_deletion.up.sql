@@ -0,0 +1,5 @@
+-- the time of the deletion previous_id belongs to, see RestoreConversation
+ALTER TABLE conversation_deletions ADD COLUMN previous_deleted INTEGER DEFAULT 0;
+
+-- rows from before only know the newer time, which purges no earlier than the old one
+UPDATE conversation_deletions SET previous_deleted = deleted WHERE previous_id > 0;
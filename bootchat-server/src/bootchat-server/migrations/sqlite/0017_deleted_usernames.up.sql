@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS deleted_usernames (
+    username VARCHAR(64) PRIMARY KEY,
+    deleted INTEGER
+);
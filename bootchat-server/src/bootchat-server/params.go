@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+	Request parameters
+
+	One struct per request, registered with it in requestHandlers, see
+	validation.go for the field types and rules. The handler gets it filled
+	in as its params, a request without a struct takes no parameters and
+	gets nil.
+
+	"remote_addr" and "token" are set by the server, a struct only names
+	them when its handler needs them.
+
+	A new password is limited to maxPasswordBytes, one to log in with is
+	not, it may have been set before the limit.
+
+	Rules only cover what holds for every caller. Checks with their own
+	error code (message.empty, room.invalid_name, room.invalid_role...) or
+	a configured limit stay in the handlers.
+*/
+
+/* accounts and sessions */
+
+type loginParams struct {
+	Username   string `param:"username" validate:"required,max=64"`
+	Password   string `param:"password" validate:"required,max=1024"`
+	RemoteAddr string `param:"remote_addr"`
+}
+
+type logoutParams struct {
+	Token string `param:"token" validate:"required"`
+}
+
+type registerParams struct {
+	Username string `param:"username" validate:"required,min=1,max=64,charset=username"`
+	Password string `param:"password" validate:"required,maxbytes=72"`
+	Nickname string `param:"nickname" validate:"max=64,charset=line"`
+	Question string `param:"question" validate:"max=256,charset=line"`
+	Answer   string `param:"answer" validate:"max=256,charset=line"`
+}
+
+// regusr is register without a nickname
+type createUserParams struct {
+	Username string `param:"username" validate:"required,min=1,max=64,charset=username"`
+	Password string `param:"password" validate:"required,maxbytes=72"`
+	Question string `param:"question" validate:"required,max=256,charset=line"`
+	Answer   string `param:"answer" validate:"required,max=256,charset=line"`
+}
+
+type forgotPasswordParams struct {
+	Username    string `param:"username" validate:"required,max=64"`
+	Question    string `param:"security_question" validate:"required,max=256"`
+	Answer      string `param:"security_answer" validate:"required,max=256"`
+	NewPassword string `param:"newpassword" validate:"required,maxbytes=72"`
+	RemoteAddr  string `param:"remote_addr"`
+}
+
+type newMessageFlagParams struct {
+	Value bool `param:"value" validate:"required"`
+}
+
+/* messages */
+
+type pageFields struct {
+	SinceId  int64 `param:"since_id" validate:"min=0"`
+	BeforeId int64 `param:"before_id" validate:"min=0"`
+	Limit    int64 `param:"limit" validate:"min=0"`
+}
+
+type sendParams struct {
+	ToUser      string  `param:"to_user" validate:"max=64"`
+	RoomId      int64   `param:"room_id" validate:"min=0"`
+	Body        string  `param:"body" validate:"max=8192,charset=text"`
+	Attachments []int64 `param:"attachments"`
+}
+
+type messagesPageParams struct {
+	Peer string `param:"peer" validate:"max=64"`
+	pageFields
+}
+
+type deleteConvoParams struct {
+	RemoveUser string `param:"remove_user" validate:"required,max=64"`
+}
+
+type peerParams struct {
+	Peer string `param:"peer" validate:"required,max=64"`
+}
+
+type editMessageParams struct {
+	MessageId int64  `param:"message_id" validate:"required,min=1"`
+	Body      string `param:"body" validate:"max=8192,charset=text"`
+}
+
+type deleteMessageParams struct {
+	MessageId int64  `param:"message_id" validate:"required,min=1"`
+	Scope     string `param:"scope" validate:"oneof=me|everyone"`
+}
+
+type messageIdParams struct {
+	MessageId int64 `param:"message_id" validate:"required,min=1"`
+}
+
+type markReadParams struct {
+	Peer   string `param:"peer" validate:"max=64"`
+	RoomId int64  `param:"room_id" validate:"min=0"`
+	UpToId int64  `param:"up_to_id" validate:"min=0"`
+}
+
+type conversationsParams struct {
+	Archived *bool `param:"archived"`
+}
+
+type setConversationParams struct {
+	Peer     string `param:"peer" validate:"max=64"`
+	RoomId   int64  `param:"room_id" validate:"min=0"`
+	Muted    *bool  `param:"muted"`
+	Archived *bool  `param:"archived"`
+}
+
+type searchParams struct {
+	Q        string       `param:"q" validate:"max=256,charset=line"`
+	Peer     string       `param:"peer" validate:"max=64"`
+	RoomId   int64        `param:"room_id" validate:"min=0"`
+	Since    timeParam    `param:"since"`
+	Until    endTimeParam `param:"until"`
+	BeforeId int64        `param:"before_id" validate:"min=0"`
+	Limit    int64        `param:"limit" validate:"min=0"`
+}
+
+type typingParams struct {
+	Peer   string `param:"peer" validate:"max=64"`
+	RoomId int64  `param:"room_id" validate:"min=0"`
+	State  string `param:"state" validate:"oneof=typing|stopped"`
+}
+
+/* rooms */
+
+type createRoomParams struct {
+	Name    string   `param:"name" validate:"charset=line"`
+	Public  *bool    `param:"public"`
+	Members []string `param:"members"`
+}
+
+type roomIdParams struct {
+	RoomId int64 `param:"room_id" validate:"required,min=1"`
+}
+
+type roomMemberParams struct {
+	RoomId int64  `param:"room_id" validate:"required,min=1"`
+	Member string `param:"member" validate:"required,max=64"`
+}
+
+type roomRoleParams struct {
+	RoomId int64  `param:"room_id" validate:"required,min=1"`
+	Member string `param:"member" validate:"required,max=64"`
+	Role   string `param:"role"`
+}
+
+type roomMessagesParams struct {
+	RoomId int64 `param:"room_id" validate:"required,min=1"`
+	pageFields
+}
+
+/* attachments */
+
+type startUploadParams struct {
+	Filename string `param:"filename" validate:"max=255,charset=line"`
+	Size     int64  `param:"size" validate:"required,min=1"`
+}
+
+type uploadIdParams struct {
+	UploadId string `param:"upload_id" validate:"required,max=64"`
+}
+
+type attachmentIdParams struct {
+	AttachmentId int64 `param:"attachment_id" validate:"required,min=1"`
+}
+
+/* contacts, privacy, blocks and presence */
+
+type contactParams struct {
+	Contact string `param:"contact" validate:"required,max=64"`
+}
+
+type privacyParams struct {
+	ContactsOnly *bool `param:"contacts_only"`
+	DropBlocked  *bool `param:"drop_blocked"`
+}
+
+type blockParams struct {
+	User        string `param:"user" validate:"required,max=64"`
+	HideHistory bool   `param:"hide_history"`
+}
+
+type unblockParams struct {
+	User string `param:"user" validate:"required,max=64"`
+}
+
+type presenceParams struct {
+	Users []string `param:"users" validate:"required"`
+}
+
+type setPresenceParams struct {
+	Invisible  *bool   `param:"invisible"`
+	StatusText *string `param:"status_text" validate:"charset=line"`
+}
+
+// every params struct is checked once at startup, a mistake in a tag or a
+// route wildcard no struct takes panics here and not in the middle of a request
+func init() {
+	for name, handler := range requestHandlers {
+		if handler.params == nil {
+			continue
+		}
+		if err := checkParamsStruct(reflect.TypeOf(handler.params)); err != nil {
+			panic(fmt.Sprintf("parameters of %s: %s", name, err.Error()))
+		}
+	}
+
+	for _, route := range apiRoutes {
+		known := make(map[string]bool)
+		if params := requestHandlers[route.request].params; params != nil {
+			decode_params(map[string]interface{}{}, params, make(map[string]string), known)
+		}
+
+		for _, name := range patternWildcards(route.pattern) {
+			if renamed, exists := route.rename[name]; exists {
+				name = renamed
+			}
+			if !known[name] {
+				panic(fmt.Sprintf("route %s: %s is not a parameter of %s", route.pattern, name, route.request))
+			}
+		}
+	}
+}
+
+func checkParamsStruct(structType reflect.Type) error {
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("%s is not a struct", structType)
+	}
+
+	for _, field := range reflect.VisibleFields(structType) {
+		if field.Anonymous {
+			continue
+		}
+
+		switch field.Type {
+		case stringType, int64Type, boolType, optStringType, optBoolType, idsType, namesType, timeType, endTimeType:
+		default:
+			return fmt.Errorf("%s has the unsupported type %s", field.Name, field.Type)
+		}
+
+		if len(field.Tag.Get("param")) == 0 {
+			return fmt.Errorf("%s has no param tag", field.Name)
+		}
+
+		tag := field.Tag.Get("validate")
+		if len(tag) == 0 {
+			continue
+		}
+
+		for _, rule := range strings.Split(tag, ",") {
+			name, arg, _ := strings.Cut(rule, "=")
+			switch name {
+			case "required", "oneof":
+			case "min", "max", "maxbytes":
+				if _, err := fmt.Sscanf(arg, "%d", new(int64)); err != nil {
+					return fmt.Errorf("%s has a bad bound %s", field.Name, rule)
+				}
+			case "charset":
+				if arg != "username" && arg != "line" && arg != "text" {
+					return fmt.Errorf("%s has the unknown charset %s", field.Name, arg)
+				}
+			default:
+				return fmt.Errorf("%s has the unknown rule %s", field.Name, rule)
+			}
+		}
+	}
+
+	return nil
+}
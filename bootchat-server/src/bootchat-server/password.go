@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	Password hashing
+
+	Passwords are stored as self describing encoded strings so the algorithm
+	and its cost parameters travel with every row:
+
+	 bcrypt   $2a$<cost>$<22 char salt><31 char hash>
+	 argon2id $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<b64 salt>$<b64 hash>
+	 md5      <32 hex chars> (legacy rows, verify only)
+
+	Rows that do not match the current hasher (legacy md5, another algorithm
+	or weaker parameters) are flagged for rehash and upgraded by
+	verify_user_login the next time the user signs in successfully.
+
+	A new password is at most maxPasswordBytes long whatever the hasher,
+	bcrypt reads no more and refuses to hash a longer one, so switching
+	passwords.hasher never strands a password.
+
+	Every check takes a place in passwordChecks first. argon2id needs its
+	memory for each one, so parallel logins queue for a CPU instead of
+	adding up until the process runs out of memory.
+*/
+
+const maxPasswordBytes = 72
+
+// passwordChecks holds a place for every hash being verified, see check_password.
+var passwordChecks = make(chan struct{}, runtime.NumCPU())
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+type PasswordHasher interface {
+	// Name returns the algorithm identifier, e.g. "bcrypt" or "argon2id".
+	Name() string
+	// Hash returns the encoded hash of password using a fresh random salt.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches an encoded hash produced by this hasher.
+	Verify(password string, encoded string) (bool, error)
+	// Handles reports whether encoded was produced by this algorithm.
+	Handles(encoded string) bool
+	// NeedsRehash reports whether encoded uses weaker parameters than the hasher.
+	NeedsRehash(encoded string) bool
+}
+
+/* bcrypt */
+
+type bcryptHasher struct {
+	cost int
+}
+
+func newBcryptHasher(cost int) *bcryptHasher {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return &bcryptHasher{cost: cost}
+}
+
+func (h *bcryptHasher) Name() string {
+	return "bcrypt"
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *bcryptHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+	return cost < h.cost
+}
+
+/* argon2id */
+
+type argon2idHasher struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	saltLen int
+	keyLen  uint32
+}
+
+type argon2idParams struct {
+	version int
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func newArgon2idHasher() *argon2idHasher {
+	return &argon2idHasher{
+		memory:  64 * 1024,
+		time:    1,
+		threads: 4,
+		saltLen: 16,
+		keyLen:  32,
+	}
+}
+
+func (h *argon2idHasher) Name() string {
+	return "argon2id"
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	return encoded, nil
+}
+
+func (h *argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (h *argon2idHasher) Handles(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *argon2idHasher) NeedsRehash(encoded string) bool {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.version != argon2.Version ||
+		params.memory < h.memory ||
+		params.time < h.time ||
+		params.threads < h.threads ||
+		uint32(len(params.key)) < h.keyLen
+}
+
+func decodeArgon2id(encoded string) (*argon2idParams, error) {
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errUnknownHashFormat
+	}
+
+	params := &argon2idParams{}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &params.version); err != nil {
+		return nil, errUnknownHashFormat
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, errUnknownHashFormat
+	}
+
+	var err error
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, errUnknownHashFormat
+	}
+
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return nil, errUnknownHashFormat
+	}
+
+	return params, nil
+}
+
+/* legacy md5 (verify only) */
+
+func isLegacyMd5Hash(encoded string) bool {
+	if len(encoded) != 32 {
+		return false
+	}
+	for _, c := range encoded {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+/* package level helpers used by database.go */
+
+// passwordHasher is used for every new hash; see select_password_hasher.
+var passwordHasher PasswordHasher = newArgon2idHasher()
+
+// knownHashers lists every algorithm we can still verify.
+var knownHashers = []PasswordHasher{
+	newArgon2idHasher(),
+	newBcryptHasher(bcrypt.DefaultCost),
+}
+
+/*
+	select_password_hasher - choose the algorithm used for new hashes
+	 name string ("argon2id" or "bcrypt")
+	 bcryptCost int (ignored for argon2id, 0 for the default)
+
+	 returns (error)
+*/
+func select_password_hasher(name string, bcryptCost int) error {
+	switch name {
+	case "argon2id":
+		passwordHasher = newArgon2idHasher()
+	case "bcrypt":
+		passwordHasher = newBcryptHasher(bcryptCost)
+	default:
+		return fmt.Errorf("unsupported password hasher: %s", name)
+	}
+	return nil
+}
+
+/*
+	hash_password - hash a plaintext password with the current hasher
+	 password string
+
+	 returns (string, error)
+	 errInvalidParameter for a password over maxPasswordBytes.
+*/
+func hash_password(password string) (string, error) {
+	if len(password) > maxPasswordBytes {
+		return "", errInvalidParameter.withDetail("password must be at most " + strconv.Itoa(maxPasswordBytes) + " bytes")
+	}
+
+	return passwordHasher.Hash(password)
+}
+
+// dummyHash is a hash of nothing by the current hasher, see check_dummy_password.
+var dummyHash struct {
+	mu      sync.Mutex
+	hasher  PasswordHasher
+	encoded string
+}
+
+/*
+	check_dummy_password - spend the time of a password check on nothing
+	 password string
+
+	 A login for a username without a password hash is answered only after
+	 this, as late as one with a wrong password, the timing must not tell
+	 which usernames exist.
+*/
+func check_dummy_password(password string) {
+	dummyHash.mu.Lock()
+	if dummyHash.hasher != passwordHasher {
+		encoded, err := passwordHasher.Hash("dummy password")
+		if err != nil {
+			dummyHash.mu.Unlock()
+			log.Printf("Unable to hash the dummy password: %s", err.Error())
+			return
+		}
+		dummyHash.hasher, dummyHash.encoded = passwordHasher, encoded
+	}
+	encoded := dummyHash.encoded
+	dummyHash.mu.Unlock()
+
+	check_password(password, encoded)
+}
+
+/*
+	check_password - verify a plaintext password against a stored hash
+	 password string
+	 encoded string
+
+	 returns (match bool, rehash bool, error)
+	 rehash is true when the stored hash should be replaced with hash_password(password)
+	 Waits while passwordChecks is full.
+*/
+func check_password(password string, encoded string) (bool, bool, error) {
+	if len(encoded) == 0 {
+		return false, false, nil
+	}
+
+	passwordChecks <- struct{}{}
+	defer func() { <-passwordChecks }()
+
+	if isLegacyMd5Hash(encoded) {
+		match := subtle.ConstantTimeCompare([]byte(md5Sum(password)), []byte(encoded)) == 1
+		return match, match, nil
+	}
+
+	if passwordHasher.Handles(encoded) {
+		match, err := passwordHasher.Verify(password, encoded)
+		if err != nil || !match {
+			return false, false, err
+		}
+		return true, passwordHasher.NeedsRehash(encoded), nil
+	}
+
+	for _, hasher := range knownHashers {
+		if hasher.Handles(encoded) {
+			match, err := hasher.Verify(password, encoded)
+			if err != nil || !match {
+				return false, false, err
+			}
+			// verified with an algorithm other than the current one
+			return true, true, nil
+		}
+	}
+
+	return false, false, errUnknownHashFormat
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useHasher makes hasher the current one until the test ends.
+func useHasher(t *testing.T, hasher PasswordHasher) {
+	previous := passwordHasher
+	passwordHasher = hasher
+	t.Cleanup(func() { passwordHasher = previous })
+}
+
+// countingHasher counts the passwords it verifies.
+type countingHasher struct {
+	*bcryptHasher
+	verified int
+}
+
+func (h *countingHasher) Verify(password string, encoded string) (bool, error) {
+	h.verified++
+	return h.bcryptHasher.Verify(password, encoded)
+}
+
+func TestHasherRoundTrip(t *testing.T) {
+	hashers := []PasswordHasher{newArgon2idHasher(), newBcryptHasher(4)}
+
+	for i, hasher := range hashers {
+		other := hashers[1-i]
+
+		encoded, err := hasher.Hash("123456")
+		if err != nil {
+			t.Fatalf("%s: Hash: %s", hasher.Name(), err.Error())
+		}
+
+		if again, _ := hasher.Hash("123456"); again == encoded {
+			t.Errorf("%s: two hashes of one password are the same, no salt", hasher.Name())
+		}
+
+		if !hasher.Handles(encoded) || other.Handles(encoded) {
+			t.Errorf("%s: Handles is wrong for %s", hasher.Name(), encoded)
+		}
+
+		if match, err := hasher.Verify("123456", encoded); !match || err != nil {
+			t.Errorf("%s: the password does not verify: %v", hasher.Name(), err)
+		}
+
+		if match, err := hasher.Verify("1234567", encoded); match || err != nil {
+			t.Errorf("%s: a wrong password verifies: %v", hasher.Name(), err)
+		}
+
+		if hasher.NeedsRehash(encoded) {
+			t.Errorf("%s: a fresh hash needs a rehash", hasher.Name())
+		}
+	}
+
+	weaker := &argon2idHasher{memory: 1024, time: 1, threads: 1, saltLen: 16, keyLen: 32}
+	encoded, _ := weaker.Hash("123456")
+	if !newArgon2idHasher().NeedsRehash(encoded) {
+		t.Errorf("argon2id with less memory does not need a rehash")
+	}
+
+	encoded, _ = newBcryptHasher(4).Hash("123456")
+	if !newBcryptHasher(5).NeedsRehash(encoded) {
+		t.Errorf("bcrypt at a lower cost does not need a rehash")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	useHasher(t, newArgon2idHasher())
+
+	bcryptHash, _ := newBcryptHasher(4).Hash("123456")
+	argon2Hash, _ := passwordHasher.Hash("123456")
+
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		match    bool
+		rehash   bool
+	}{
+		{"current", "123456", argon2Hash, true, false},
+		{"current wrong", "654321", argon2Hash, false, false},
+		{"legacy md5", "123456", md5Sum("123456"), true, true},
+		{"legacy md5 wrong", "654321", md5Sum("123456"), false, false},
+		{"other algorithm", "123456", bcryptHash, true, true},
+		{"other algorithm wrong", "654321", bcryptHash, false, false},
+		{"no hash", "123456", "", false, false},
+	}
+
+	for _, test := range tests {
+		match, rehash, err := check_password(test.password, test.encoded)
+		if err != nil || match != test.match || rehash != test.rehash {
+			t.Errorf("%s: got %v %v %v, want %v %v", test.name, match, rehash, err, test.match, test.rehash)
+		}
+	}
+
+	if _, _, err := check_password("123456", "$unknown$"); err != errUnknownHashFormat {
+		t.Errorf("an unknown format gave %v", err)
+	}
+}
+
+func TestLegacyPasswordUpgradedOnLogin(t *testing.T) {
+	useHasher(t, newArgon2idHasher())
+
+	// a failure in between must not hold up the correct password
+	defer func(backoff time.Duration) { loginBackoff = backoff }(loginBackoff)
+	loginBackoff = 0
+
+	store := newMemStore()
+	legacy := md5Sum("123456")
+	store.CreateAccount("alice", "alice", "question", "answer", legacy)
+
+	if success, err := verify_user_login(store, "alice", "654321", ""); success || err != nil {
+		t.Fatalf("wrong password: %v %v", success, err)
+	}
+	if encoded, _ := store.GetPasswordHash("alice"); encoded != legacy {
+		t.Errorf("a failed login replaced the hash with %s", encoded)
+	}
+
+	if success, err := verify_user_login(store, "alice", "123456", ""); !success || err != nil {
+		t.Fatalf("right password: %v %v", success, err)
+	}
+
+	encoded, _ := store.GetPasswordHash("alice")
+	if !strings.HasPrefix(encoded, "$argon2id$") {
+		t.Fatalf("the legacy hash was not upgraded: %s", encoded)
+	}
+
+	if success, _ := verify_user_login(store, "alice", "123456", ""); !success {
+		t.Errorf("the upgraded hash does not verify")
+	}
+	if again, _ := store.GetPasswordHash("alice"); again != encoded {
+		t.Errorf("a current hash was replaced")
+	}
+}
+
+func TestPasswordLength(t *testing.T) {
+	longest := strings.Repeat("x", maxPasswordBytes)
+	tooLong := longest + "x"
+
+	for _, hasher := range []PasswordHasher{newArgon2idHasher(), newBcryptHasher(4)} {
+		useHasher(t, hasher)
+
+		encoded, err := hash_password(longest)
+		if err != nil {
+			t.Fatalf("%s: %d bytes: %s", hasher.Name(), maxPasswordBytes, err.Error())
+		}
+		if match, _, _ := check_password(longest, encoded); !match {
+			t.Errorf("%s: %d bytes do not verify", hasher.Name(), maxPasswordBytes)
+		}
+
+		var apiErr *apiError
+		if _, err = hash_password(tooLong); !errors.As(err, &apiErr) || apiErr.code != errInvalidParameter.code {
+			t.Errorf("%s: %d bytes gave %v", hasher.Name(), maxPasswordBytes+1, err)
+		}
+
+		// a login may carry a longer one, it is only wrong
+		if match, _, err := check_password(strings.Repeat("y", maxPasswordBytes+1), encoded); match || err != nil {
+			t.Errorf("%s: checking %d bytes gave %v %v", hasher.Name(), maxPasswordBytes+1, match, err)
+		}
+	}
+
+	// the reason for the limit, utf-8 counts in bytes
+	if _, err := newBcryptHasher(4).Hash(tooLong); err == nil {
+		t.Errorf("bcrypt hashed %d bytes", maxPasswordBytes+1)
+	}
+	if _, err := hash_password(strings.Repeat("ä", maxPasswordBytes/2+1)); err == nil {
+		t.Errorf("%d two byte characters were accepted", maxPasswordBytes/2+1)
+	}
+}
+
+func TestUnknownUserChecksPassword(t *testing.T) {
+	hasher := &countingHasher{bcryptHasher: newBcryptHasher(8)}
+	useHasher(t, hasher)
+
+	store := newMemStore()
+	encoded, _ := hasher.Hash("123456")
+	store.CreateAccount("alice", "alice", "question", "answer", encoded)
+
+	// the dummy hash is made once per hasher
+	check_dummy_password("123456")
+
+	measure := func(username string) time.Duration {
+		hasher.verified = 0
+		fastest := time.Hour
+		for i := 0; i < 3; i++ {
+			start := time.Now()
+			if success, err := check_user_login(store, username, "654321"); success || err != nil {
+				t.Fatalf("%s: %v %v", username, success, err)
+			}
+			if took := time.Since(start); took < fastest {
+				fastest = took
+			}
+		}
+		if hasher.verified != 3 {
+			t.Errorf("%s: %d password checks in 3 logins", username, hasher.verified)
+		}
+		return fastest
+	}
+
+	wrong := measure("alice")
+	unknown := measure("nobody")
+
+	if unknown < wrong/2 {
+		t.Errorf("an unknown username took %s, a wrong password %s", unknown, wrong)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Presence
+
+	Every authenticated request and every websocket connection, and any
+	frame a client sends on it, counts as activity. From that the server
+	derives a status:
+
+	 online   a websocket is open and the user was active within
+	          presenceAwayAfter, or there was a request within presenceIdleTimeout
+	 away     a websocket is open but the user has been idle longer
+	 offline  neither
+
+	last_seen is the last activity, written to the database at most every
+	presenceSaveInterval. A user can set a status text and go invisible:
+	others then see them offline with the last_seen from before, and
+	last_seen stops moving until they are visible again.
+
+	Changes are pushed to the user's contacts and to the user's own
+	connections:
+
+	 {"event":"presence","username":..,"status":..,"last_seen":..,"status_text":..}
+*/
+
+const presenceOnline = "online"
+const presenceAway = "away"
+const presenceOffline = "offline"
+
+const presenceIdleTimeout = 2 * time.Minute
+const presenceAwayAfter = 5 * time.Minute
+
+// presenceSweepInterval is how often idle users are moved to away or offline.
+const presenceSweepInterval = 30 * time.Second
+
+const presenceSaveInterval = time.Minute
+
+const maxStatusTextLength = 140
+const maxPresenceUsers = 200
+
+type presenceEntry struct {
+	lastActive time.Time
+	saved      time.Time // when last_seen was last written
+	status     string    // as last published
+	invisible  bool
+}
+
+// presenceTracker holds the live state of recently active users, users
+// that went offline are dropped from it and only live in the database.
+type presenceTracker struct {
+	mu      sync.Mutex
+	entries map[string]*presenceEntry
+}
+
+var presence = newPresenceTracker()
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{entries: make(map[string]*presenceEntry)}
+}
+
+// statusAt derives the status of an entry from its activity and open connections.
+func (entry *presenceEntry) statusAt(now time.Time, connections int) string {
+	idle := now.Sub(entry.lastActive)
+
+	if connections > 0 {
+		if idle < presenceAwayAfter {
+			return presenceOnline
+		}
+		return presenceAway
+	}
+
+	if idle < presenceIdleTimeout {
+		return presenceOnline
+	}
+
+	return presenceOffline
+}
+
+// visibleStatus is what others see.
+func (entry *presenceEntry) visibleStatus() string {
+	if entry.invisible {
+		return presenceOffline
+	}
+	return entry.status
+}
+
+/*
+	touch - record activity by username
+	 store Store
+	 username string
+*/
+func (tracker *presenceTracker) touch(store Store, username string) {
+	tracker.mu.Lock()
+	_, exists := tracker.entries[username]
+	tracker.mu.Unlock()
+
+	var loaded *presenceEntry
+	if !exists {
+		var err error
+		if loaded, err = load_presence_entry(store, username); err != nil {
+			log.Printf("Unable to load presence of %s: %s", username, err.Error())
+			return
+		}
+	}
+
+	now := time.Now()
+
+	tracker.mu.Lock()
+	entry, exists := tracker.entries[username]
+	if !exists {
+		if loaded == nil {
+			// swept in between, the next activity tracks it again
+			tracker.mu.Unlock()
+			return
+		}
+		entry = loaded
+		tracker.entries[username] = entry
+	}
+	entry.lastActive = now
+	save := !entry.invisible && now.Sub(entry.saved) >= presenceSaveInterval
+	if save {
+		entry.saved = now
+	}
+	tracker.mu.Unlock()
+
+	if save {
+		if err := store.SetLastSeen(username, now); err != nil {
+			log.Printf("Unable to save last seen of %s: %s", username, err.Error())
+		}
+	}
+
+	tracker.update(store, username)
+}
+
+// load_presence_entry reads the stored settings of a user that is not tracked yet.
+func load_presence_entry(store Store, username string) (*presenceEntry, error) {
+	rows, err := store.GetPresence([]string{username})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errUserNotFound
+	}
+
+	return &presenceEntry{status: presenceOffline, invisible: rows[0]["invisible"] == "1"}, nil
+}
+
+/*
+	update - recompute username's status and publish it when it changed
+	 store Store
+	 username string
+*/
+func (tracker *presenceTracker) update(store Store, username string) {
+	connections := eventHub.connectionCount(username)
+
+	tracker.mu.Lock()
+	entry, exists := tracker.entries[username]
+	if !exists {
+		tracker.mu.Unlock()
+		return
+	}
+
+	wasVisible := entry.visibleStatus()
+	status := entry.statusAt(time.Now(), connections)
+	changed := status != entry.status
+	entry.status = status
+	contacts := entry.visibleStatus() != wasVisible
+	tracker.mu.Unlock()
+
+	if changed {
+		publish_presence(store, username, contacts)
+	}
+}
+
+// sweep moves idle users to away or offline and forgets offline ones.
+func (tracker *presenceTracker) sweep(store Store) {
+	tracker.mu.Lock()
+	usernames := make([]string, 0, len(tracker.entries))
+	for username := range tracker.entries {
+		usernames = append(usernames, username)
+	}
+	tracker.mu.Unlock()
+
+	for _, username := range usernames {
+		tracker.update(store, username)
+
+		tracker.mu.Lock()
+		entry, exists := tracker.entries[username]
+		if !exists {
+			// forgotten in between
+			tracker.mu.Unlock()
+			continue
+		}
+		gone := entry.status == presenceOffline
+		if gone {
+			delete(tracker.entries, username)
+		}
+		tracker.mu.Unlock()
+
+		// the database keeps the exact last_seen once nobody tracks it
+		if gone && !entry.invisible && entry.saved.Before(entry.lastActive) {
+			if err := store.SetLastSeen(username, entry.lastActive); err != nil {
+				log.Printf("Unable to save last seen of %s: %s", username, err.Error())
+			}
+		}
+	}
+}
+
+// run sweeps every presenceSweepInterval, it never returns.
+func (tracker *presenceTracker) run(store Store) {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		tracker.sweep(store)
+	}
+}
+
+/*
+	presenceRows - the presence of usernames as viewer may see it
+	 store Store
+	 viewer string
+	 usernames []string
+
+	 returns ([]map[string]string, error)
+	 Rows have username, status, last_seen and status_text, unknown users
+	 and users who blocked viewer are left out. The viewer's own row also
+	 has invisible.
+*/
+func (tracker *presenceTracker) presenceRows(store Store, viewer string, usernames []string) ([]map[string]string, error) {
+	rows, err := store.GetPresence(usernames)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]map[string]string, 0, len(rows))
+
+	for _, row := range rows {
+		username := row["username"]
+
+		if username != viewer {
+			blockedBy, err := store.IsBlocked(username, viewer)
+			if err != nil {
+				return nil, err
+			}
+			if blockedBy {
+				continue
+			}
+		}
+
+		invisible := row["invisible"] == "1"
+		row["status"] = presenceOffline
+
+		tracker.mu.Lock()
+		if entry, exists := tracker.entries[username]; exists {
+			row["status"] = entry.status
+			if !invisible {
+				row["last_seen"] = strconv.FormatInt(entry.lastActive.Unix(), 10)
+			}
+		}
+		tracker.mu.Unlock()
+
+		if username != viewer {
+			if invisible {
+				row["status"] = presenceOffline
+			}
+			delete(row, "invisible")
+		}
+
+		visible = append(visible, row)
+	}
+
+	return visible, nil
+}
+
+// presenceEvent is username's presence as their contacts see it.
+func presenceEvent(row map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"event":       "presence",
+		"username":    row["username"],
+		"status":      row["status"],
+		"last_seen":   row["last_seen"],
+		"status_text": row["status_text"],
+	}
+}
+
+/*
+	publish_presence - push username's presence to themselves and their contacts
+	 store Store
+	 username string
+	 contacts bool (false to only tell username's own connections)
+*/
+func publish_presence(store Store, username string, contacts bool) {
+	rows, err := presence.presenceRows(store, username, []string{username})
+	if err != nil || len(rows) == 0 {
+		if err != nil {
+			log.Printf("Unable to load presence of %s: %s", username, err.Error())
+		}
+		return
+	}
+
+	own := rows[0]
+	eventHub.publish(username, presenceEvent(own))
+
+	if !contacts {
+		return
+	}
+
+	// contacts never see through invisible
+	if own["invisible"] == "1" {
+		own["status"] = presenceOffline
+	}
+
+	list, err := store.GetContacts(username)
+	if err != nil {
+		log.Printf("Unable to load contacts of %s: %s", username, err.Error())
+		return
+	}
+
+	event := presenceEvent(own)
+	for _, contact := range list {
+		eventHub.publish(contact["username"], event)
+	}
+}
+
+// getNameListParam reads a list of usernames given as an array or a comma
+// separated string, a missing or empty list is nil.
+func getNameListParam(postData map[string]interface{}, key string) ([]string, error) {
+	var items []string
+
+	switch value := postData[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		items = strings.Split(value, ",")
+	case []interface{}:
+		for _, item := range value {
+			name, isString := item.(string)
+			if !isString {
+				return nil, errInvalidParameter.withDetail(key + " must be a list of usernames")
+			}
+			items = append(items, name)
+		}
+	default:
+		return nil, errInvalidParameter.withDetail(key + " must be a list of usernames")
+	}
+
+	seen := make(map[string]bool)
+	usernames := make([]string, 0, len(items))
+	for _, item := range items {
+		name := strings.TrimSpace(item)
+		if len(name) > 0 && !seen[name] {
+			seen[name] = true
+			usernames = append(usernames, name)
+		}
+	}
+
+	return usernames, nil
+}
+
+/* request handlers */
+
+/*
+	getpresence - presence of a list of users
+	 users  usernames, an array or comma separated
+
+	 reply: presence [{username, status, last_seen, status_text}] by
+	 username, unknown users are left out
+*/
+func handleGetPresenceRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	usernames := params.(presenceParams).Users
+	if len(usernames) > maxPresenceUsers {
+		return errorReply(errInvalidParameter.withDetail("at most " + strconv.Itoa(maxPresenceUsers) + " users"))
+	}
+
+	rows, err := presence.presenceRows(store, username, usernames)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["presence"] = rows
+	return replyMap
+}
+
+/*
+	setpresence - change the caller's status text or invisibility, absent ones keep their value
+	 status_text  up to maxStatusTextLength characters, "" to clear
+	 invisible    appear offline to everyone
+
+	 reply: the caller's presence as getpresence, plus invisible ("0" or "1")
+*/
+func handleSetPresenceRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(setPresenceParams)
+
+	rows, err := store.GetPresence([]string{username})
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if len(rows) == 0 {
+		return errorReply(errUserNotFound)
+	}
+
+	status_text := rows[0]["status_text"]
+	wasInvisible := rows[0]["invisible"] == "1"
+
+	if p.StatusText != nil {
+		if len([]rune(*p.StatusText)) > maxStatusTextLength {
+			return errorReply(errInvalidParameter.withDetail("status_text must be a string of at most " + strconv.Itoa(maxStatusTextLength) + " characters"))
+		}
+		status_text = strings.TrimSpace(*p.StatusText)
+	}
+
+	invisible := wasInvisible
+	if p.Invisible != nil {
+		invisible = *p.Invisible
+	}
+
+	// last_seen freezes at the moment the user disappears
+	if invisible && !wasInvisible {
+		if err = store.SetLastSeen(username, time.Now()); err != nil {
+			return errorReply(err)
+		}
+	}
+
+	if err = store.SetPresenceSettings(username, status_text, invisible); err != nil {
+		return errorReply(err)
+	}
+
+	presence.mu.Lock()
+	if entry, exists := presence.entries[username]; exists {
+		entry.invisible = invisible
+	}
+	presence.mu.Unlock()
+
+	publish_presence(store, username, true)
+
+	own, err := presence.presenceRows(store, username, []string{username})
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	for key, value := range own[0] {
+		replyMap[key] = value
+	}
+	return replyMap
+}
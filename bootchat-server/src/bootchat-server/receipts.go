@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+	Read receipts
+
+	One-to-one messages carry delivered_at and read_at (unix seconds, absent
+	until set). A message is delivered once its recipient fetched it
+	(getallmsgs, getmsgs) or it was queued on one of their websockets, and
+	read once the recipient sends markread for the conversation. Both are
+	recorded "up to" a message id per conversation and the sender is told:
+
+	 {"event":"receipt","status":"delivered"|"read","peer":"<recipient>","up_to_id":..,"at":..}
+
+	The reader's own connections get {"event":"conversation_read","peer":..,"up_to_id":..}
+	so every device can clear its badge.
+
+	Room messages have no receipts, each member only has a read marker
+	(room_members.last_read_id) that markread with a room_id moves forward
+	and that getconversations counts unread messages from.
+*/
+
+/*
+	mark_delivered - record delivery of peer's messages to username up to upto_id
+	 store Store
+	 username string (the recipient)
+	 peer string (the sender, who gets the receipt)
+	 upto_id int64
+	 at time.Time
+*/
+func mark_delivered(store Store, username string, peer string, upto_id int64, at time.Time) {
+	count, last, err := store.MarkDelivered(username, peer, upto_id, at)
+	if err != nil {
+		log.Printf("Unable to record delivery to %s: %s", username, err.Error())
+		return
+	}
+
+	if count > 0 {
+		eventHub.publish(peer, receiptEvent("delivered", username, last, at))
+	}
+}
+
+// acknowledge_delivery marks the fetched messages addressed to username as
+// delivered, listOfRows is updated in place.
+func acknowledge_delivery(store Store, username string, listOfRows []map[string]string) {
+	upto := make(map[string]int64)
+
+	for _, row := range listOfRows {
+		if isUndeliveredTo(row, username) {
+			id, _ := strconv.ParseInt(row["id"], 10, 64)
+			if id > upto[row["from_user"]] {
+				upto[row["from_user"]] = id
+			}
+		}
+	}
+
+	if len(upto) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for peer, id := range upto {
+		mark_delivered(store, username, peer, id, now)
+	}
+
+	stamp := strconv.FormatInt(now.Unix(), 10)
+	for _, row := range listOfRows {
+		if isUndeliveredTo(row, username) {
+			row["delivered_at"] = stamp
+		}
+	}
+}
+
+func isUndeliveredTo(row map[string]string, username string) bool {
+	return row["to_user"] == username && len(row["room_id"]) == 0 && len(row["delivered_at"]) == 0
+}
+
+/*
+	markread - mark a conversation read
+	 peer or room_id  the conversation
+	 up_to_id         the newest message read (optional, default everything)
+
+	 reply: marked (messages newly read), up_to_id (the newest of them, or
+	 the room's read marker)
+*/
+func handleMarkReadRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(markReadParams)
+
+	peer, room_id, upto_id := p.Peer, p.RoomId, p.UpToId
+
+	if (len(peer) > 0) == (room_id > 0) {
+		return errorReply(errMissingParameter.withDetail("exactly one of peer and room_id"))
+	}
+
+	if room_id > 0 {
+		return markRoomRead(store, username, room_id, upto_id)
+	}
+
+	now := time.Now()
+
+	count, last, err := store.MarkRead(username, peer, upto_id, now)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if count > 0 {
+		eventHub.publish(peer, receiptEvent("read", username, last, now))
+		eventHub.publish(username, conversationReadEvent(peer, last))
+	}
+
+	if verbose {
+		log.Printf("Marked %d message(s) from %s read for %s\n", count, peer, username)
+	}
+
+	replyMap["success"] = true
+	replyMap["marked"] = count
+	replyMap["up_to_id"] = last
+	return replyMap
+}
+
+// markRoomRead is the room half of handleMarkReadRequest.
+func markRoomRead(store Store, username string, room_id int64, upto_id int64) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	if err := requireRoomRole(store, room_id, username, false); err != nil {
+		return errorReply(err)
+	}
+
+	count, marker, err := store.MarkRoomRead(room_id, username, upto_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if count > 0 {
+		eventHub.publish(username, roomReadEvent(room_id, marker))
+	}
+
+	replyMap["success"] = true
+	replyMap["marked"] = count
+	replyMap["up_to_id"] = marker
+	return replyMap
+}
+
+/*
+	getunread - unread one-to-one messages per peer
+	 reply: conversations [{peer, unread, last_id}] most recent first, total
+*/
+func handleGetUnreadRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	counts, err := store.GetUnreadCounts(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	var total int64
+	for _, count := range counts {
+		unread, _ := strconv.ParseInt(count["unread"], 10, 64)
+		total += unread
+	}
+
+	replyMap["success"] = true
+	replyMap["conversations"] = counts
+	replyMap["total"] = total
+	return replyMap
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"log"
+)
+
+/*
+	Rooms - named group conversations
+
+	A room has members with a role of "owner" or "member". Owners can add,
+	kick and promote members, anyone can join a public room by id, private
+	rooms are joined only by being added. Room messages live in the messages
+	table with room_id set and an empty to_user, one-to-one messages keep
+	room_id NULL.
+*/
+
+const roomRoleOwner = "owner"
+const roomRoleMember = "member"
+const maxRoomNameLength = 64
+
+// get_room_member_names returns just the usernames of a room's members.
+func get_room_member_names(store Store, room_id int64) ([]string, error) {
+	members, err := store.GetRoomMembers(room_id)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member["username"])
+	}
+
+	return names, nil
+}
+
+/*
+	check_room_member - may username add member to a room
+	 store Store
+	 username string
+	 member string
+
+	 returns (drop bool, error)
+	 Whoever may not message member one-to-one may not pull them into a
+	 room either. drop is set as by check_blocked, the member is left out
+	 without telling username.
+*/
+func check_room_member(store Store, username string, member string) (bool, error) {
+	if err := lookup_user(store, username, member); err != nil {
+		return false, err
+	}
+
+	drop, err := check_blocked(store, username, member)
+	if err != nil || drop {
+		return drop, err
+	}
+
+	return false, check_contacts_only(store, username, member)
+}
+
+/* request handlers */
+
+// publishRoomEvent sends event to every current member of a room.
+func publishRoomEvent(store Store, room_id int64, event map[string]interface{}) {
+	members, err := get_room_member_names(store, room_id)
+	if err != nil {
+		log.Printf("Unable to load members of room %d: %s", room_id, err.Error())
+		return
+	}
+
+	for _, member := range members {
+		eventHub.publish(member, event)
+	}
+}
+
+func roomMemberEvent(room_id int64, username string, action string) map[string]interface{} {
+	return map[string]interface{}{"event": "room_member", "room_id": room_id, "username": username, "action": action}
+}
+
+// requireRoomRole loads the caller's role and checks they are at least a member (or owner).
+// A private room does not exist for those who are not in it.
+func requireRoomRole(store Store, room_id int64, username string, ownerOnly bool) error {
+	room, err := store.GetRoom(room_id)
+	if err != nil {
+		return err
+	}
+
+	role, err := store.GetRoomRole(room_id, username)
+	if err != nil {
+		return err
+	}
+
+	if len(role) == 0 {
+		if room["public"] != "1" {
+			return errRoomNotFound
+		}
+		return errNotRoomMember
+	}
+
+	if ownerOnly && role != roomRoleOwner {
+		return errNotRoomOwner
+	}
+
+	return nil
+}
+
+func handleCreateRoomRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(createRoomParams)
+
+	name := p.Name
+	if len(name) < 1 || len(name) > maxRoomNameLength {
+		return errorReply(errInvalidRoomName)
+	}
+
+	public := true
+	if p.Public != nil {
+		public = *p.Public
+	}
+
+	members := make([]string, 0, len(p.Members))
+	for _, member := range p.Members {
+		if member == username {
+			continue
+		}
+		drop, err := check_room_member(store, username, member)
+		if err != nil {
+			return errorReply(err)
+		}
+		if !drop {
+			members = append(members, member)
+		}
+	}
+
+	room_id, err := store.CreateRoom(name, username, public, members)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	publishRoomEvent(store, room_id, roomMemberEvent(room_id, username, "created"))
+
+	replyMap["success"] = true
+	replyMap["room_id"] = room_id
+	return replyMap
+}
+
+func handleListRoomsRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	rooms, err := store.GetUserRooms(username)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["rooms"] = rooms
+	return replyMap
+}
+
+func handleGetRoomRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	room_id := params.(roomIdParams).RoomId
+
+	if err := requireRoomRole(store, room_id, username, false); err != nil {
+		return errorReply(err)
+	}
+
+	room, err := store.GetRoom(room_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	members, err := store.GetRoomMembers(room_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	replyMap["room"] = room
+	replyMap["members"] = members
+	return replyMap
+}
+
+func handleJoinRoomRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	room_id := params.(roomIdParams).RoomId
+
+	room, err := store.GetRoom(room_id)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if room["public"] != "1" {
+		// do not reveal private rooms to non members
+		return errorReply(errRoomNotFound)
+	}
+
+	added, err := store.AddRoomMember(room_id, username, roomRoleMember)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if added {
+		publishRoomEvent(store, room_id, roomMemberEvent(room_id, username, "joined"))
+	}
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleAddRoomMemberRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(roomMemberParams)
+
+	room_id, member := p.RoomId, p.Member
+
+	// only the owner learns whether member exists
+	if err := requireRoomRole(store, room_id, username, true); err != nil {
+		return errorReply(err)
+	}
+
+	drop, err := check_room_member(store, username, member)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	// a dropped member looks added
+	if drop {
+		replyMap["success"] = true
+		return replyMap
+	}
+
+	added, err := store.AddRoomMember(room_id, member, roomRoleMember)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if added {
+		publishRoomEvent(store, room_id, roomMemberEvent(room_id, member, "added"))
+	}
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleLeaveRoomRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	room_id := params.(roomIdParams).RoomId
+
+	if err := requireRoomRole(store, room_id, username, false); err != nil {
+		return errorReply(err)
+	}
+
+	if err := store.RemoveRoomMember(room_id, username); err != nil {
+		return errorReply(err)
+	}
+
+	// the last member leaving deletes the room and its messages
+	purge_attachments(store)
+
+	event := roomMemberEvent(room_id, username, "left")
+	eventHub.publish(username, event)
+	publishRoomEvent(store, room_id, event)
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleKickRoomMemberRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(roomMemberParams)
+
+	room_id, member := p.RoomId, p.Member
+
+	if err := requireRoomRole(store, room_id, username, true); err != nil {
+		return errorReply(err)
+	}
+
+	if member == username {
+		return errorReply(errKickSelf)
+	}
+
+	role, err := store.GetRoomRole(room_id, member)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if len(role) == 0 {
+		return errorReply(errRoomMemberNotFound)
+	}
+
+	if role == roomRoleOwner {
+		return errorReply(errKickOwner)
+	}
+
+	if err = store.RemoveRoomMember(room_id, member); err != nil {
+		return errorReply(err)
+	}
+
+	event := roomMemberEvent(room_id, member, "kicked")
+	eventHub.publish(member, event)
+	publishRoomEvent(store, room_id, event)
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleSetRoomRoleRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(roomRoleParams)
+
+	room_id, member, role := p.RoomId, p.Member, p.Role
+
+	if role != roomRoleOwner && role != roomRoleMember {
+		return errorReply(errInvalidRoomRole)
+	}
+
+	if err := requireRoomRole(store, room_id, username, true); err != nil {
+		return errorReply(err)
+	}
+
+	current, err := store.GetRoomRole(room_id, member)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if len(current) == 0 {
+		return errorReply(errRoomMemberNotFound)
+	}
+
+	if member == username && role == roomRoleMember {
+		return errorReply(errDemoteSelf)
+	}
+
+	if err = store.SetRoomRole(room_id, member, role); err != nil {
+		return errorReply(err)
+	}
+
+	publishRoomEvent(store, room_id, roomMemberEvent(room_id, member, role))
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleGetRoomMessagesRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(roomMessagesParams)
+
+	room_id := p.RoomId
+
+	if err := requireRoomRole(store, room_id, username, false); err != nil {
+		return errorReply(err)
+	}
+
+	page, err := getPageParams(p.pageFields)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	listOfRows, hasMore, err := store.GetRoomMessages(room_id, username, page.since_id, page.before_id, page.limit)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	attachments, err := add_attachment_info(store, listOfRows)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replyMap["success"] = true
+	page.fillReply(replyMap, listOfRows, hasMore)
+	replyMap["attachments"] = attachments
+	return replyMap
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	Request registry
+
+	Every request the server understands is registered once, under its
+	legacy "request" name, and is reachable through two front doors:
+
+	 POST /    the original dispatcher, {"request":"send","token":..,...}
+	 /v1/...   resource routes with real methods and status codes (apiRoutes)
+
+	Handlers registered with auth are only called after authenticate_request
+	has resolved the caller, they get the username and never look at
+	credentials themselves. Every handler gets its parameters decoded into
+	the struct it is registered with (see validation.go), never the raw
+	request. Both doors set "remote_addr", the client address
+	failed logins are counted for (see lockout.go), over anything the client
+	sent under that name.
+*/
+
+// params is a filled struct of the type of requestHandler.params, or nil
+type requestFunc func(store Store, username string, params interface{}) map[string]interface{}
+
+type requestHandler struct {
+	handle requestFunc
+	auth   bool
+	params interface{} // a struct of the parameters, see params.go
+}
+
+var requestHandlers = map[string]requestHandler{
+	"login":            {handle: handleLoginRequest, params: loginParams{}},
+	"logout":           {handle: handleLogoutRequest, params: logoutParams{}},
+	"logoutall":        {handle: handleLogoutAllRequest, auth: true},
+	"regusr":           {handle: handleCreateUserRequest, params: createUserParams{}},
+	"register":         {handle: handleRegisterNewUserRequest, params: registerParams{}},
+	"forgotpass":       {handle: handleForgotPasswordRequest, params: forgotPasswordParams{}},
+	"getmyrow":         {handle: handleGetUserRowRequest, auth: true},
+	"getinboxstatus":   {handle: handleGetInboxStatusRequest, auth: true},
+	"setnewmsg":        {handle: handleSetNewMessageRequest, auth: true, params: newMessageFlagParams{}},
+	"send":             {handle: handleSendMessageRequest, auth: true, params: sendParams{}},
+	"getallmsgs":       {handle: handleGetMessagesRequest, auth: true},
+	"getmsgs":          {handle: handleGetMessagesPageRequest, auth: true, params: messagesPageParams{}},
+	"deleteconv":       {handle: handleDeleteConvoRequest, auth: true, params: deleteConvoParams{}},
+	"restoreconv":      {handle: handleRestoreConvoRequest, auth: true, params: peerParams{}},
+	"editmsg":          {handle: handleEditMessageRequest, auth: true, params: editMessageParams{}},
+	"deletemsg":        {handle: handleDeleteMessageRequest, auth: true, params: deleteMessageParams{}},
+	"getrevisions":     {handle: handleGetRevisionsRequest, auth: true, params: messageIdParams{}},
+	"markread":         {handle: handleMarkReadRequest, auth: true, params: markReadParams{}},
+	"getunread":        {handle: handleGetUnreadRequest, auth: true},
+	"getconversations": {handle: handleGetConversationsRequest, auth: true, params: conversationsParams{}},
+	"setconversation":  {handle: handleSetConversationRequest, auth: true, params: setConversationParams{}},
+	"createroom":       {handle: handleCreateRoomRequest, auth: true, params: createRoomParams{}},
+	"listrooms":        {handle: handleListRoomsRequest, auth: true},
+	"getroom":          {handle: handleGetRoomRequest, auth: true, params: roomIdParams{}},
+	"joinroom":         {handle: handleJoinRoomRequest, auth: true, params: roomIdParams{}},
+	"addmember":        {handle: handleAddRoomMemberRequest, auth: true, params: roomMemberParams{}},
+	"leaveroom":        {handle: handleLeaveRoomRequest, auth: true, params: roomIdParams{}},
+	"kickmember":       {handle: handleKickRoomMemberRequest, auth: true, params: roomMemberParams{}},
+	"setroomrole":      {handle: handleSetRoomRoleRequest, auth: true, params: roomRoleParams{}},
+	"getroommsgs":      {handle: handleGetRoomMessagesRequest, auth: true, params: roomMessagesParams{}},
+	"startupload":      {handle: handleStartUploadRequest, auth: true, params: startUploadParams{}},
+	"getupload":        {handle: handleGetUploadRequest, auth: true, params: uploadIdParams{}},
+	"finishupload":     {handle: handleFinishUploadRequest, auth: true, params: uploadIdParams{}},
+	"cancelupload":     {handle: handleCancelUploadRequest, auth: true, params: uploadIdParams{}},
+	"getattachment":    {handle: handleGetAttachmentRequest, auth: true, params: attachmentIdParams{}},
+	"search":           {handle: handleSearchRequest, auth: true, params: searchParams{}},
+	"friendrequest":    {handle: handleFriendRequestRequest, auth: true, params: contactParams{}},
+	"acceptfriend":     {handle: handleAcceptFriendRequest, auth: true, params: contactParams{}},
+	"declinefriend":    {handle: handleDeclineFriendRequest, auth: true, params: contactParams{}},
+	"cancelfriend":     {handle: handleCancelFriendRequest, auth: true, params: contactParams{}},
+	"getfriendreqs":    {handle: handleGetFriendRequestsRequest, auth: true},
+	"getcontacts":      {handle: handleGetContactsRequest, auth: true},
+	"removecontact":    {handle: handleRemoveContactRequest, auth: true, params: contactParams{}},
+	"getprivacy":       {handle: handleGetPrivacyRequest, auth: true},
+	"setprivacy":       {handle: handleSetPrivacyRequest, auth: true, params: privacyParams{}},
+	"block":            {handle: handleBlockRequest, auth: true, params: blockParams{}},
+	"unblock":          {handle: handleUnblockRequest, auth: true, params: unblockParams{}},
+	"listblocked":      {handle: handleListBlockedRequest, auth: true},
+	"getpresence":      {handle: handleGetPresenceRequest, auth: true, params: presenceParams{}},
+	"setpresence":      {handle: handleSetPresenceRequest, auth: true, params: setPresenceParams{}},
+	"typing":           {handle: handleTypingRequest, auth: true, params: typingParams{}},
+}
+
+/*
+run_request - authenticate and run a registered request
+
+	store Store
+	name string (the legacy request name)
+	postData map[string]interface{}
+
+	returns (reply map, HTTP status)
+	The status is 200 on success, otherwise the one the error catalog
+	lists for the reply's code.
+*/
+func run_request(store Store, name string, postData map[string]interface{}) (replyMap map[string]interface{}, status int) {
+	defer recoverRequest(name, &replyMap, &status)
+
+	handler, exists := requestHandlers[name]
+	if !exists {
+		return errorReply(errUnknownRequest), errUnknownRequest.status
+	}
+
+	var username string
+
+	if handler.auth {
+		u, err := authenticate_request(store, postData)
+		if err != nil {
+			replyMap = errorReply(err)
+			return replyMap, replyStatus(replyMap)
+		}
+		username = u
+
+		presence.touch(store, username)
+	}
+
+	params, err := decode_request(name, handler, postData)
+	if err != nil {
+		replyMap = errorReply(err)
+		return replyMap, replyStatus(replyMap)
+	}
+
+	replyMap = handler.handle(store, username, params)
+	return replyMap, replyStatus(replyMap)
+}
+
+/*
+	REST routes
+
+	Patterns use the Go 1.22 ServeMux syntax. Path wildcards, the query
+	string and a JSON body are merged into the parameters of the registered
+	request (wildcards win), so a route is only a new way of calling the
+	same handler. Authenticated routes take the session token from the
+	"Authorization: Bearer" header only.
+
+	 POST   /v1/sessions                              login
+	 DELETE /v1/sessions/current                      logout
+	 DELETE /v1/sessions                              logoutall
+	 POST   /v1/users                                 register
+	 POST   /v1/users/{username}/password-reset       forgotpass
+	 GET    /v1/me                                    getmyrow
+	 GET    /v1/me/inbox                              getinboxstatus
+	 PUT    /v1/me/inbox                              setnewmsg
+	 GET    /v1/me/unread                             getunread
+	 GET    /v1/me/privacy                            getprivacy
+	 PATCH  /v1/me/privacy                            setprivacy
+	 PATCH  /v1/me/presence                           setpresence
+	 GET    /v1/presence                              getpresence
+	 GET    /v1/messages                              getmsgs
+	 POST   /v1/messages                              send
+	 PATCH  /v1/messages/{message_id}                 editmsg
+	 DELETE /v1/messages/{message_id}                 deletemsg (?scope=everyone)
+	 GET    /v1/messages/{message_id}/revisions       getrevisions
+	 GET    /v1/conversations                         getconversations
+	 GET    /v1/conversations/{peer}/messages         getmsgs
+	 DELETE /v1/conversations/{peer}                  deleteconv
+	 POST   /v1/conversations/{peer}/restore          restoreconv
+	 POST   /v1/conversations/{peer}/read             markread
+	 POST   /v1/conversations/{peer}/typing           typing
+	 PATCH  /v1/conversations/{peer}/settings         setconversation
+	 GET    /v1/rooms                                 listrooms
+	 POST   /v1/rooms                                 createroom
+	 GET    /v1/rooms/{room_id}                       getroom
+	 POST   /v1/rooms/{room_id}/join                  joinroom
+	 POST   /v1/rooms/{room_id}/members               addmember
+	 DELETE /v1/rooms/{room_id}/members/me            leaveroom
+	 DELETE /v1/rooms/{room_id}/members/{member}      kickmember
+	 PUT    /v1/rooms/{room_id}/members/{member}/role setroomrole
+	 GET    /v1/rooms/{room_id}/messages              getroommsgs
+	 POST   /v1/rooms/{room_id}/read                  markread
+	 POST   /v1/rooms/{room_id}/typing                typing
+	 PATCH  /v1/rooms/{room_id}/settings              setconversation
+	 POST   /v1/rooms/{room_id}/messages              send
+	 POST   /v1/uploads                               startupload
+	 GET    /v1/uploads/{upload_id}                   getupload
+	 POST   /v1/uploads/{upload_id}/complete          finishupload
+	 DELETE /v1/uploads/{upload_id}                   cancelupload
+	 GET    /v1/attachments/{attachment_id}           getattachment
+	 GET    /v1/search                                search
+	 GET    /v1/contacts                              getcontacts
+	 DELETE /v1/contacts/{contact}                    removecontact
+	 GET    /v1/friend-requests                       getfriendreqs
+	 POST   /v1/friend-requests                       friendrequest
+	 POST   /v1/friend-requests/{contact}/accept      acceptfriend
+	 POST   /v1/friend-requests/{contact}/decline     declinefriend
+	 DELETE /v1/friend-requests/{contact}             cancelfriend
+	 GET    /v1/blocks                                listblocked
+	 POST   /v1/blocks                                block
+	 DELETE /v1/blocks/{user}                         unblock
+
+	File routes (apiFileRoutes) stream their bodies instead of exchanging
+	JSON parameters, they are only reachable here and always need a session:
+
+	 POST   /v1/attachments                           multipart upload
+	 PUT    /v1/uploads/{upload_id}                   one chunk of a chunked upload
+	 GET    /v1/attachments/{attachment_id}/content   download, Range requests allowed
+*/
+
+type apiRoute struct {
+	pattern string
+	request string
+	created bool              // reply 201 instead of 200
+	rename  map[string]string // wildcard -> parameter, when the names differ
+}
+
+var apiRoutes = []apiRoute{
+	{pattern: "POST /v1/sessions", request: "login", created: true},
+	{pattern: "DELETE /v1/sessions/current", request: "logout"},
+	{pattern: "DELETE /v1/sessions", request: "logoutall"},
+	{pattern: "POST /v1/users", request: "register", created: true},
+	{pattern: "POST /v1/users/{username}/password-reset", request: "forgotpass"},
+	{pattern: "GET /v1/me", request: "getmyrow"},
+	{pattern: "GET /v1/me/inbox", request: "getinboxstatus"},
+	{pattern: "PUT /v1/me/inbox", request: "setnewmsg"},
+	{pattern: "GET /v1/me/unread", request: "getunread"},
+	{pattern: "GET /v1/me/privacy", request: "getprivacy"},
+	{pattern: "PATCH /v1/me/privacy", request: "setprivacy"},
+	{pattern: "PATCH /v1/me/presence", request: "setpresence"},
+	{pattern: "GET /v1/presence", request: "getpresence"},
+	{pattern: "GET /v1/messages", request: "getmsgs"},
+	{pattern: "POST /v1/messages", request: "send", created: true},
+	{pattern: "PATCH /v1/messages/{message_id}", request: "editmsg"},
+	{pattern: "DELETE /v1/messages/{message_id}", request: "deletemsg"},
+	{pattern: "GET /v1/messages/{message_id}/revisions", request: "getrevisions"},
+	{pattern: "GET /v1/conversations", request: "getconversations"},
+	{pattern: "GET /v1/conversations/{peer}/messages", request: "getmsgs"},
+	{pattern: "DELETE /v1/conversations/{peer}", request: "deleteconv", rename: map[string]string{"peer": "remove_user"}},
+	{pattern: "POST /v1/conversations/{peer}/restore", request: "restoreconv"},
+	{pattern: "POST /v1/conversations/{peer}/read", request: "markread"},
+	{pattern: "POST /v1/conversations/{peer}/typing", request: "typing"},
+	{pattern: "PATCH /v1/conversations/{peer}/settings", request: "setconversation"},
+	{pattern: "GET /v1/rooms", request: "listrooms"},
+	{pattern: "POST /v1/rooms", request: "createroom", created: true},
+	{pattern: "GET /v1/rooms/{room_id}", request: "getroom"},
+	{pattern: "POST /v1/rooms/{room_id}/join", request: "joinroom"},
+	{pattern: "POST /v1/rooms/{room_id}/members", request: "addmember", created: true},
+	{pattern: "DELETE /v1/rooms/{room_id}/members/me", request: "leaveroom"},
+	{pattern: "DELETE /v1/rooms/{room_id}/members/{member}", request: "kickmember"},
+	{pattern: "PUT /v1/rooms/{room_id}/members/{member}/role", request: "setroomrole"},
+	{pattern: "GET /v1/rooms/{room_id}/messages", request: "getroommsgs"},
+	{pattern: "POST /v1/rooms/{room_id}/read", request: "markread"},
+	{pattern: "POST /v1/rooms/{room_id}/typing", request: "typing"},
+	{pattern: "PATCH /v1/rooms/{room_id}/settings", request: "setconversation"},
+	{pattern: "POST /v1/rooms/{room_id}/messages", request: "send", created: true},
+	{pattern: "POST /v1/uploads", request: "startupload", created: true},
+	{pattern: "GET /v1/uploads/{upload_id}", request: "getupload"},
+	{pattern: "POST /v1/uploads/{upload_id}/complete", request: "finishupload", created: true},
+	{pattern: "DELETE /v1/uploads/{upload_id}", request: "cancelupload"},
+	{pattern: "GET /v1/attachments/{attachment_id}", request: "getattachment"},
+	{pattern: "GET /v1/search", request: "search"},
+	{pattern: "GET /v1/contacts", request: "getcontacts"},
+	{pattern: "DELETE /v1/contacts/{contact}", request: "removecontact"},
+	{pattern: "GET /v1/friend-requests", request: "getfriendreqs"},
+	{pattern: "POST /v1/friend-requests", request: "friendrequest", created: true},
+	{pattern: "POST /v1/friend-requests/{contact}/accept", request: "acceptfriend"},
+	{pattern: "POST /v1/friend-requests/{contact}/decline", request: "declinefriend"},
+	{pattern: "DELETE /v1/friend-requests/{contact}", request: "cancelfriend"},
+	{pattern: "GET /v1/blocks", request: "listblocked"},
+	{pattern: "POST /v1/blocks", request: "block", created: true},
+	{pattern: "DELETE /v1/blocks/{user}", request: "unblock"},
+}
+
+type apiFileRoute struct {
+	pattern string
+	handle  func(store Store, username string, response http.ResponseWriter, request *http.Request)
+}
+
+var apiFileRoutes = []apiFileRoute{
+	{pattern: "POST /v1/attachments", handle: handleUploadAttachments},
+	{pattern: "PUT /v1/uploads/{upload_id}", handle: handleUploadChunk},
+	{pattern: "GET /v1/attachments/{attachment_id}/content", handle: handleDownloadAttachment},
+}
+
+// apiHandler returns the handler serving apiRoutes.
+func (sqlobject *SqlObject) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	for _, route := range apiRoutes {
+		if _, exists := requestHandlers[route.request]; !exists {
+			log.Fatalf("route %s uses unknown request %s", route.pattern, route.request)
+		}
+		mux.HandleFunc(route.pattern, sqlobject.handleApiRoute(route))
+	}
+
+	for _, route := range apiFileRoutes {
+		mux.HandleFunc(route.pattern, sqlobject.handleApiFileRoute(route))
+	}
+
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if _, pattern := mux.Handler(request); len(pattern) == 0 {
+			// let the mux pick 404 or 405 (and set Allow), but answer from the catalog
+			response = &apiFallbackWriter{ResponseWriter: response}
+		}
+		mux.ServeHTTP(response, request)
+	})
+}
+
+// apiFallbackWriter replaces the mux's plain text 404 and 405 pages with catalog errors.
+type apiFallbackWriter struct {
+	http.ResponseWriter
+}
+
+func (writer *apiFallbackWriter) WriteHeader(status int) {
+	var err *apiError = errRouteNotFound
+	if status == http.StatusMethodNotAllowed {
+		err = errMethodNotAllowed
+	}
+
+	writer.Header().Del("X-Content-Type-Options")
+	writeJsonReply(writer.ResponseWriter, err.status, errorReply(err))
+}
+
+func (writer *apiFallbackWriter) Write(body []byte) (int, error) {
+	return len(body), nil
+}
+
+// patternWildcards lists the {name} segments of a ServeMux pattern.
+func patternWildcards(pattern string) []string {
+	names := make([]string, 0)
+
+	for _, segment := range strings.Split(pattern, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, strings.TrimSuffix(segment[1:len(segment)-1], "..."))
+		}
+	}
+
+	return names
+}
+
+func (sqlobject *SqlObject) handleApiRoute(route apiRoute) http.HandlerFunc {
+	wildcards := patternWildcards(route.pattern)
+
+	return func(response http.ResponseWriter, request *http.Request) {
+		postData := make(map[string]interface{})
+
+		requestBytes, err := readRequestBody(response, request)
+		if err != nil {
+			writeJsonReply(response, replyStatus(errorReply(err)), errorReply(err))
+			return
+		}
+
+		if len(requestBytes) > 0 {
+			if err := json.Unmarshal(requestBytes, &postData); err != nil || postData == nil {
+				writeJsonReply(response, errMalformedRequest.status, errorReply(errMalformedRequest))
+				return
+			}
+		}
+
+		for key, values := range request.URL.Query() {
+			postData[key] = values[0]
+		}
+
+		for _, name := range wildcards {
+			param := name
+			if renamed, exists := route.rename[name]; exists {
+				param = renamed
+			}
+			postData[param] = request.PathValue(name)
+		}
+
+		postData["token"] = bearerToken(request)
+		postData["remote_addr"] = clientAddress(request)
+
+		replyMap, status := run_request(sqlobject.store, route.request, postData)
+		if status == http.StatusOK && route.created {
+			status = http.StatusCreated
+		}
+
+		if status == http.StatusUnauthorized {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+		}
+
+		if retryAfter, exists := replyMap["retry_after"].(int64); exists {
+			response.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		}
+
+		writeJsonReply(response, status, replyMap)
+	}
+}
+
+func (sqlobject *SqlObject) handleApiFileRoute(route apiFileRoute) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		token := bearerToken(request)
+		if len(token) == 0 {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			writeJsonReply(response, errMissingCredentials.status, errorReply(errMissingCredentials))
+			return
+		}
+
+		username, err := lookup_session(sqlobject.store, token)
+		if err != nil {
+			replyMap := errorReply(err)
+			status := replyStatus(replyMap)
+			if status == http.StatusUnauthorized {
+				response.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJsonReply(response, status, replyMap)
+			return
+		}
+
+		presence.touch(sqlobject.store, username)
+		extendTransferDeadlines(response)
+		route.handle(sqlobject.store, username, response, request)
+	}
+}
+
+func writeJsonReply(response http.ResponseWriter, status int, replyMap map[string]interface{}) {
+	jsonString, err := interfaceMapToJsonString(replyMap)
+	if err != nil {
+		log.Printf("Unable to encode reply: %s", err.Error())
+		status = http.StatusInternalServerError
+		jsonString = getErrorJson(errInternal)
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	fmt.Fprint(response, jsonString)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+	Message search
+
+	search finds messages in the conversations the caller takes part in:
+	their one-to-one messages and the rooms they are a member of. A query
+	is a list of terms that must all match, each one
+
+	 word      the word, in any case
+	 word*     any word starting with "word"
+	 "a b c"   the words next to each other in this order ("a b"* works too)
+
+	Anything but letters and digits separates words. Results come newest
+	first with a snippet of the body, matches wrapped in searchMarkStart and
+	searchMarkEnd.
+
+	SQLite answers from the FTS5 table messages_fts (migration 0007, needs
+	the sqlite_fts5 build tag), PostgreSQL from a GIN index over
+	to_tsvector('simple', body) and the memory store by scanning.
+*/
+
+const searchMarkStart = "<mark>"
+const searchMarkEnd = "</mark>"
+
+// searchSnippetWords is about how many words of context a snippet keeps.
+const searchSnippetWords = 16
+
+const maxSearchTerms = 16
+
+// searchTerm is one word or phrase, prefix applies to its last word.
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+type searchQuery struct {
+	terms   []searchTerm
+	peer    string // only the conversation with peer
+	room_id int64  // only this room
+	since   int64  // unix seconds, inclusive, 0 for no bound
+	until   int64  // unix seconds, exclusive, 0 for no bound
+}
+
+// searchWords splits text into lower case words the way the indexes do.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+/*
+	parse_search_query - split a search string into terms
+	 q string
+
+	 returns ([]searchTerm, error)
+*/
+func parse_search_query(q string) ([]searchTerm, error) {
+	terms := make([]searchTerm, 0)
+
+	for len(q) > 0 {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if len(q) == 0 {
+			break
+		}
+
+		var text string
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				// an unterminated phrase runs to the end
+				text, q = q[1:], ""
+			} else {
+				text, q = q[1:end+1], q[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(q, unicode.IsSpace)
+			if end < 0 {
+				end = len(q)
+			}
+			text, q = q[:end], q[end:]
+		}
+
+		prefix := false
+		if strings.HasPrefix(q, "*") {
+			prefix, q = true, q[1:]
+		} else if strings.HasSuffix(text, "*") {
+			prefix = true
+		}
+
+		if words := searchWords(text); len(words) > 0 {
+			terms = append(terms, searchTerm{words: words, prefix: prefix})
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, errMissingParameter.withDetail("q")
+	}
+
+	if len(terms) > maxSearchTerms {
+		return nil, errInvalidParameter.withDetail("at most " + strconv.Itoa(maxSearchTerms) + " search terms")
+	}
+
+	return terms, nil
+}
+
+// ftsMatch renders terms as an FTS5 MATCH expression, words never need quoting.
+func ftsMatch(terms []searchTerm) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = `"` + strings.Join(term.words, " ") + `"`
+		if term.prefix {
+			parts[i] += "*"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// tsQuery renders terms for PostgreSQL's to_tsquery.
+func tsQuery(terms []searchTerm) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		words := make([]string, len(term.words))
+		for j, word := range term.words {
+			words[j] = "'" + word + "'"
+		}
+		if term.prefix {
+			words[len(words)-1] += ":*"
+		}
+		parts[i] = "(" + strings.Join(words, " <-> ") + ")"
+	}
+	return strings.Join(parts, " & ")
+}
+
+type searchWordSpan struct {
+	start, end int // byte offsets into the body
+	word       string
+}
+
+func searchWordSpans(body string) []searchWordSpan {
+	spans := make([]searchWordSpan, 0)
+	start := -1
+
+	for i, r := range body + " " {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			spans = append(spans, searchWordSpan{start: start, end: i, word: strings.ToLower(body[start:i])})
+			start = -1
+		}
+	}
+
+	return spans
+}
+
+// matchAt reports whether term matches the words starting at spans[i].
+func (term searchTerm) matchAt(spans []searchWordSpan, i int) bool {
+	if i+len(term.words) > len(spans) {
+		return false
+	}
+
+	last := len(term.words) - 1
+	for j, word := range term.words {
+		if j == last && term.prefix {
+			if !strings.HasPrefix(spans[i+j].word, word) {
+				return false
+			}
+		} else if spans[i+j].word != word {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+	search_snippet - match a body against terms, the memory store's search
+	 body string
+	 terms []searchTerm
+
+	 returns (snippet string, matched bool)
+	 Like FTS5's snippet() the snippet is a window of about
+	 searchSnippetWords words around the first match, "…" marking cuts.
+*/
+func search_snippet(body string, terms []searchTerm) (string, bool) {
+	spans := searchWordSpans(body)
+	marked := make([]bool, len(spans))
+	first := -1
+
+	for _, term := range terms {
+		found := false
+		for i := range spans {
+			if term.matchAt(spans, i) {
+				found = true
+				for j := range term.words {
+					marked[i+j] = true
+				}
+				if first < 0 || i < first {
+					first = i
+				}
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+
+	from := first - searchSnippetWords/4
+	if from < 0 {
+		from = 0
+	}
+	to := from + searchSnippetWords
+	if to > len(spans) {
+		to = len(spans)
+	}
+
+	var builder strings.Builder
+
+	begin := 0
+	if from > 0 {
+		builder.WriteString("…")
+		begin = spans[from].start
+	}
+
+	end := len(body)
+	if to < len(spans) {
+		end = spans[to-1].end
+	}
+
+	position := begin
+	for i := from; i < to; i++ {
+		if !marked[i] {
+			continue
+		}
+		builder.WriteString(body[position:spans[i].start])
+		builder.WriteString(searchMarkStart)
+		builder.WriteString(body[spans[i].start:spans[i].end])
+		builder.WriteString(searchMarkEnd)
+		position = spans[i].end
+	}
+	builder.WriteString(body[position:end])
+
+	if end < len(body) {
+		builder.WriteString("…")
+	}
+
+	return builder.String(), true
+}
+
+/*
+	getSearchTimeParam - read an optional date bound
+	 postData map[string]interface{}
+	 key string
+	 endOfDay bool (a bare date means the end rather than the start of that day)
+
+	 returns (unix seconds or 0, error)
+	 Dates are unix seconds, 2006-01-02 (UTC) or RFC 3339.
+*/
+func getSearchTimeParam(postData map[string]interface{}, key string, endOfDay bool) (int64, error) {
+	value, isString := postData[key].(string)
+	if !isString {
+		return getIntParam(postData, key)
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil || len(value) == 0 {
+		return unix, nil
+	}
+
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day.Unix(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+
+	return 0, errInvalidParameter.withDetail(key + " must be unix seconds, YYYY-MM-DD or RFC 3339")
+}
+
+/*
+	search - full text search over the caller's messages
+	 q          the query, see above
+	 peer       optional, only the conversation with this user
+	 room_id    optional, only this room (must be a member)
+	 since      optional, messages sent at or after this date
+	 until      optional, messages sent before this date (a bare date includes that day)
+	 before_id  optional, continue with older results (next_cursor)
+	 limit      page size (default 50, max 200)
+
+	 reply: messages (newest first, each with a "snippet"), attachments,
+	 has_more, next_cursor
+*/
+func handleSearchRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(searchParams)
+
+	terms, err := parse_search_query(p.Q)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	query := &searchQuery{terms: terms, peer: p.Peer, room_id: p.RoomId, since: int64(p.Since), until: int64(p.Until)}
+
+	if len(query.peer) > 0 && query.room_id > 0 {
+		return errorReply(errInvalidParameter.withDetail("peer and room_id can not be combined"))
+	}
+
+	if query.room_id > 0 {
+		if err = requireRoomRole(store, query.room_id, username, false); err != nil {
+			return errorReply(err)
+		}
+	}
+
+	before_id, limit := p.BeforeId, p.Limit
+
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	listOfRows, hasMore, err := store.SearchMessages(username, query, before_id, int(limit))
+	if err != nil {
+		return errorReply(err)
+	}
+
+	attachments, err := add_attachment_info(store, listOfRows)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	nextCursor := before_id
+	if len(listOfRows) > 0 {
+		nextCursor, _ = strconv.ParseInt(listOfRows[len(listOfRows)-1]["id"], 10, 64)
+	}
+
+	replyMap["success"] = true
+	replyMap["messages"] = listOfRows
+	replyMap["attachments"] = attachments
+	replyMap["has_more"] = hasMore
+	replyMap["next_cursor"] = nextCursor
+	return replyMap
+}
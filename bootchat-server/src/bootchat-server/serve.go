@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	Serving and shutdown
+
+	The server runs with the timeouts and sizes of the [server] and
+	[limits] config tables. File routes get fileTransferTimeout instead of
+	the read and write timeouts, attachments can take a while.
+
+	SIGINT or SIGTERM stop it gracefully: no new connections are accepted,
+	requests in flight finish, websocket clients get a close frame, and the
+	store is closed last. Whatever is still running after
+	server.shutdown_timeout is cut off.
+
+	The process exits with
+
+	 exitOK        0  stopped by a signal, everything drained
+	 exitFailure   1  could not start or serve, or the store did not close
+	 exitUsage     2  bad arguments or config
+	 exitUnclean   3  stopped by a signal, the shutdown timed out
+*/
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitUnclean = 3
+)
+
+// the limits can be changed in the config, see config.go
+var maxRequestSize int64 = 1 << 20
+var fileTransferTimeout = 10 * time.Minute // an attachment upload or download
+
+// wsConnections counts websocket connections until their readPump is done.
+var wsConnections sync.WaitGroup
+
+/*
+	serve - run the server until it fails or a signal stops it
+	 config *serverConfig
+	 store Store (closed before returning)
+	 handler http.Handler
+
+	 returns (process exit code)
+*/
+func serve(config *serverConfig, store Store, handler http.Handler) int {
+	server := &http.Server{
+		Addr:              config.listen,
+		Handler:           handler,
+		ReadHeaderTimeout: config.readHeaderTimeout,
+		ReadTimeout:       config.readTimeout,
+		WriteTimeout:      config.writeTimeout,
+		IdleTimeout:       config.idleTimeout,
+		MaxHeaderBytes:    config.maxHeaderSize,
+	}
+
+	// Shutdown does not track hijacked connections, the hub closes those
+	server.RegisterOnShutdown(eventHub.closeAll)
+
+	if config.tlsEnabled {
+		reloader, err := newTLSReloader(config)
+		if err != nil {
+			log.Printf("Refusing to start: tls: %s (gen-cert creates a development certificate, or set tls.enabled = false)", err.Error())
+			store.Close()
+			return exitFailure
+		}
+		go reloader.watch()
+
+		server.TLSConfig = reloader.tlsConfig()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	failed := make(chan error, 1)
+	go func() {
+		if config.tlsEnabled {
+			log.Printf("Starting server on https://%s...", config.listen)
+			failed <- server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting server on http://%s...", config.listen)
+			failed <- server.ListenAndServe()
+		}
+	}()
+
+	code := exitOK
+	select {
+	case err := <-failed:
+		log.Printf("Server failed: %s", err.Error())
+		code = exitFailure
+
+	case received := <-stop:
+		log.Printf("Received %s, shutting down...", received)
+		code = shutdown(server, config.shutdownTimeout)
+	}
+
+	if err := store.Close(); err != nil {
+		log.Printf("Unable to close the store: %s", err.Error())
+		code = exitFailure
+	}
+
+	if code == exitOK {
+		log.Println("Shut down cleanly.")
+	}
+
+	return code
+}
+
+// shutdown drains server and the websockets within timeout.
+func shutdown(server *http.Server, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timed out with requests in flight: %s", err.Error())
+		server.Close()
+		return exitUnclean
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wsConnections.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return exitOK
+	case <-ctx.Done():
+		log.Println("Shutdown timed out with websocket connections open")
+		return exitUnclean
+	}
+}
+
+/*
+	readRequestBody - read a JSON request body of at most maxRequestSize
+	 response http.ResponseWriter
+	 request *http.Request
+
+	 returns (body []byte, error)
+	 errRequestTooLarge when the body is larger, errMalformedRequest when
+	 it could not be read.
+*/
+func readRequestBody(response http.ResponseWriter, request *http.Request) ([]byte, error) {
+	reader := http.MaxBytesReader(response, request.Body, maxRequestSize)
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errRequestTooLarge
+		}
+		return nil, errMalformedRequest
+	}
+
+	return body, nil
+}
+
+// extendTransferDeadlines gives a file route fileTransferTimeout from now.
+func extendTransferDeadlines(response http.ResponseWriter) {
+	controller := http.NewResponseController(response)
+	deadline := time.Now().Add(fileTransferTimeout)
+
+	controller.SetReadDeadline(deadline)
+	controller.SetWriteDeadline(deadline)
+}
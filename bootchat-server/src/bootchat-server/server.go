@@ -1,72 +1,111 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-	_ "sync/atomic"
-	_ "time"
+	"strings"
+	"time"
 )
 
 type SqlObject struct {
-	db *sql.DB
+	store Store
 }
 
 var verbose bool = false
 
 func printLogo() {
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 	fmt.Println(`,-----.                  ,--.   ,-----.,--.               ,--.`)
 	fmt.Println(`|  |) /_  ,---.  ,---. ,-'  '-.'  .--./|  ,---.  ,--,--.,-'  '-.`)
 	fmt.Println(`|  .-.  \| .-. || .-. |'-.  .-'|  |    |  .-.  |' ,-.  |'-.  .-'`)
 	fmt.Println(`|  '--' /' '-' '' '-' '  |  |  '  '--'\|  | |  |\ '-'  |  |  |`)
 	fmt.Println(`'------'  '---'  '---'   '--'   '-----''--' '--' '--'--'  '--'`)
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 }
 
 func main() {
 	printLogo()
 
-	if len(os.Args) > 1 {
-		if os.Args[1] == "-v" {
-			verbose = true
-			fmt.Println("Verbose enabled.")
-		}
+	config, args, err := load_config(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		fmt.Printf("Refusing to start: %s\n", err.Error())
+		os.Exit(exitUsage)
+	}
+
+	if config.logLevel == "debug" {
+		verbose = true
+		fmt.Println("Verbose enabled.")
 	}
 
-	dbo, err := open_database(verbose)
+	rejectUnknownParams = config.unknownParams == "reject"
+
+	attachmentFiles = newAttachmentStorage(config.attachmentDir)
+
+	if len(args) > 0 && args[0] == "gen-cert" {
+		os.Exit(runGenCertCommand(config, args[1:]))
+	}
+
+	store, err := open_store(config.dbDriver, config.dbDsn)
 	if err != nil {
 		fmt.Println(err.Error())
-		os.Exit(1)
+		os.Exit(exitFailure)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			os.Exit(runMigrateCommand(store, args[1:]))
+		case "users":
+			os.Exit(runUsersCommand(store, args[1:]))
+		case "messages":
+			os.Exit(runMessagesCommand(store, args[1:]))
+		case "db":
+			os.Exit(runDbCommand(store, args[1:]))
+		}
+
+		fmt.Println("usage: bootchat-server [flags] [migrate|users|messages|db|gen-cert ...], -h lists the flags")
+		os.Exit(exitUsage)
 	}
 
-	//init_tables(dbo)
-	
+	// never serve on a dirty or partially migrated database
+	applied, err := store.MigrateUp(0)
+	if err != nil {
+		log.Printf("Refusing to start: %s", err.Error())
+		os.Exit(exitFailure)
+	}
 
-	sqlHttpHandler := &SqlObject{db: dbo}
-	http.HandleFunc("/", sqlHttpHandler.handleConnection)
+	if applied > 0 {
+		log.Printf("Applied %d migration(s).", applied)
+	}
 
-	log.Printf("Starting server on port %s...", "8443")
-	//err = http.ListenAndServeTLS("127.0.0.1:8443", "./etc/server.crt", "./etc/server.key", nil)
-	err = http.ListenAndServe("127.0.0.1:8443", nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	if err = attachmentFiles.prepare(); err != nil {
+		log.Printf("Refusing to start: %s", err.Error())
+		os.Exit(exitFailure)
 	}
-}
 
-func getErrorJson(exception string) string {
-	jsonMap := make(map[string]string)
+	go presence.run(store)
+	go run_conversation_purge(store)
+
+	sqlHttpHandler := &SqlObject{store: store}
 
-	jsonMap["success"] = "false"
-	jsonMap["exception"] = exception
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", sqlHttpHandler.handleConnection)
+	mux.HandleFunc("/ws", sqlHttpHandler.handleWebsocket)
+	mux.Handle("/v1/", sqlHttpHandler.apiHandler())
+
+	os.Exit(serve(config, store, recoverPanics(mux)))
+}
 
-	jsonBytes, _ := json.Marshal(jsonMap)
+func getErrorJson(err error) string {
+	jsonBytes, _ := json.Marshal(errorReply(err))
 	return string(jsonBytes)
 }
 
@@ -91,111 +130,191 @@ func (sqlobject *SqlObject) handleConnection(response http.ResponseWriter, reque
 
 	response.Header().Set("Content-Type", "text/json")
 
-	const errParseStr = "error - can not parse request body."
-	const errUnserializeStr = "error - can not unserialize the request."
-
 	//var requestStr string
 	var requestBytes []byte
 	var postData map[string]interface{}
 
-	requestBytes, err := ioutil.ReadAll(request.Body)
+	requestBytes, err := readRequestBody(response, request)
 	if err != nil {
-		log.Println(errParseStr)
-		fmt.Fprintf(response, getErrorJson(errParseStr))
+		log.Printf("Unable to read request body: %s", err.Error())
+		fmt.Fprint(response, getErrorJson(err))
 		return
 	}
 
 	//requestStr = string(requestBytes)
 
-	if err := json.Unmarshal(requestBytes, &postData); err != nil {
-		log.Println(errUnserializeStr)
-		fmt.Fprintf(response, getErrorJson(errUnserializeStr))
+	if err := json.Unmarshal(requestBytes, &postData); err != nil || postData == nil {
+		if verbose {
+			log.Println("Unable to unserialize request body")
+		}
+		fmt.Fprint(response, getErrorJson(errMalformedRequest))
 		return
 	}
 
-	if request, exists := postData["request"]; exists {
+	if _, exists := postData["token"]; !exists {
+		if token := bearerToken(request); len(token) > 0 {
+			postData["token"] = token
+		}
+	}
 
-		if request == "login" {
-			jsonString, _ := mapToJsonString(handleLoginRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
+	postData["remote_addr"] = clientAddress(request)
 
-			if u, exists := postData["username"]; exists {
-				set_new_message_flag(sqlobject.db, u.(string), 1)
-			}
+	name, _ := postData["request"].(string)
+	if len(name) == 0 {
+		fmt.Fprint(response, getErrorJson(errMissingRequest))
+		return
+	}
 
-			return
-		}
+	// the legacy front door always answers 200, failures are in the body
+	replyMap, _ := run_request(sqlobject.store, name, postData)
 
-		if request == "regusr" {
-			jsonString, _ := mapToJsonString(handleCreateUserRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
-		}
+	jsonString, _ := interfaceMapToJsonString(replyMap)
+	fmt.Fprint(response, jsonString)
+}
 
-		if request == "send" {
-			jsonString, _ := mapToJsonString(handleSendMessageRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
-		}
+// bearerToken returns the token from an "Authorization: Bearer <token>" header.
+func bearerToken(request *http.Request) string {
+	const prefix = "Bearer "
 
-		if request == "getmyrow" {
-			jsonString, _ := mapToJsonString(handleGetUserRowRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
-		}
+	header := request.Header.Get("Authorization")
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
 
-		if request == "getinboxstatus" {
-			jsonString, _ := mapToJsonString(handleGetInboxStatusRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
-		}
+	return ""
+}
 
-		if request == "getallmsgs" {
-			jsonString, _ := interfaceMapToJsonString(handleGetMessagesRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
-		}
+/*
+	getIntParam - read an optional integer parameter
+	 postData map[string]interface{}
+	 key string
 
-		if request == "setnewmsg" {
-			jsonString, _ := mapToJsonString(handleSetNewMessageRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
-		}
+	 returns (value int64, error)
+	 JSON numbers and numeric strings are accepted, a missing key is 0.
+*/
+func getIntParam(postData map[string]interface{}, key string) (int64, error) {
+	v, exists := postData[key]
+	if !exists || v == nil {
+		return 0, nil
+	}
 
-		if request == "register" {
-			jsonString, _ := mapToJsonString(handleRegisterNewUserRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
+	switch value := v.(type) {
+	case float64:
+		if value != float64(int64(value)) {
+			return 0, errInvalidParameter.withDetail("must be an integer: " + key)
+		}
+		return int64(value), nil
+	case string:
+		if len(value) == 0 {
+			return 0, nil
 		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, errInvalidParameter.withDetail("must be an integer: " + key)
+		}
+		return n, nil
+	}
+
+	return 0, errInvalidParameter.withDetail("must be an integer: " + key)
+}
 
-		if request == "forgotpass" {
-			jsonString, _ := mapToJsonString(handleForgotPasswordRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
+/*
+	getBoolParam - read an optional boolean parameter
+	 postData map[string]interface{}
+	 key string
+
+	 returns (value bool, present bool, error)
+	 JSON booleans and the strings "1"/"0"/"true"/"false" are accepted.
+*/
+func getBoolParam(postData map[string]interface{}, key string) (bool, bool, error) {
+	v, exists := postData[key]
+	if !exists || v == nil {
+		return false, false, nil
+	}
+
+	switch value := v.(type) {
+	case bool:
+		return value, true, nil
+	case float64:
+		if value == 0 || value == 1 {
+			return value == 1, true, nil
 		}
+	case string:
+		switch value {
+		case "1", "true":
+			return true, true, nil
+		case "0", "false":
+			return false, true, nil
+		}
+	}
 
-		if request == "deleteconv" {
-			jsonString, _ := mapToJsonString(handleDeleteConvoRequest(sqlobject.db, postData))
-			fmt.Fprintf(response, jsonString)
-			return
+	return false, false, errInvalidParameter.withDetail("must be a boolean: " + key)
+}
+
+/*
+	getIdListParam - read an optional list of ids
+	 postData map[string]interface{}
+	 key string
+
+	 returns (ids []int64, error)
+	 A JSON array of numbers or numeric strings, or a comma separated
+	 string. Duplicates are dropped, ids must be positive.
+*/
+func getIdListParam(postData map[string]interface{}, key string) ([]int64, error) {
+	var items []interface{}
+
+	switch value := postData[key].(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		items = value
+	case string:
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
 		}
+	default:
+		return nil, errInvalidParameter.withDetail("must be a list of ids: " + key)
+	}
 
-		fmt.Fprintf(response, getErrorJson("unimplemented request"))
-		return
+	ids := make([]int64, 0, len(items))
+	seen := make(map[int64]bool)
+
+	for _, item := range items {
+		id, err := getIntParam(map[string]interface{}{key: item}, key)
+		if err != nil || id < 1 {
+			return nil, errInvalidParameter.withDetail("must be a list of ids: " + key)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
 	}
 
-	fmt.Fprintf(response, getErrorJson("missing request"))
+	return ids, nil
 }
 
-/* ADD REQUESET HANDLERS HERE */
-/* ALL HANDLERS MUST RETURN A MAP CONTAINING: { 'success' : Boolean, 'exception' : String (if any) } */
+/*
+	authenticate_request - resolve the user making a request
+	 store Store
+	 postData map[string]interface{}
 
-func handleLoginRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
+	 returns (username string, error)
 
-	var username string = ""
-	var password string = ""
+	 The session token ("token", or the Authorization header copied into it by
+	 handleConnection) is preferred. Requests without a token fall back to the
+	 legacy username/password pair so older clients keep working, throttled
+	 like a login by the "remote_addr" the front door set.
+*/
+func authenticate_request(store Store, postData map[string]interface{}) (string, error) {
+	if t, exists := postData["token"]; exists {
+		token, _ := t.(string)
+		return lookup_session(store, token)
+	}
+
+	var username string
+	var password string
 
 	if u, exists := postData["username"]; exists {
 		username, _ = u.(string)
@@ -206,386 +325,507 @@ func handleLoginRequest(db *sql.DB, postData map[string]interface{}) map[string]
 	}
 
 	if !(len(username) > 0 && len(password) > 0) {
-		replyMap["exception"] = "unable to get username and/or password from request"
-		return replyMap
+		return "", errMissingCredentials
 	}
 
-	if success, _ := verify_user_login(db, username, password); success {
-		userRow, err := get_user_row(db, username)
-		if err == nil {
-			replyMap["success"] = "true"
-			replyMap["id"] = userRow["id"]
-			replyMap["nickname"] = userRow["nickname"]
-			replyMap["gender"] = userRow["gender"]
-			replyMap["new_message"] = userRow["new_message"]
+	remote, _ := postData["remote_addr"].(string)
 
-			return replyMap
-		} else {
-			replyMap["exception"] = err.Error()
-			return replyMap
-		}
+	success, err := verify_user_login(store, username, password, remote)
+	if err != nil {
+		return "", err
 	}
 
-	replyMap["exception"] = "unable to login"
-	return replyMap
+	if !success {
+		return "", errInvalidCredentials
+	}
+
+	return username, nil
 }
 
-func handleCreateUserRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
+/* ADD REQUESET HANDLERS HERE, AND REGISTER THEM IN requestHandlers (routes.go) */
+/* ALL HANDLERS MUST RETURN A MAP CONTAINING: { 'success' : Boolean } OR THE errorReply OF A CATALOG ERROR (errors.go) */
 
-	var username string
-	var question string
-	var answer string
-	var password string
+func handleLoginRequest(store Store, _ string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(loginParams)
 
-	if u, exists := postData["username"]; exists {
-		username, _ = u.(string)
-	} else {
-		replyMap["exception"] = "missing parameter: username"
-		return replyMap
-	}
+	username := p.Username
 
-	if q, exists := postData["question"]; exists {
-		question, _ = q.(string)
-	} else {
-		replyMap["exception"] = "missing parameter: security question"
-		return replyMap
+	// any other error still reads as invalid credentials
+	success, err := verify_user_login(store, username, p.Password, p.RemoteAddr)
+	if err == errAccountDisabled || isLoginThrottled(err) {
+		return errorReply(err)
 	}
 
-	if a, exists := postData["answer"]; exists {
-		answer, _ = a.(string)
-	} else {
-		replyMap["exception"] = "missing parameter: security answer"
-		return replyMap
-	}
+	if success {
+		userRow, err := store.GetUserRow(username)
+		if err != nil {
+			return errorReply(err)
+		}
+
+		purge_expired_sessions(store)
+		purge_login_failures(store)
+
+		token, expires, err := create_session(store, username)
+		if err != nil {
+			return errorReply(err)
+		}
+
+		// a fresh login always shows the inbox as having news
+		store.SetNewMessageFlag(username, 1)
+
+		replyMap["success"] = true
+		replyMap["id"] = userRow["id"]
+		replyMap["nickname"] = userRow["nickname"]
+		replyMap["gender"] = userRow["gender"]
+		replyMap["new_message"] = userRow["new_message"]
+		replyMap["token"] = token
+		replyMap["expires"] = expires.UTC().Format(time.RFC3339)
 
-	if p, exists := postData["password"]; exists {
-		password, _ = p.(string)
-	} else {
-		replyMap["exception"] = "missing parameter: password"
 		return replyMap
 	}
 
-	//db *sql.DB, username string, question string, answer string, password string
-	err := add_user(db, username, question, answer, password)
+	return errorReply(errInvalidCredentials)
+}
+
+func handleLogoutRequest(store Store, _ string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(logoutParams)
+
+	err := delete_session(store, p.Token)
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
-	replyMap["success"] = "true"
+	replyMap["success"] = true
 	return replyMap
 }
 
-func handleSetNewMessageRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
+func handleLogoutAllRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
 
-	verifyLoginCredentials := handleLoginRequest(db, postData)
-	if verifyLoginCredentials["success"] != "true" {
-		replyMap["exception"] = "invalid login"
-		return replyMap
+	revoked, err := delete_user_sessions(store, username)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	var username string = postData["username"].(string)
-	var svalue string = postData["value"].(string)
+	replyMap["success"] = true
+	replyMap["revoked"] = revoked
+	return replyMap
+}
 
-	value := 1
+func handleCreateUserRequest(store Store, _ string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(createUserParams)
 
-	if svalue != "1" {
-		value = 0
+	err := add_user(store, p.Username, "", p.Question, p.Answer, p.Password)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	//value,err := strconv.Atoi(postData["value"].(string))
-	//if err != nil{
-	//	value = 1
-	//}
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleSetNewMessageRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(newMessageFlagParams)
+
+	// "1" or "0" from the legacy client, any boolean from the REST route
+	value := 0
+	if p.Value {
+		value = 1
+	}
 
-	err := set_new_message_flag(db, username, value)
+	err := store.SetNewMessageFlag(username, value)
 
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
+	eventHub.publish(username, newMessageFlagEvent(value))
+
 	if verbose {
 		log.Printf("Updating new message flag for %s\n", username)
 	}
 
-	replyMap["success"] = "true"
+	replyMap["success"] = true
 	return replyMap
 }
 
-func handleDeleteConvoRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
+func handleDeleteConvoRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	remove_user := params.(deleteConvoParams).RemoveUser
 
-	verifyLoginCredentials := handleLoginRequest(db, postData)
-	if verifyLoginCredentials["success"] != "true" {
-		replyMap["exception"] = "invalid login"
-		return replyMap
+	upto_id, err := delete_convo(store, remove_user, username)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	var username string = postData["username"].(string)
-
-	var remove_user string
+	// only the caller's side is gone, see conversations.go
+	eventHub.publish(username, convoDeletedEvent(remove_user, upto_id))
 
-	if r, exists := postData["remove_user"]; exists {
-		remove_user, _ = r.(string)
-	} else {
-		replyMap["exception"] = "missing parameter"
-		return replyMap
+	err = store.SetNewMessageFlag(username, 1)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	err := delete_convo(db, remove_user, username)
+	replyMap["success"] = true
+	replyMap["up_to_id"] = upto_id
+	replyMap["undo_until"] = time.Now().Add(conversationUndoWindow).Unix()
+	return replyMap
+}
+
+/*
+	restoreconv - undo a deleteconv within conversationUndoWindow
+	 peer  the other side of the conversation
+*/
+func handleRestoreConvoRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	peer := params.(peerParams).Peer
+
+	restored, err := store.RestoreConversation(username, peer, time.Now().Add(-conversationUndoWindow))
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
-	err = set_new_message_flag(db, username, 1)
-	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+	if !restored {
+		return errorReply(errNothingToRestore)
 	}
 
-	replyMap["success"] = "true"
+	eventHub.publish(username, convoRestoredEvent(peer))
+
+	replyMap["success"] = true
 	return replyMap
 }
 
-func handleGetInboxStatusRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
-
-	verifyLoginCredentials := handleLoginRequest(db, postData)
-	if verifyLoginCredentials["success"] != "true" {
-		replyMap["exception"] = "invalid login"
-		return replyMap
-	}
+func handleGetInboxStatusRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
 
-	var username string = postData["username"].(string)
-	newMsg, err := get_new_message_flag(db, username)
+	newMsg, err := store.GetNewMessageFlag(username)
 
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
 	if verbose {
 		log.Printf("Getting inbox status flag for %s\n", username)
 	}
 
-	replyMap["success"] = "true"
+	replyMap["success"] = true
 	replyMap["new"] = strconv.Itoa(newMsg)
 
-	set_new_message_flag(db, username, 0)
+	if newMsg != 0 && store.SetNewMessageFlag(username, 0) == nil {
+		eventHub.publish(username, newMessageFlagEvent(0))
+	}
 	return replyMap
 }
 
-func handleForgotPasswordRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
-
-	var username string
-	var question string
-	var answer string
-	var newpassword string
-	var missing bool = false
+func handleForgotPasswordRequest(store Store, _ string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(forgotPasswordParams)
 
-	if u, exists := postData["username"]; exists {
-		username, _ = u.(string)
-	} else {
-		missing = true
-	}
+	username := p.Username
 
-	if q, exists := postData["security_question"]; exists {
-		question, _ = q.(string)
-	} else {
-		missing = true
+	// the security answer is a password too, guesses are throttled like logins
+	attempt, err := begin_login_attempt(store, username, p.RemoteAddr)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	if a, exists := postData["security_answer"]; exists {
-		answer, _ = a.(string)
-	} else {
-		missing = true
-	}
+	controlRow, err := store.GetControlUserRow(username)
 
-	if p, exists := postData["newpassword"]; exists {
-		newpassword, _ = p.(string)
-	} else {
-		missing = true
+	if err != nil {
+		attempt.finish(store, false, err)
+		return errorReply(err)
 	}
 
-	if missing {
-		replyMap["exception"] = "missing parameter(s)"
-		return replyMap
+	if controlRow["security_answer"] != p.Answer || controlRow["security_question"] != p.Question {
+		attempt.finish(store, false, nil)
+		return errorReply(errSecurityAnswer)
 	}
 
-	controlRow, err := get_control_user_row(db, username)
+	attempt.finish(store, true, nil)
 
+	err = set_password(store, username, p.NewPassword)
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
-	if controlRow["security_answer"] != answer || controlRow["security_question"] != question {
-		replyMap["exception"] = "invalid question/answer"
-		return replyMap
+	// a password reset invalidates every existing session
+	delete_user_sessions(store, username)
+
+	replyMap["success"] = true
+	return replyMap
+}
+
+func handleRegisterNewUserRequest(store Store, _ string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(registerParams)
+
+	// the nickname defaults to the username
+	nickname := p.Nickname
+	if len(nickname) == 0 {
+		nickname = p.Username
 	}
 
-	err = set_password(db, username, newpassword)
+	err := add_user(store, p.Username, nickname, p.Question, p.Answer, p.Password)
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
-	replyMap["success"] = "true"
+	replyMap["success"] = true
 	return replyMap
 }
 
-func handleRegisterNewUserRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
-
-	var username string
-	var password string
-	var nickname string
-	var question string
-	var answer string
+func handleGetUserRowRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
 
-	if u, exists := postData["username"]; exists {
-		username, _ = u.(string)
-		nickname = username
+	userRow, err := store.GetUserRow(username)
+	if err == nil {
+		replyMap["success"] = true
+		replyMap["id"] = userRow["id"]
+		replyMap["nickname"] = userRow["nickname"]
+		replyMap["gender"] = userRow["gender"]
+		replyMap["new_message"] = userRow["new_message"]
+		return replyMap
 	}
 
-	if p, exists := postData["password"]; exists {
-		password = md5Sum(p.(string))
-	}
+	return errorReply(err)
+}
+
+func handleGetMessagesRequest(store Store, username string, _ interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
 
-	if n, exists := postData["nickname"]; exists {
-		nickname, _ = n.(string)
+	listOfRows, err := store.GetAllMessages(username)
+
+	if err != nil {
+		return errorReply(err)
 	}
 
-	if q, exists := postData["question"]; exists {
-		question, _ = q.(string)
+	acknowledge_delivery(store, username, listOfRows)
+
+	attachments, err := add_attachment_info(store, listOfRows)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	if a, exists := postData["answer"]; exists {
-		answer, _ = a.(string)
+	if verbose {
+		log.Printf("Getting inbox contents for %s\n", username)
 	}
 
-	//TODO check for valid strings or else error
+	replyMap["success"] = true
+	replyMap["messages"] = listOfRows
+	replyMap["attachments"] = attachments
+	return replyMap
+}
+
+func handleSendMessageRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(sendParams)
 
-	statement := "INSERT INTO accounts(username,nickname,password,security_question,security_answer) VALUES(?,?,?,?,?)"
-	stmt, err := db.Prepare(statement)
+	var to_user string = p.ToUser
+	var from_user string = username
+	var message_body string = p.Body
+	var room_id int64 = p.RoomId
+	var attachments []int64 = p.Attachments
 
-	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+	if len(attachments) > maxAttachmentsPerMessage {
+		return errorReply(errInvalidParameter.withDetail("at most " + strconv.Itoa(maxAttachmentsPerMessage) + " attachments"))
 	}
 
-	_, err = stmt.Exec(username, nickname, password, question, answer)
-	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+	if room_id > 0 {
+		return sendRoomMessage(store, room_id, from_user, message_body, attachments)
 	}
 
-	stmt.Close()
+	if !store.UserExists(to_user) {
+		return errorReply(errUserNotFound.withDetail(to_user))
+	}
 
-	replyMap["success"] = "true"
-	return replyMap
-}
+	drop, err := check_blocked(store, from_user, to_user)
+	if err != nil {
+		return errorReply(err)
+	}
 
-func handleGetUserRowRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
+	// a message may be nothing but attachments
+	if len(message_body) < 1 && len(attachments) == 0 {
+		return errorReply(errEmptyMessage)
+	}
 
-	verifyLoginCredentials := handleLoginRequest(db, postData)
-	if verifyLoginCredentials["success"] != "true" {
-		replyMap["exception"] = "invalid credentials: " + verifyLoginCredentials["exception"]
+	// a dropped message looks sent, only the id is missing
+	if drop {
+		replyMap["success"] = true
 		return replyMap
 	}
 
-	userRow, err := get_user_row(db, postData["username"].(string))
+	if err = check_contacts_only(store, from_user, to_user); err != nil {
+		return errorReply(err)
+	}
+
+	message, err := send_message(store, to_user, from_user, message_body, attachments)
 	if err == nil {
-		replyMap["success"] = "true"
-		replyMap["id"] = userRow["id"]
-		replyMap["nickname"] = userRow["nickname"]
-		replyMap["gender"] = userRow["gender"]
-		replyMap["new_message"] = userRow["new_message"]
+		typingIndicators.stop(store, typingKey{username: from_user, peer: to_user})
+
+		eventHub.publish(to_user, messageEvent(message))
+		eventHub.publish(to_user, newMessageFlagEvent(1))
+		if from_user != to_user {
+			eventHub.publish(from_user, messageEvent(message))
+		}
+
+		// a message queued on an open websocket counts as delivered
+		if eventHub.connectionCount(to_user) > 0 {
+			id, _ := strconv.ParseInt(message["id"], 10, 64)
+			mark_delivered(store, to_user, from_user, id, time.Now())
+		}
+
+		replyMap["success"] = true
+		replyMap["id"] = message["id"]
 		return replyMap
 	}
 
-	replyMap["exception"] = err.Error()
-	return replyMap
+	return errorReply(err)
 }
 
-func handleGetMessagesRequest(db *sql.DB, postData map[string]interface{}) map[string]interface{} {
+// sendRoomMessage is the room half of handleSendMessageRequest.
+func sendRoomMessage(store Store, room_id int64, from_user string, message_body string, attachments []int64) map[string]interface{} {
 	replyMap := make(map[string]interface{})
-	replyMap["success"] = false
 
-	verifyLoginCredentials := handleLoginRequest(db, postData)
-	if verifyLoginCredentials["success"] != "true" {
-		replyMap["exception"] = "invalid login"
-		return replyMap
+	if err := requireRoomRole(store, room_id, from_user, false); err != nil {
+		return errorReply(err)
 	}
 
-	var username string = postData["username"].(string)
-	listOfRows, err := get_all_messages(db, username)
+	if len(message_body) < 1 && len(attachments) == 0 {
+		return errorReply(errEmptyMessage)
+	}
 
+	message, err := store.SendRoomMessage(room_id, from_user, message_body, attachments)
 	if err != nil {
-		replyMap["exception"] = err.Error()
-		return replyMap
+		return errorReply(err)
 	}
 
-	if verbose {
-		log.Printf("Getting inbox contents for %s\n", username)
+	typingIndicators.stop(store, typingKey{username: from_user, room_id: room_id})
+
+	members, err := get_room_member_names(store, room_id)
+	if err == nil {
+		for _, member := range members {
+			eventHub.publish(member, messageEvent(message))
+			if member != from_user {
+				eventHub.publish(member, newMessageFlagEvent(1))
+			}
+		}
 	}
 
-	replyMap["success"] = "true"
-	replyMap["messages"] = listOfRows
+	replyMap["success"] = true
+	replyMap["id"] = message["id"]
 	return replyMap
 }
 
-func handleSendMessageRequest(db *sql.DB, postData map[string]interface{}) map[string]string {
-	replyMap := make(map[string]string)
-	replyMap["success"] = "false"
+const defaultPageSize = 50
+// maxPageSize can be changed in the config, see config.go
+var maxPageSize int64 = 200
 
-	verifyLoginCredentials := handleLoginRequest(db, postData)
-	if verifyLoginCredentials["success"] != "true" {
-		replyMap["exception"] = "invalid credentials: " + verifyLoginCredentials["exception"]
-		return replyMap
+type pageParams struct {
+	since_id  int64
+	before_id int64
+	limit     int
+}
+
+/*
+	getPageParams - check the since_id, before_id and limit parameters
+	 fields pageFields
+
+	 returns (pageParams, error)
+*/
+func getPageParams(fields pageFields) (pageParams, error) {
+	var page pageParams
+
+	since_id, before_id, limit := fields.SinceId, fields.BeforeId, fields.Limit
+
+	if since_id > 0 && before_id > 0 {
+		return page, errInvalidParameter.withDetail("since_id and before_id can not be combined")
+	}
+
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
 	}
 
-	var to_user string = ""
-	var from_user string = postData["username"].(string)
-	var message_body string = ""
+	page.since_id = since_id
+	page.before_id = before_id
+	page.limit = int(limit)
 
-	if t, exists := postData["to_user"]; exists {
-		to_user, _ = t.(string)
+	return page, nil
+}
+
+// fillReply adds messages, has_more, next_cursor and latest_id for a fetched page.
+func (page pageParams) fillReply(replyMap map[string]interface{}, listOfRows []map[string]string, hasMore bool) {
+	nextCursor := page.since_id
+	latestId := page.since_id
+
+	if len(listOfRows) > 0 {
+		first, _ := strconv.ParseInt(listOfRows[0]["id"], 10, 64)
+		last, _ := strconv.ParseInt(listOfRows[len(listOfRows)-1]["id"], 10, 64)
+
+		latestId = last
+		if page.since_id > 0 {
+			nextCursor = last
+		} else {
+			nextCursor = first
+		}
+	} else if page.since_id == 0 {
+		nextCursor = page.before_id
 	}
 
-	if m, exists := postData["body"]; exists {
-		message_body, _ = m.(string)
+	replyMap["messages"] = listOfRows
+	replyMap["has_more"] = hasMore
+	replyMap["next_cursor"] = nextCursor
+	replyMap["latest_id"] = latestId
+}
+
+/*
+	getmsgs - paged message history
+	 since_id  return messages newer than this id (incremental sync)
+	 before_id return messages older than this id (scroll back)
+	 limit     page size (default 50, max 200)
+	 peer      only the conversation with this user
+
+	 reply: messages (oldest first), has_more, next_cursor (pass back in the
+	 same field to continue in the same direction) and latest_id (pass as
+	 since_id to sync only what changed since this call). Messages with
+	 attachments list their ids in "attachments", the reply's own
+	 "attachments" describes them (see add_attachment_info).
+*/
+func handleGetMessagesPageRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+	p := params.(messagesPageParams)
+
+	page, err := getPageParams(p.pageFields)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	if !user_exists(db, to_user) {
-		replyMap["exception"] = "receipient does not exist"
-		return replyMap
+	peer := p.Peer
+
+	listOfRows, hasMore, err := store.GetMessages(username, peer, page.since_id, page.before_id, page.limit)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	if len(message_body) < 1 {
-		replyMap["exception"] = "can not send empty message"
-		return replyMap
+	acknowledge_delivery(store, username, listOfRows)
+
+	attachments, err := add_attachment_info(store, listOfRows)
+	if err != nil {
+		return errorReply(err)
 	}
 
-	err := send_message(db, to_user, from_user, message_body)
-	if err == nil {
-		replyMap["success"] = "true"
-		return replyMap
+	if verbose {
+		log.Printf("Getting message page for %s (since %d, before %d)\n", username, page.since_id, page.before_id)
 	}
 
-	replyMap["exception"] = err.Error()
+	replyMap["success"] = true
+	page.fillReply(replyMap, listOfRows, hasMore)
+	replyMap["attachments"] = attachments
 	return replyMap
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestServer is a legacy front door on a memory store with the users
+// alice and bob (password 123456).
+func newTestServer(t testing.TB) *SqlObject {
+	passwordHasher = newBcryptHasher(4)
+	attachmentFiles = newAttachmentStorage(t.TempDir())
+	if err := attachmentFiles.prepare(); err != nil {
+		t.Fatalf("prepare attachments: %s", err.Error())
+	}
+
+	// a fuzzed password must not lock the seeded users out
+	loginBackoff, loginMaxBackoff = 0, 0
+	loginLockoutFailures, loginIpLockoutFailures = 1<<30, 1<<30
+
+	store := newMemStore()
+	for _, username := range []string{"alice", "bob"} {
+		if err := add_user(store, username, username, "question", "answer", "123456"); err != nil {
+			t.Fatalf("add_user %s: %s", username, err.Error())
+		}
+	}
+
+	return &SqlObject{store: store}
+}
+
+// post sends body to the legacy front door and decodes the reply.
+func post(t testing.TB, server *SqlObject, body string) map[string]interface{} {
+	request := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	response := httptest.NewRecorder()
+
+	server.handleConnection(response, request)
+
+	var replyMap map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &replyMap); err != nil {
+		t.Fatalf("reply to %q is not JSON: %q", body, response.Body.String())
+	}
+
+	return replyMap
+}
+
+func FuzzHandleConnection(f *testing.F) {
+	server := newTestServer(f)
+
+	for _, seed := range []string{
+		`{}`,
+		`[]`,
+		`{"request":"nope"}`,
+		`{"request":"login","username":"alice","password":"123456"}`,
+		`{"request":"login","username":"alice","password":"wrong"}`,
+		`{"request":"register","username":"carol","password":"123456","nickname":"C"}`,
+		`{"request":"forgotpass","username":"bob","security_question":"question","security_answer":"answer","newpassword":"123456"}`,
+		`{"request":"send","username":"alice","password":"123456","to_user":"bob","body":"hi"}`,
+		`{"request":"send","username":"alice","password":"123456","room_id":"1","body":"hi","attachments":"1,2"}`,
+		`{"request":"getmsgs","username":"alice","password":"123456","peer":"bob","since_id":0,"limit":"5"}`,
+		`{"request":"editmsg","username":"alice","password":"123456","message_id":1,"body":"edited"}`,
+		`{"request":"deletemsg","username":"alice","password":"123456","message_id":1,"scope":"everyone"}`,
+		`{"request":"createroom","username":"alice","password":"123456","name":"r","public":false,"members":["bob"]}`,
+		`{"request":"setroomrole","username":"alice","password":"123456","room_id":1,"member":"bob","role":"owner"}`,
+		`{"request":"getconversations","username":"bob","password":"123456","archived":"1"}`,
+		`{"request":"setconversation","username":"bob","password":"123456","peer":"alice","muted":true}`,
+		`{"request":"search","username":"alice","password":"123456","q":"hi","since":"2020-01-01","until":"2030-01-01"}`,
+		`{"request":"startupload","username":"alice","password":"123456","filename":"a.txt","size":3}`,
+		`{"request":"getpresence","username":"alice","password":"123456","users":"bob, alice"}`,
+		`{"request":"setpresence","username":"alice","password":"123456","status_text":"away","invisible":true}`,
+		`{"request":"setprivacy","username":"bob","password":"123456","contacts_only":1}`,
+		`{"request":"block","username":"bob","password":"123456","user":"alice","hide_history":"true"}`,
+		`{"request":"typing","username":"alice","password":"123456","peer":"bob","state":"stopped"}`,
+		`{"request":"logout","token":""}`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, body string) {
+		replyMap := post(t, server, body)
+
+		if success, _ := replyMap["success"].(bool); success {
+			return
+		}
+
+		code, _ := replyMap["code"].(string)
+		if _, exists := errorCatalog[code]; !exists {
+			t.Fatalf("reply to %q has no catalog code: %v", body, replyMap)
+		}
+
+		// a panic is recovered as internal.error, the memory store has no other
+		if code == errInternal.code {
+			t.Fatalf("internal error for %q", body)
+		}
+	})
+}
+
+func TestHandleConnectionCodes(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		body string
+		code string
+	}{
+		{`not json`, errMalformedRequest.code},
+		{`{"username":"alice"}`, errMissingRequest.code},
+		{`{"request":"nope"}`, errUnknownRequest.code},
+		{`{"request":"login","username":"alice"}`, errMissingParameter.code},
+		{`{"request":"login","username":"alice","password":"123456","extra":1}`, errInvalidParameter.code},
+		{`{"request":"login","username":"alice","password":"wrong"}`, errInvalidCredentials.code},
+		{`{"request":"getmyrow"}`, errMissingCredentials.code},
+		{`{"request":"send","username":"alice","password":"123456","to_user":"bob"}`, errEmptyMessage.code},
+		{`{"request":"send","username":"alice","password":"123456","to_user":"bob","room_id":"x"}`, errInvalidParameter.code},
+		{`{"request":"createroom","username":"alice","password":"123456","name":""}`, errInvalidRoomName.code},
+		{`{"request":"register","username":"carol","password":"` + strings.Repeat("x", 73) + `"}`, errInvalidParameter.code},
+		{`{"request":"login","username":"alice","password":"` + strings.Repeat("x", 73) + `"}`, errInvalidCredentials.code},
+		{`{"request":"login","username":"nobody","password":"123456"}`, errInvalidCredentials.code},
+	}
+
+	for _, test := range tests {
+		replyMap := post(t, server, test.body)
+		if code, _ := replyMap["code"].(string); code != test.code {
+			t.Errorf("%s: got code %q, want %q (%v)", test.body, code, test.code, replyMap)
+		}
+	}
+
+	replyMap := post(t, server, `{"request":"login","username":"alice","password":"123456"}`)
+	if success, _ := replyMap["success"].(bool); !success {
+		t.Fatalf("login failed: %v", replyMap)
+	}
+
+	token, _ := replyMap["token"].(string)
+	replyMap = post(t, server, `{"request":"send","token":"`+token+`","to_user":"bob","body":"hi"}`)
+	if success, _ := replyMap["success"].(bool); !success {
+		t.Fatalf("send failed: %v", replyMap)
+	}
+}
+
+func TestRoomMemberPrivacy(t *testing.T) {
+	server := newTestServer(t)
+	alice := `"username":"alice","password":"123456"`
+	bob := `"username":"bob","password":"123456"`
+
+	replyMap := post(t, server, `{"request":"createroom",`+alice+`,"name":"r"}`)
+	room_id, _ := replyMap["room_id"].(float64)
+
+	tests := []struct {
+		setup string // sent by bob first
+		code  string
+	}{
+		{`{"request":"setprivacy",` + bob + `,"contacts_only":true}`, errContactsOnly.code},
+		{`{"request":"setprivacy",` + bob + `,"contacts_only":false}`, ""},
+		{`{"request":"block",` + bob + `,"user":"alice"}`, errUserNotFound.code},
+	}
+
+	for _, test := range tests {
+		post(t, server, test.setup)
+
+		for _, body := range []string{
+			`{"request":"createroom",` + alice + `,"name":"r","members":["bob"]}`,
+			`{"request":"addmember",` + alice + `,"room_id":` + strconv.FormatFloat(room_id, 'f', -1, 64) + `,"member":"bob"}`,
+		} {
+			replyMap = post(t, server, body)
+			if code, _ := replyMap["code"].(string); code != test.code {
+				t.Errorf("after %s: %s got code %q, want %q", test.setup, body, code, test.code)
+			}
+		}
+	}
+}
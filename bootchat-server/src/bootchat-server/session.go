@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+/*
+	Sessions
+
+	login issues an opaque random token which the client sends back with
+	every other request, either as the "token" field of the JSON body or as
+	an "Authorization: Bearer <token>" header. Only the sha256 of the token
+	is stored so a leaked database does not leak live sessions.
+*/
+
+// sessionLifetime can be changed in the config, see config.go
+var sessionLifetime = 7 * 24 * time.Hour
+
+// sessionTouchInterval limits how often last_seen is written for a busy session.
+const sessionTouchInterval = time.Minute
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func new_session_token() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+/*
+	create_session - store a new session for username
+	 store Store
+	 username string
+
+	 returns (token string, expires time.Time, error)
+*/
+func create_session(store Store, username string) (string, time.Time, error) {
+	token, err := new_session_token()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expires := now.Add(sessionLifetime)
+
+	err = store.CreateSession(hashSessionToken(token), username, now, expires)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if verbose {
+		log.Printf("Created session for %s\n", username)
+	}
+
+	return token, expires, nil
+}
+
+/*
+	lookup_session - resolve a session token to its username
+	 store Store
+	 token string
+
+	 returns (username string, error)
+	 error is errInvalidSession for unknown or expired tokens
+*/
+func lookup_session(store Store, token string) (string, error) {
+	if len(token) == 0 {
+		return "", errInvalidSession
+	}
+
+	tokenHash := hashSessionToken(token)
+
+	username, expires, lastSeen, err := store.GetSession(tokenHash)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	if !now.Before(expires) {
+		store.DeleteSession(tokenHash)
+		return "", errInvalidSession
+	}
+
+	if now.Sub(lastSeen) > sessionTouchInterval {
+		store.TouchSession(tokenHash, now)
+	}
+
+	return username, nil
+}
+
+/*
+	check_session - is a session still there
+	 store Store
+	 tokenHash string
+
+	 returns (error)
+	 errInvalidSession once it was revoked or expired, it is not touched.
+*/
+func check_session(store Store, tokenHash string) error {
+	_, expires, _, err := store.GetSession(tokenHash)
+	if err != nil {
+		return err
+	}
+
+	if !time.Now().Before(expires) {
+		return errInvalidSession
+	}
+
+	return nil
+}
+
+/*
+	delete_session - remove a single session and close its websockets
+	 store Store
+	 token string
+
+	 returns (error)
+*/
+func delete_session(store Store, token string) error {
+	tokenHash := hashSessionToken(token)
+
+	deleted, err := store.DeleteSession(tokenHash)
+	if err != nil {
+		return err
+	}
+
+	eventHub.disconnectSession(tokenHash)
+
+	if !deleted {
+		return errInvalidSession
+	}
+
+	return nil
+}
+
+/*
+	delete_user_sessions - revoke every session belonging to username and
+	close their websockets in this process, another one closes them at its
+	next ping
+	 store Store
+	 username string
+
+	 returns (number of sessions removed, error)
+*/
+func delete_user_sessions(store Store, username string) (int64, error) {
+	revoked, err := store.DeleteUserSessions(username)
+	if err != nil {
+		return 0, err
+	}
+
+	eventHub.disconnectUser(username)
+
+	if verbose {
+		log.Printf("Revoked all sessions for %s\n", username)
+	}
+
+	return revoked, nil
+}
+
+/*
+	purge_expired_sessions - remove sessions past their expiry
+	 store Store
+
+	 returns (error)
+*/
+func purge_expired_sessions(store Store) error {
+	return store.PurgeExpiredSessions(time.Now())
+}
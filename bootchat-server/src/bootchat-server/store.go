@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+	Store - everything the server persists
+
+	Handlers talk to a Store rather than to database/sql so the backend can
+	be swapped:
+
+	 sqlite3  the default, a file such as ./etc/bootchat.db
+	 postgres a PostgreSQL DSN, e.g. postgres://bootchat@localhost/bootchat?sslmode=disable
+	 memory   an in-process store that forgets everything on exit, for tests and demos
+
+	Rows are returned as map[string]string keyed by the JSON names the
+	handlers reply with, lists of rows are never nil.
+*/
+
+type Store interface {
+	/* accounts */
+
+	// CreateAccount stores a new account, nickname may be empty. The
+	// username of a deleted account is errUserExists, see DeleteUser.
+	CreateAccount(username string, nickname string, question string, answer string, passwordHash string) error
+	UserExists(username string) bool
+	// GetPasswordHash returns "" and no error for an unknown user.
+	GetPasswordHash(username string) (string, error)
+	SetPasswordHash(username string, encoded string) error
+	// GetControlUserRow returns id, security_question and security_answer.
+	GetControlUserRow(username string) (map[string]string, error)
+	// GetUserRow returns id, nickname, gender and new_message.
+	GetUserRow(username string) (map[string]string, error)
+	// DeleteUser removes the account with its contacts, friend requests,
+	// blocks, hidden and deleted conversation marks, failed logins and
+	// conversation settings, and leaves its rooms like RemoveRoomMember.
+	// Its messages stay under the username, which is kept from being
+	// registered again so they never reach another account.
+	DeleteUser(username string) error
+	// ListAccounts returns id, username, nickname, password and disabled for every account.
+	ListAccounts() ([]map[string]string, error)
+	// SetAccountDisabled returns errUserNotFound for an unknown user.
+	SetAccountDisabled(username string, disabled bool) error
+	AccountDisabled(username string) (bool, error)
+
+	/* new message flag */
+
+	SetNewMessageFlag(username string, value int) error
+	GetNewMessageFlag(username string) (int, error)
+
+	/* one-to-one messages */
+
+	// SendMessage stores a message and raises the recipient's new message
+	// flag. The attachments must be unsent uploads of from_user, otherwise
+	// nothing is stored and the error is errAttachmentNotFound.
+	SendMessage(to_user string, from_user string, body string, attachments []int64) (map[string]string, error)
+	// GetAllMessages returns the newest 100 messages to or from username, oldest first.
+	// Like every read of one-to-one history it leaves out conversations
+	// with users username blocked with hide_history and what username
+	// deleted with DeleteConversation.
+	GetAllMessages(username string) ([]map[string]string, error)
+	// GetMessages returns one page of history, oldest first. With since_id the
+	// page starts right after the cursor, otherwise it ends right before
+	// before_id (or at the newest message when neither is set). The bool
+	// reports whether another page exists in the same direction. peer may be
+	// "" for every one-to-one conversation.
+	GetMessages(username string, peer string, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error)
+
+	/* conversation deletion, per participant */
+
+	// DeleteConversation hides the one-to-one messages between username and
+	// peer up to the newest one from username only and returns that id, 0
+	// when there are none. peer's history is untouched.
+	DeleteConversation(username string, peer string, at time.Time) (int64, error)
+	// RestoreConversation undoes a DeleteConversation made at or after
+	// since, it reports whether there was one. A deletion before it is
+	// back with its own time, to be undone or purged as if never covered.
+	RestoreConversation(username string, peer string, since time.Time) (bool, error)
+	// PurgeConversations removes the one-to-one messages both participants
+	// deleted before before and returns how many were removed.
+	PurgeConversations(before time.Time) (int64, error)
+
+	/* edits and deletions of single messages, one-to-one or room */
+
+	// GetMessage returns a message row like GetMessages plus created (unix
+	// seconds), errMessageNotFound for an unknown id.
+	GetMessage(id int64) (map[string]string, error)
+	// EditMessage replaces the body of a message, keeps the old body as a
+	// revision and stamps edited_at.
+	EditMessage(id int64, body string, at time.Time) error
+	// GetMessageRevisions returns body and replaced (unix seconds) of every
+	// earlier body of a message, oldest first.
+	GetMessageRevisions(id int64) ([]map[string]string, error)
+	// DeleteMessage empties a message for everyone: the row stays with an
+	// empty body and deleted_at, its revisions go, its attachments with the
+	// next PurgeAttachments.
+	DeleteMessage(id int64, at time.Time) error
+	// HideMessage deletes a message for username only, history and search
+	// leave it out for them from then on.
+	HideMessage(username string, id int64) error
+
+	/* receipts, one-to-one messages only, times are unix seconds */
+
+	// MarkDelivered stamps delivered_at on peer's messages to username with
+	// an id up to upto_id (0 for all) and returns how many were stamped and
+	// the highest id among them.
+	MarkDelivered(username string, peer string, upto_id int64, at time.Time) (int64, int64, error)
+	// MarkRead is MarkDelivered for read_at, it also fills a missing delivered_at.
+	MarkRead(username string, peer string, upto_id int64, at time.Time) (int64, int64, error)
+	// GetUnreadCounts returns peer, unread and last_id for every peer with
+	// unread messages to username, most recent first.
+	GetUnreadCounts(username string) ([]map[string]string, error)
+
+	/* search */
+
+	// SearchMessages returns the messages username can see that match
+	// query, newest first and older than before_id when it is set, each with
+	// a "snippet". The bool reports whether more results follow.
+	SearchMessages(username string, query *searchQuery, before_id int64, limit int) ([]map[string]string, bool, error)
+
+	/* conversation list */
+
+	// GetConversations returns a row per peer and per room username talks
+	// in, newest activity first: type ("peer" or "room"), peer or room_id
+	// and name, last_id, last_from, snippet, date, unread, muted and
+	// archived. Rooms without messages come last with last_id "0".
+	GetConversations(username string) ([]map[string]string, error)
+	// GetConversationState returns mute and archive for a peer (room_id 0) or a room (peer "").
+	GetConversationState(username string, peer string, room_id int64) (muted bool, archived bool, err error)
+	SetConversationState(username string, peer string, room_id int64, muted bool, archived bool) error
+	// MarkRoomRead moves username's read marker in a room to upto_id (0 for
+	// the newest message) and returns how many messages from others it
+	// passed and the new marker. The marker never moves backwards.
+	MarkRoomRead(room_id int64, username string, upto_id int64) (int64, int64, error)
+
+	/* sessions, keyed by the sha256 of the token */
+
+	CreateSession(tokenHash string, username string, created time.Time, expires time.Time) error
+	// GetSession returns errInvalidSession for an unknown token.
+	GetSession(tokenHash string) (username string, expires time.Time, lastSeen time.Time, err error)
+	TouchSession(tokenHash string, lastSeen time.Time) error
+	// DeleteSession reports whether a session was removed.
+	DeleteSession(tokenHash string) (bool, error)
+	DeleteUserSessions(username string) (int64, error)
+	PurgeExpiredSessions(now time.Time) error
+
+	/* failed logins, kept per kind ("user" or "addr") and name, see lockout.go */
+
+	// GetLoginFailures returns the failures in a row and when the last one
+	// was, 0 and the zero time for none.
+	GetLoginFailures(kind string, name string) (int, time.Time, error)
+	// RecordLoginFailure counts a failure at at, starting over when the
+	// last one was before forgetBefore, and returns the failures in a row.
+	RecordLoginFailure(kind string, name string, at time.Time, forgetBefore time.Time) (int, error)
+	// ClearLoginFailures reports whether there were failures to clear.
+	ClearLoginFailures(kind string, name string) (bool, error)
+	// ListLoginFailures returns kind, name, failures and last_failure (unix
+	// seconds) of everything that failed since since, most recent first.
+	ListLoginFailures(since time.Time) ([]map[string]string, error)
+	// PurgeLoginFailures forgets failures last seen before before.
+	PurgeLoginFailures(before time.Time) error
+
+	/* rooms */
+
+	CreateRoom(name string, owner string, public bool, members []string) (int64, error)
+	// GetRoom returns errRoomNotFound for an unknown room.
+	GetRoom(room_id int64) (map[string]string, error)
+	// GetRoomRole returns "" when username is not a member.
+	GetRoomRole(room_id int64, username string) (string, error)
+	GetRoomMembers(room_id int64) ([]map[string]string, error)
+	GetUserRooms(username string) ([]map[string]string, error)
+	AddRoomMember(room_id int64, username string, role string) (bool, error)
+	SetRoomRole(room_id int64, username string, role string) error
+	// RemoveRoomMember promotes a new owner when the last one leaves and deletes empty rooms.
+	RemoveRoomMember(room_id int64, username string) error
+	// SendRoomMessage stores a room message and raises every other member's
+	// new message flag, attachments as for SendMessage.
+	SendRoomMessage(room_id int64, from_user string, body string, attachments []int64) (map[string]string, error)
+	// GetRoomMessages pages a room's history as username sees it, like GetMessages.
+	GetRoomMessages(room_id int64, username string, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error)
+
+	/* attachments, the files themselves are kept by attachmentFiles */
+
+	// CreateAttachment records an upload that is not part of a message yet and returns its row.
+	CreateAttachment(owner string, sha256 string, size int64, content_type string, filename string, created time.Time) (map[string]string, error)
+	// GetAttachment returns id, owner, message_id, sha256, size,
+	// content_type, filename and created, plus to_user, from_user and
+	// room_id of the message once it was sent. errAttachmentNotFound for an
+	// unknown id.
+	GetAttachment(id int64) (map[string]string, error)
+	// GetMessageAttachments returns the attachments of the given messages.
+	GetMessageAttachments(message_ids []int64) ([]map[string]string, error)
+	// GetAttachmentUsage returns the bytes owner has uploaded, sent or not.
+	GetAttachmentUsage(owner string) (int64, error)
+	// PurgeAttachments deletes attachments whose message is gone or was
+	// deleted and unsent ones created before unsentBefore, and returns the sha256 of every file
+	// no attachment refers to anymore.
+	PurgeAttachments(unsentBefore time.Time) ([]string, error)
+
+	/* contacts, kept in both directions */
+
+	// GetContacts returns username, nickname and since (unix seconds) for
+	// every contact of username, by username.
+	GetContacts(username string) ([]map[string]string, error)
+	IsContact(username string, contact string) (bool, error)
+	// RemoveContact reports whether the two were contacts.
+	RemoveContact(username string, contact string) (bool, error)
+	// CreateFriendRequest reports whether a new request was stored.
+	CreateFriendRequest(from_user string, to_user string, created time.Time) (bool, error)
+	HasFriendRequest(from_user string, to_user string) (bool, error)
+	// GetFriendRequests returns username, nickname and created of the
+	// requests sent to and by username, newest first.
+	GetFriendRequests(username string) (incoming []map[string]string, outgoing []map[string]string, err error)
+	// DeleteFriendRequest reports whether a request was removed.
+	DeleteFriendRequest(from_user string, to_user string) (bool, error)
+	// AcceptFriendRequest turns the request from from_user into a contact
+	// in both directions, errNoFriendRequest without one.
+	AcceptFriendRequest(from_user string, to_user string, at time.Time) error
+	GetPrivacySettings(username string) (privacySettings, error)
+	SetPrivacySettings(username string, settings privacySettings) error
+
+	/* blocks */
+
+	// BlockUser blocks (or updates the block of) blocked for username and
+	// drops any contact and friend requests between the two. It reports
+	// whether the block is new.
+	BlockUser(username string, blocked string, hideHistory bool, at time.Time) (bool, error)
+	// UnblockUser reports whether a block was removed.
+	UnblockUser(username string, blocked string) (bool, error)
+	IsBlocked(username string, blocked string) (bool, error)
+	// GetBlockedUsers returns username, nickname, hide_history and since
+	// for everyone username has blocked, by username.
+	GetBlockedUsers(username string) ([]map[string]string, error)
+
+	/* presence, the live state is kept by the presence tracker */
+
+	// GetPresence returns username, last_seen (unix seconds, "" if never),
+	// status_text and invisible for each of usernames that exists.
+	GetPresence(usernames []string) ([]map[string]string, error)
+	SetLastSeen(username string, at time.Time) error
+	SetPresenceSettings(username string, status_text string, invisible bool) error
+
+	/* maintenance */
+
+	// PurgeMessages removes every message, one-to-one or room, sent before
+	// before (or at an unknown time) and returns how many were removed.
+	// Attachments follow with the next PurgeAttachments.
+	PurgeMessages(before time.Time) (int64, error)
+	// GetStats returns row counts for the admin tool: accounts,
+	// disabled_accounts, messages, room_messages, rooms, sessions,
+	// attachments and attachment_bytes.
+	GetStats() (map[string]string, error)
+
+	/* schema */
+
+	MigrateUp(target int) (int, error)
+	MigrateDown(steps int) (int, error)
+	MigrationStatus() ([]migrationStatus, error)
+	MigrateForce(version int) error
+
+	Close() error
+}
+
+var errUnknownStoreDriver = errors.New("unknown database driver")
+
+const defaultStoreDriver = "sqlite3"
+const defaultStoreDSN = "./etc/bootchat.db"
+
+/*
+	open_store - open a Store for a driver
+	 driver string ("sqlite3", "postgres" or "memory")
+	 dsn string (file path or connection string, ignored for memory)
+
+	 returns (Store, error)
+*/
+func open_store(driver string, dsn string) (Store, error) {
+	var dialect *sqlDialect
+
+	switch driver {
+	case "sqlite3", "sqlite":
+		dialect = dialectSqlite
+	case "postgres", "postgresql":
+		dialect = dialectPostgres
+	case "memory":
+		return newMemStore(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownStoreDriver, driver)
+	}
+
+	store, err := open_sql_store(dialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
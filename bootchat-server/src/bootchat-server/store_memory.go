@@ -0,0 +1,1873 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	memStore - a Store kept entirely in memory
+
+	It mirrors the behaviour of sqlStore closely enough for handler tests
+	and throwaway demo servers. Nothing survives a restart and there is no
+	schema, so the migration methods are no-ops.
+*/
+
+type memAccount struct {
+	id         int64
+	username   string
+	nickname   string
+	gender     string
+	question   string
+	answer     string
+	password   string
+	newMessage int
+
+	contactsOnly bool
+	dropBlocked  bool
+
+	lastSeen   int64 // unix seconds, 0 for never
+	statusText string
+	invisible  bool
+
+	disabled bool
+}
+
+type memMessage struct {
+	id      int64
+	toUser  string
+	from    string
+	body    string
+	time    string
+	created int64 // unix seconds, for date filters
+	roomId  int64 // 0 for one-to-one messages
+
+	deliveredAt int64 // unix seconds, 0 until delivered
+	readAt      int64
+
+	editedAt  int64 // unix seconds, 0 unless edited
+	deletedAt int64 // unix seconds, 0 unless deleted for everyone
+	revisions []map[string]string
+	hiddenFor map[string]bool // users who deleted it for themselves
+}
+
+type memAttachment struct {
+	id          int64
+	owner       string
+	messageId   int64 // 0 until sent
+	sha256      string
+	size        int64
+	contentType string
+	filename    string
+	created     int64
+}
+
+type memSession struct {
+	username string
+	expires  time.Time
+	lastSeen time.Time
+}
+
+type memLoginFailures struct {
+	failures int
+	last     int64 // unix seconds
+}
+
+type memRoom struct {
+	id      int64
+	name    string
+	owner   string
+	public  bool
+	created int64
+}
+
+type memRoomMember struct {
+	role       string
+	joined     int64
+	lastReadId int64
+}
+
+// memConversationKey names a conversation like conversation_settings, peer "" for rooms and room 0 for peers.
+type memConversationKey struct {
+	username string
+	peer     string
+	roomId   int64
+}
+
+// memUserPair keys contacts (username, contact) and friend requests (from, to).
+type memUserPair struct {
+	first  string
+	second string
+}
+
+type memBlock struct {
+	created     int64
+	hideHistory bool
+}
+
+type memConversationState struct {
+	muted    bool
+	archived bool
+}
+
+type memConversationDeletion struct {
+	uptoId          int64
+	previousId      int64
+	deleted         int64 // unix seconds
+	previousDeleted int64
+}
+
+type memStore struct {
+	mu sync.Mutex
+
+	lastAccountId int64
+	lastMessageId int64
+	lastRoomId    int64
+
+	lastAttachmentId int64
+
+	accounts map[string]*memAccount
+	messages []*memMessage // ascending id
+	sessions map[string]*memSession
+	rooms    map[int64]*memRoom
+	members  map[int64]map[string]*memRoomMember
+	settings map[memConversationKey]memConversationState
+
+	attachments map[int64]*memAttachment
+
+	contacts       map[memUserPair]int64 // unix seconds since, both directions
+	friendRequests map[memUserPair]int64 // unix seconds created
+
+	blocks map[memUserPair]*memBlock // (username, blocked)
+
+	deletions map[memUserPair]*memConversationDeletion // (username, peer)
+
+	loginFailures map[loginKey]*memLoginFailures
+
+	deletedUsernames map[string]int64 // unix seconds deleted
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		accounts: make(map[string]*memAccount),
+		messages: make([]*memMessage, 0),
+		sessions: make(map[string]*memSession),
+		rooms:    make(map[int64]*memRoom),
+		members:  make(map[int64]map[string]*memRoomMember),
+		settings: make(map[memConversationKey]memConversationState),
+
+		attachments: make(map[int64]*memAttachment),
+
+		contacts:       make(map[memUserPair]int64),
+		friendRequests: make(map[memUserPair]int64),
+
+		blocks: make(map[memUserPair]*memBlock),
+
+		deletions: make(map[memUserPair]*memConversationDeletion),
+
+		loginFailures: make(map[loginKey]*memLoginFailures),
+
+		deletedUsernames: make(map[string]int64),
+	}
+}
+
+func (store *memStore) Close() error {
+	return nil
+}
+
+/* accounts */
+
+func (store *memStore) CreateAccount(username string, nickname string, question string, answer string, passwordHash string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, exists := store.accounts[username]; exists {
+		return errUserExists
+	}
+
+	if _, deleted := store.deletedUsernames[username]; deleted {
+		return errUserExists
+	}
+
+	if len(nickname) > 0 {
+		for _, account := range store.accounts {
+			if account.nickname == nickname {
+				return errNicknameTaken
+			}
+		}
+	}
+
+	store.lastAccountId += 1
+	store.accounts[username] = &memAccount{
+		id:       store.lastAccountId,
+		username: username,
+		nickname: nickname,
+		question: question,
+		answer:   answer,
+		password: passwordHash,
+	}
+
+	return nil
+}
+
+func (store *memStore) UserExists(username string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, exists := store.accounts[username]
+	return exists
+}
+
+func (store *memStore) GetPasswordHash(username string) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		return account.password, nil
+	}
+
+	return "", nil
+}
+
+func (store *memStore) SetPasswordHash(username string, encoded string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		account.password = encoded
+	}
+
+	return nil
+}
+
+func (store *memStore) GetControlUserRow(username string) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	account := store.accounts[username]
+	if account == nil {
+		account = &memAccount{}
+	}
+
+	userRow := make(map[string]string)
+	userRow["id"] = strconv.FormatInt(account.id, 10)
+	userRow["security_question"] = account.question
+	userRow["security_answer"] = account.answer
+
+	return userRow, nil
+}
+
+func (store *memStore) GetUserRow(username string) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	account := store.accounts[username]
+	if account == nil {
+		account = &memAccount{}
+	}
+
+	userRow := make(map[string]string)
+	userRow["id"] = strconv.FormatInt(account.id, 10)
+	userRow["nickname"] = account.nickname
+	userRow["gender"] = account.gender
+	userRow["new_message"] = strconv.Itoa(account.newMessage)
+
+	return userRow, nil
+}
+
+func (store *memStore) DeleteUser(username string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.accounts, username)
+	store.deletedUsernames[username] = time.Now().Unix()
+
+	for pair := range store.contacts {
+		if pair.first == username || pair.second == username {
+			delete(store.contacts, pair)
+		}
+	}
+
+	for pair := range store.friendRequests {
+		if pair.first == username || pair.second == username {
+			delete(store.friendRequests, pair)
+		}
+	}
+
+	for pair := range store.blocks {
+		if pair.first == username || pair.second == username {
+			delete(store.blocks, pair)
+		}
+	}
+
+	for _, message := range store.messages {
+		delete(message.hiddenFor, username)
+	}
+
+	delete(store.loginFailures, loginKey{loginKindUser, username})
+
+	for pair := range store.deletions {
+		if pair.first == username {
+			delete(store.deletions, pair)
+		}
+	}
+
+	// leaving every room like leaveroom, the settings of rooms go with it
+	for room_id, roomMembers := range store.members {
+		if _, isMember := roomMembers[username]; isMember {
+			store.removeRoomMember(room_id, username)
+		}
+	}
+
+	for key := range store.settings {
+		if key.username == username {
+			delete(store.settings, key)
+		}
+	}
+
+	return nil
+}
+
+func (store *memStore) ListAccounts() ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	accounts := make([]map[string]string, 0, len(store.accounts))
+	for _, account := range store.accounts {
+		row := make(map[string]string)
+		row["id"] = strconv.FormatInt(account.id, 10)
+		row["username"] = account.username
+		row["nickname"] = account.nickname
+		row["password"] = account.password
+		row["disabled"] = strconv.Itoa(boolToInt(account.disabled))
+		accounts = append(accounts, row)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		a, _ := strconv.ParseInt(accounts[i]["id"], 10, 64)
+		b, _ := strconv.ParseInt(accounts[j]["id"], 10, 64)
+		return a < b
+	})
+
+	return accounts, nil
+}
+
+func (store *memStore) SetAccountDisabled(username string, disabled bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	account, exists := store.accounts[username]
+	if !exists {
+		return errUserNotFound.withDetail(username)
+	}
+
+	account.disabled = disabled
+	return nil
+}
+
+func (store *memStore) AccountDisabled(username string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		return account.disabled, nil
+	}
+
+	return false, nil
+}
+
+/* new message flag */
+
+func (store *memStore) SetNewMessageFlag(username string, value int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		account.newMessage = value
+	}
+
+	return nil
+}
+
+func (store *memStore) GetNewMessageFlag(username string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		return account.newMessage, nil
+	}
+
+	return 0, nil
+}
+
+/* messages */
+
+func (message *memMessage) row() map[string]string {
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(message.id, 10)
+	row["to_user"] = message.toUser
+	row["from_user"] = message.from
+	row["body"] = message.body
+	row["date"] = message.time
+	if message.roomId != 0 {
+		row["room_id"] = strconv.FormatInt(message.roomId, 10)
+	}
+	if message.deliveredAt != 0 {
+		row["delivered_at"] = strconv.FormatInt(message.deliveredAt, 10)
+	}
+	if message.readAt != 0 {
+		row["read_at"] = strconv.FormatInt(message.readAt, 10)
+	}
+	if message.editedAt != 0 {
+		row["edited_at"] = strconv.FormatInt(message.editedAt, 10)
+	}
+	if message.deletedAt != 0 {
+		row["deleted_at"] = strconv.FormatInt(message.deletedAt, 10)
+	}
+	return row
+}
+
+// appendMessage stores a message with the next id, callers hold the lock.
+func (store *memStore) appendMessage(message *memMessage) {
+	store.lastMessageId += 1
+	now := time.Now()
+	message.id = store.lastMessageId
+	message.time = now.String()
+	message.created = now.Unix()
+	store.messages = append(store.messages, message)
+}
+
+// pageMessages is the in-memory queryMessagePage, callers hold the lock.
+func (store *memStore) pageMessages(match func(message *memMessage) bool, since_id int64, before_id int64, limit int) ([]map[string]string, bool) {
+	forward := since_id > 0
+	listOfRows := make([]map[string]string, 0)
+
+	if forward {
+		for _, message := range store.messages {
+			if message.id > since_id && match(message) {
+				listOfRows = append(listOfRows, message.row())
+				if len(listOfRows) > limit {
+					break
+				}
+			}
+		}
+	} else {
+		for i := len(store.messages) - 1; i >= 0; i-- {
+			message := store.messages[i]
+			if (before_id == 0 || message.id < before_id) && match(message) {
+				listOfRows = append(listOfRows, message.row())
+				if len(listOfRows) > limit {
+					break
+				}
+			}
+		}
+	}
+
+	return trimMessagePage(listOfRows, limit, forward)
+}
+
+func (store *memStore) SendMessage(to_user string, from_user string, body string, attachments []int64) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.checkUnsentAttachments(from_user, attachments); err != nil {
+		return nil, err
+	}
+
+	message := &memMessage{toUser: to_user, from: from_user, body: body}
+	store.appendMessage(message)
+	store.bindAttachments(message.id, attachments)
+
+	if account, exists := store.accounts[to_user]; exists {
+		account.newMessage = 1
+	}
+
+	row := message.row()
+	if len(attachments) > 0 {
+		row["attachments"] = formatIdList(attachments)
+	}
+	return row, nil
+}
+
+func (store *memStore) GetAllMessages(username string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	match := func(message *memMessage) bool {
+		return message.roomId == 0 && (message.toUser == username || message.from == username) &&
+			!store.isHiddenLocked(username, message) && !message.hiddenFor[username]
+	}
+
+	listOfRows, _ := store.pageMessages(match, 0, 0, 100)
+	return listOfRows, nil
+}
+
+func (store *memStore) GetMessages(username string, peer string, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	match := func(message *memMessage) bool {
+		if message.roomId != 0 || store.isHiddenLocked(username, message) || message.hiddenFor[username] {
+			return false
+		}
+		if len(peer) > 0 {
+			return (message.toUser == username && message.from == peer) || (message.toUser == peer && message.from == username)
+		}
+		return message.toUser == username || message.from == username
+	}
+
+	listOfRows, hasMore := store.pageMessages(match, since_id, before_id, limit)
+	return listOfRows, hasMore, nil
+}
+
+// isHiddenLocked reports whether username hid a one-to-one message by
+// blocking the other side or by deleting the conversation after it was
+// sent, callers hold the lock.
+func (store *memStore) isHiddenLocked(username string, message *memMessage) bool {
+	other := message.toUser
+	if other == username {
+		other = message.from
+	}
+
+	if deletion, exists := store.deletions[memUserPair{username, other}]; exists && message.id <= deletion.uptoId {
+		return true
+	}
+
+	block, exists := store.blocks[memUserPair{username, other}]
+	return exists && block.hideHistory
+}
+
+// removeMessages drops every message matching, callers hold the lock.
+func (store *memStore) removeMessages(match func(message *memMessage) bool) {
+	kept := store.messages[:0]
+	for _, message := range store.messages {
+		if !match(message) {
+			kept = append(kept, message)
+		}
+	}
+	store.messages = kept
+}
+
+/* conversation deletion */
+
+// isBetween matches the one-to-one messages between two users.
+func (message *memMessage) isBetween(username string, peer string) bool {
+	return message.roomId == 0 &&
+		((message.toUser == username && message.from == peer) || (message.toUser == peer && message.from == username))
+}
+
+func (store *memStore) DeleteConversation(username string, peer string, at time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var newest int64
+	for _, message := range store.messages {
+		if message.isBetween(username, peer) {
+			newest = message.id
+		}
+	}
+
+	key := memUserPair{username, peer}
+	deletion, exists := store.deletions[key]
+	if !exists {
+		deletion = &memConversationDeletion{}
+	}
+
+	// nothing new to delete, an undo would bring back the earlier deletion
+	if newest <= deletion.uptoId {
+		return newest, nil
+	}
+
+	store.deletions[key] = &memConversationDeletion{uptoId: newest, previousId: deletion.uptoId, deleted: at.Unix(), previousDeleted: deletion.deleted}
+	return newest, nil
+}
+
+func (store *memStore) RestoreConversation(username string, peer string, since time.Time) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := memUserPair{username, peer}
+	deletion, exists := store.deletions[key]
+	if !exists || deletion.deleted < since.Unix() {
+		return false, nil
+	}
+
+	// back to the deletion before, as of when it was made
+	if deletion.previousId > 0 {
+		store.deletions[key] = &memConversationDeletion{uptoId: deletion.previousId, deleted: deletion.previousDeleted}
+	} else {
+		delete(store.deletions, key)
+	}
+
+	return true, nil
+}
+
+func (store *memStore) PurgeConversations(before time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var removed int64
+
+	for pair, deletion := range store.deletions {
+		other, exists := store.deletions[memUserPair{pair.second, pair.first}]
+		if pair.first > pair.second || !exists || deletion.deleted >= before.Unix() || other.deleted >= before.Unix() {
+			continue
+		}
+
+		upto_id := deletion.uptoId
+		if other.uptoId < upto_id {
+			upto_id = other.uptoId
+		}
+
+		store.removeMessages(func(message *memMessage) bool {
+			if message.isBetween(pair.first, pair.second) && message.id <= upto_id {
+				removed += 1
+				return true
+			}
+			return false
+		})
+	}
+
+	return removed, nil
+}
+
+/* edits and deletions */
+
+func (store *memStore) GetMessage(id int64) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message := store.findMessage(id)
+	if message == nil {
+		return nil, errMessageNotFound
+	}
+
+	row := message.row()
+	row["created"] = strconv.FormatInt(message.created, 10)
+	return row, nil
+}
+
+func (store *memStore) EditMessage(id int64, body string, at time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message := store.findMessage(id)
+	if message == nil {
+		return errMessageNotFound
+	}
+
+	revision := make(map[string]string)
+	revision["body"] = message.body
+	revision["replaced"] = strconv.FormatInt(at.Unix(), 10)
+
+	message.revisions = append(message.revisions, revision)
+	message.body = body
+	message.editedAt = at.Unix()
+	return nil
+}
+
+func (store *memStore) GetMessageRevisions(id int64) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	revisions := make([]map[string]string, 0)
+	if message := store.findMessage(id); message != nil {
+		for _, revision := range message.revisions {
+			copied := make(map[string]string)
+			for key, value := range revision {
+				copied[key] = value
+			}
+			revisions = append(revisions, copied)
+		}
+	}
+
+	return revisions, nil
+}
+
+func (store *memStore) DeleteMessage(id int64, at time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message := store.findMessage(id)
+	if message == nil {
+		return errMessageNotFound
+	}
+
+	message.body = ""
+	message.deletedAt = at.Unix()
+	message.revisions = nil
+	return nil
+}
+
+func (store *memStore) HideMessage(username string, id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message := store.findMessage(id)
+	if message == nil {
+		return errMessageNotFound
+	}
+
+	if message.hiddenFor == nil {
+		message.hiddenFor = make(map[string]bool)
+	}
+	message.hiddenFor[username] = true
+	return nil
+}
+
+/* receipts */
+
+func (store *memStore) MarkDelivered(username string, peer string, upto_id int64, at time.Time) (int64, int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	var last int64
+
+	for _, message := range store.messages {
+		if store.isReceiptTarget(message, username, peer, upto_id) && message.deliveredAt == 0 {
+			message.deliveredAt = at.Unix()
+			count += 1
+			last = message.id
+		}
+	}
+
+	return count, last, nil
+}
+
+func (store *memStore) MarkRead(username string, peer string, upto_id int64, at time.Time) (int64, int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	var last int64
+
+	for _, message := range store.messages {
+		if store.isReceiptTarget(message, username, peer, upto_id) && message.readAt == 0 {
+			message.readAt = at.Unix()
+			if message.deliveredAt == 0 {
+				message.deliveredAt = message.readAt
+			}
+			count += 1
+			last = message.id
+		}
+	}
+
+	return count, last, nil
+}
+
+// isReceiptTarget matches the one-to-one messages from peer to username up to upto_id (0 for all).
+func (store *memStore) isReceiptTarget(message *memMessage, username string, peer string, upto_id int64) bool {
+	return message.roomId == 0 && message.toUser == username && message.from == peer &&
+		(upto_id == 0 || message.id <= upto_id)
+}
+
+func (store *memStore) GetUnreadCounts(username string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	unread := make(map[string]int64)
+	last := make(map[string]int64)
+
+	for _, message := range store.messages {
+		if message.roomId == 0 && message.toUser == username && message.readAt == 0 && !store.isHiddenLocked(username, message) && !message.hiddenFor[username] {
+			unread[message.from] += 1
+			last[message.from] = message.id
+		}
+	}
+
+	counts := make([]map[string]string, 0, len(unread))
+	for peer := range unread {
+		count := make(map[string]string)
+		count["peer"] = peer
+		count["unread"] = strconv.FormatInt(unread[peer], 10)
+		count["last_id"] = strconv.FormatInt(last[peer], 10)
+		counts = append(counts, count)
+	}
+
+	sort.Slice(counts, func(i, j int) bool { return last[counts[i]["peer"]] > last[counts[j]["peer"]] })
+
+	return counts, nil
+}
+
+/* search */
+
+func (store *memStore) SearchMessages(username string, query *searchQuery, before_id int64, limit int) ([]map[string]string, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	listOfRows := make([]map[string]string, 0)
+
+	for i := len(store.messages) - 1; i >= 0 && len(listOfRows) <= limit; i-- {
+		message := store.messages[i]
+
+		if (before_id > 0 && message.id >= before_id) || message.hiddenFor[username] {
+			continue
+		}
+
+		if message.roomId == 0 {
+			if (message.toUser != username && message.from != username) || store.isHiddenLocked(username, message) {
+				continue
+			}
+			if len(query.peer) > 0 && message.toUser != query.peer && message.from != query.peer {
+				continue
+			}
+			if query.room_id > 0 {
+				continue
+			}
+		} else {
+			if _, member := store.members[message.roomId][username]; !member {
+				continue
+			}
+			if len(query.peer) > 0 || (query.room_id > 0 && message.roomId != query.room_id) {
+				continue
+			}
+		}
+
+		if (query.since > 0 && message.created < query.since) || (query.until > 0 && message.created >= query.until) {
+			continue
+		}
+
+		snippet, matched := search_snippet(message.body, query.terms)
+		if !matched {
+			continue
+		}
+
+		row := message.row()
+		row["snippet"] = snippet
+		listOfRows = append(listOfRows, row)
+	}
+
+	hasMore := len(listOfRows) > limit
+	if hasMore {
+		listOfRows = listOfRows[:limit]
+	}
+
+	return listOfRows, hasMore, nil
+}
+
+/* conversation list */
+
+func snippetOf(body string) string {
+	runes := []rune(body)
+	if len(runes) > conversationSnippetLength {
+		return string(runes[:conversationSnippetLength])
+	}
+	return body
+}
+
+func (store *memStore) GetConversations(username string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	latest := make(map[string]*memMessage)
+	unread := make(map[string]int64)
+
+	for _, message := range store.messages {
+		if message.roomId != 0 || store.isHiddenLocked(username, message) {
+			continue
+		}
+		if message.toUser == username {
+			latest[message.from] = message
+			if message.readAt == 0 && !message.hiddenFor[username] {
+				unread[message.from] += 1
+			}
+		} else if message.from == username {
+			latest[message.toUser] = message
+		}
+	}
+
+	conversations := make([]map[string]string, 0)
+
+	for peer, message := range latest {
+		state := store.settings[memConversationKey{username: username, peer: peer}]
+
+		conversation := store.conversationRow(message, unread[peer], state)
+		conversation["type"] = "peer"
+		conversation["peer"] = peer
+		conversations = append(conversations, conversation)
+	}
+
+	for room_id, roomMembers := range store.members {
+		member, exists := roomMembers[username]
+		if !exists {
+			continue
+		}
+
+		var last *memMessage
+		var count int64
+		for _, message := range store.messages {
+			if message.roomId == room_id {
+				last = message
+				if message.id > member.lastReadId && message.from != username && !message.hiddenFor[username] {
+					count += 1
+				}
+			}
+		}
+
+		state := store.settings[memConversationKey{username: username, roomId: room_id}]
+
+		conversation := store.conversationRow(last, count, state)
+		conversation["type"] = "room"
+		conversation["room_id"] = strconv.FormatInt(room_id, 10)
+		conversation["name"] = store.rooms[room_id].name
+		conversations = append(conversations, conversation)
+	}
+
+	return sortConversations(conversations), nil
+}
+
+// conversationRow fills the GetConversations columns shared by peers and rooms, message may be nil.
+func (store *memStore) conversationRow(message *memMessage, unread int64, state memConversationState) map[string]string {
+	if message == nil {
+		message = &memMessage{}
+	}
+
+	conversation := make(map[string]string)
+	conversation["last_id"] = strconv.FormatInt(message.id, 10)
+	conversation["last_from"] = message.from
+	conversation["snippet"] = snippetOf(message.body)
+	conversation["date"] = message.time
+	conversation["unread"] = strconv.FormatInt(unread, 10)
+	conversation["muted"] = strconv.Itoa(boolToInt(state.muted))
+	conversation["archived"] = strconv.Itoa(boolToInt(state.archived))
+
+	return conversation
+}
+
+func (store *memStore) GetConversationState(username string, peer string, room_id int64) (bool, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	state := store.settings[memConversationKey{username: username, peer: peer, roomId: room_id}]
+	return state.muted, state.archived, nil
+}
+
+func (store *memStore) SetConversationState(username string, peer string, room_id int64, muted bool, archived bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.settings[memConversationKey{username: username, peer: peer, roomId: room_id}] = memConversationState{muted: muted, archived: archived}
+	return nil
+}
+
+func (store *memStore) MarkRoomRead(room_id int64, username string, upto_id int64) (int64, int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	member, exists := store.members[room_id][username]
+	if !exists {
+		return 0, 0, errNotRoomMember
+	}
+
+	var newest int64
+	for _, message := range store.messages {
+		if message.roomId == room_id {
+			newest = message.id
+		}
+	}
+
+	if upto_id == 0 || upto_id > newest {
+		upto_id = newest
+	}
+
+	if upto_id <= member.lastReadId {
+		return 0, member.lastReadId, nil
+	}
+
+	var count int64
+	for _, message := range store.messages {
+		if message.roomId == room_id && message.id > member.lastReadId && message.id <= upto_id && message.from != username {
+			count += 1
+		}
+	}
+
+	member.lastReadId = upto_id
+	return count, upto_id, nil
+}
+
+/* sessions */
+
+func (store *memStore) CreateSession(tokenHash string, username string, created time.Time, expires time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.sessions[tokenHash] = &memSession{username: username, expires: expires, lastSeen: created}
+	return nil
+}
+
+func (store *memStore) GetSession(tokenHash string) (string, time.Time, time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, exists := store.sessions[tokenHash]
+	if !exists {
+		return "", time.Time{}, time.Time{}, errInvalidSession
+	}
+
+	return session.username, session.expires, session.lastSeen, nil
+}
+
+func (store *memStore) TouchSession(tokenHash string, lastSeen time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if session, exists := store.sessions[tokenHash]; exists {
+		session.lastSeen = lastSeen
+	}
+
+	return nil
+}
+
+func (store *memStore) DeleteSession(tokenHash string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, exists := store.sessions[tokenHash]
+	delete(store.sessions, tokenHash)
+
+	return exists, nil
+}
+
+func (store *memStore) DeleteUserSessions(username string) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for tokenHash, session := range store.sessions {
+		if session.username == username {
+			delete(store.sessions, tokenHash)
+			count += 1
+		}
+	}
+
+	return count, nil
+}
+
+func (store *memStore) PurgeExpiredSessions(now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for tokenHash, session := range store.sessions {
+		if !now.Before(session.expires) {
+			delete(store.sessions, tokenHash)
+		}
+	}
+
+	return nil
+}
+
+/* failed logins */
+
+func (store *memStore) GetLoginFailures(kind string, name string) (int, time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, exists := store.loginFailures[loginKey{kind, name}]
+	if !exists {
+		return 0, time.Time{}, nil
+	}
+
+	return entry.failures, time.Unix(entry.last, 0), nil
+}
+
+func (store *memStore) RecordLoginFailure(kind string, name string, at time.Time, forgetBefore time.Time) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := loginKey{kind, name}
+	entry, exists := store.loginFailures[key]
+	if !exists || entry.last < forgetBefore.Unix() {
+		entry = &memLoginFailures{}
+		store.loginFailures[key] = entry
+	}
+
+	entry.failures += 1
+	entry.last = at.Unix()
+
+	return entry.failures, nil
+}
+
+func (store *memStore) ClearLoginFailures(kind string, name string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := loginKey{kind, name}
+	_, exists := store.loginFailures[key]
+	delete(store.loginFailures, key)
+
+	return exists, nil
+}
+
+func (store *memStore) ListLoginFailures(since time.Time) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	list := make([]map[string]string, 0)
+	for key, entry := range store.loginFailures {
+		if entry.last < since.Unix() {
+			continue
+		}
+
+		list = append(list, map[string]string{
+			"kind":         key.kind,
+			"name":         key.name,
+			"failures":     strconv.Itoa(entry.failures),
+			"last_failure": strconv.FormatInt(entry.last, 10),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.ParseInt(list[i]["last_failure"], 10, 64)
+		b, _ := strconv.ParseInt(list[j]["last_failure"], 10, 64)
+		return a > b
+	})
+
+	return list, nil
+}
+
+func (store *memStore) PurgeLoginFailures(before time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for key, entry := range store.loginFailures {
+		if entry.last < before.Unix() {
+			delete(store.loginFailures, key)
+		}
+	}
+
+	return nil
+}
+
+/* rooms */
+
+func (store *memStore) CreateRoom(name string, owner string, public bool, members []string) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	store.lastRoomId += 1
+	room := &memRoom{id: store.lastRoomId, name: name, owner: owner, public: public, created: now}
+	store.rooms[room.id] = room
+
+	roomMembers := map[string]*memRoomMember{owner: {role: roomRoleOwner, joined: now}}
+	for _, member := range members {
+		if _, exists := roomMembers[member]; !exists {
+			roomMembers[member] = &memRoomMember{role: roomRoleMember, joined: now}
+		}
+	}
+	store.members[room.id] = roomMembers
+
+	return room.id, nil
+}
+
+func (store *memStore) GetRoom(room_id int64) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	room, exists := store.rooms[room_id]
+	if !exists {
+		return nil, errRoomNotFound
+	}
+
+	public := "0"
+	if room.public {
+		public = "1"
+	}
+
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(room.id, 10)
+	row["name"] = room.name
+	row["owner"] = room.owner
+	row["public"] = public
+	row["created"] = strconv.FormatInt(room.created, 10)
+
+	return row, nil
+}
+
+func (store *memStore) GetRoomRole(room_id int64, username string) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if member, exists := store.members[room_id][username]; exists {
+		return member.role, nil
+	}
+
+	return "", nil
+}
+
+// sortedRoomMembers returns a room's members owners first, then by join time; callers hold the lock.
+func (store *memStore) sortedRoomMembers(room_id int64) []string {
+	roomMembers := store.members[room_id]
+
+	names := make([]string, 0, len(roomMembers))
+	for username := range roomMembers {
+		names = append(names, username)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a := roomMembers[names[i]]
+		b := roomMembers[names[j]]
+		if (a.role == roomRoleOwner) != (b.role == roomRoleOwner) {
+			return a.role == roomRoleOwner
+		}
+		if a.joined != b.joined {
+			return a.joined < b.joined
+		}
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+func (store *memStore) GetRoomMembers(room_id int64) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	members := make([]map[string]string, 0)
+	for _, username := range store.sortedRoomMembers(room_id) {
+		member := store.members[room_id][username]
+		row := make(map[string]string)
+		row["username"] = username
+		row["role"] = member.role
+		row["joined"] = strconv.FormatInt(member.joined, 10)
+		members = append(members, row)
+	}
+
+	return members, nil
+}
+
+func (store *memStore) GetUserRooms(username string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	rooms := make([]map[string]string, 0)
+	for room_id, roomMembers := range store.members {
+		member, exists := roomMembers[username]
+		if !exists {
+			continue
+		}
+
+		room := store.rooms[room_id]
+		public := "0"
+		if room.public {
+			public = "1"
+		}
+
+		row := make(map[string]string)
+		row["id"] = strconv.FormatInt(room.id, 10)
+		row["name"] = room.name
+		row["owner"] = room.owner
+		row["public"] = public
+		row["role"] = member.role
+		row["members"] = strconv.Itoa(len(roomMembers))
+		rooms = append(rooms, row)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i]["name"] < rooms[j]["name"] })
+
+	return rooms, nil
+}
+
+func (store *memStore) AddRoomMember(room_id int64, username string, role string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	roomMembers, exists := store.members[room_id]
+	if !exists {
+		return false, errRoomNotFound
+	}
+
+	if _, exists = roomMembers[username]; exists {
+		return false, nil
+	}
+
+	// history from before joining is visible but not unread
+	var newest int64
+	for _, message := range store.messages {
+		if message.roomId == room_id {
+			newest = message.id
+		}
+	}
+
+	roomMembers[username] = &memRoomMember{role: role, joined: time.Now().Unix(), lastReadId: newest}
+	return true, nil
+}
+
+func (store *memStore) SetRoomRole(room_id int64, username string, role string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if member, exists := store.members[room_id][username]; exists {
+		member.role = role
+	}
+
+	return nil
+}
+
+func (store *memStore) RemoveRoomMember(room_id int64, username string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.removeRoomMember(room_id, username)
+	return nil
+}
+
+// removeRoomMember is RemoveRoomMember with the lock held.
+func (store *memStore) removeRoomMember(room_id int64, username string) {
+	roomMembers := store.members[room_id]
+	delete(roomMembers, username)
+	delete(store.settings, memConversationKey{username: username, roomId: room_id})
+
+	if len(roomMembers) == 0 {
+		delete(store.members, room_id)
+		delete(store.rooms, room_id)
+		store.removeMessages(func(message *memMessage) bool { return message.roomId == room_id })
+		return
+	}
+
+	for _, member := range roomMembers {
+		if member.role == roomRoleOwner {
+			return
+		}
+	}
+
+	// no owner left, promote the longest standing member
+	var oldest string
+	for name, member := range roomMembers {
+		if len(oldest) == 0 || member.joined < roomMembers[oldest].joined ||
+			(member.joined == roomMembers[oldest].joined && name < oldest) {
+			oldest = name
+		}
+	}
+	roomMembers[oldest].role = roomRoleOwner
+}
+
+func (store *memStore) SendRoomMessage(room_id int64, from_user string, body string, attachments []int64) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.checkUnsentAttachments(from_user, attachments); err != nil {
+		return nil, err
+	}
+
+	message := &memMessage{from: from_user, body: body, roomId: room_id}
+	store.appendMessage(message)
+	store.bindAttachments(message.id, attachments)
+
+	for username := range store.members[room_id] {
+		if account, exists := store.accounts[username]; exists && username != from_user {
+			account.newMessage = 1
+		}
+	}
+
+	row := message.row()
+	if len(attachments) > 0 {
+		row["attachments"] = formatIdList(attachments)
+	}
+	return row, nil
+}
+
+func (store *memStore) GetRoomMessages(room_id int64, username string, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	match := func(message *memMessage) bool { return message.roomId == room_id && !message.hiddenFor[username] }
+
+	listOfRows, hasMore := store.pageMessages(match, since_id, before_id, limit)
+	return listOfRows, hasMore, nil
+}
+
+/* attachments */
+
+func (attachment *memAttachment) row() map[string]string {
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(attachment.id, 10)
+	row["owner"] = attachment.owner
+	row["message_id"] = strconv.FormatInt(attachment.messageId, 10)
+	row["sha256"] = attachment.sha256
+	row["size"] = strconv.FormatInt(attachment.size, 10)
+	row["content_type"] = attachment.contentType
+	row["filename"] = attachment.filename
+	row["created"] = strconv.FormatInt(attachment.created, 10)
+	return row
+}
+
+// checkUnsentAttachments is the precondition of bindAttachments, callers hold the lock.
+func (store *memStore) checkUnsentAttachments(owner string, attachments []int64) error {
+	for _, id := range attachments {
+		attachment, exists := store.attachments[id]
+		if !exists || attachment.owner != owner || attachment.messageId != 0 {
+			return errAttachmentNotFound.withDetail(strconv.FormatInt(id, 10))
+		}
+	}
+
+	return nil
+}
+
+func (store *memStore) bindAttachments(message_id int64, attachments []int64) {
+	for _, id := range attachments {
+		store.attachments[id].messageId = message_id
+	}
+}
+
+// findMessage returns the message with an id, or nil, callers hold the lock.
+func (store *memStore) findMessage(id int64) *memMessage {
+	i := sort.Search(len(store.messages), func(i int) bool { return store.messages[i].id >= id })
+	if i < len(store.messages) && store.messages[i].id == id {
+		return store.messages[i]
+	}
+	return nil
+}
+
+func (store *memStore) CreateAttachment(owner string, sha256 string, size int64, content_type string, filename string, created time.Time) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.lastAttachmentId += 1
+	attachment := &memAttachment{
+		id:          store.lastAttachmentId,
+		owner:       owner,
+		sha256:      sha256,
+		size:        size,
+		contentType: content_type,
+		filename:    filename,
+		created:     created.Unix(),
+	}
+	store.attachments[attachment.id] = attachment
+
+	return attachment.row(), nil
+}
+
+func (store *memStore) GetAttachment(id int64) (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	attachment, exists := store.attachments[id]
+	if !exists {
+		return nil, errAttachmentNotFound
+	}
+
+	row := attachment.row()
+	if message := store.findMessage(attachment.messageId); message != nil {
+		row["to_user"] = message.toUser
+		row["from_user"] = message.from
+		if message.roomId != 0 {
+			row["room_id"] = strconv.FormatInt(message.roomId, 10)
+		}
+	}
+
+	return row, nil
+}
+
+func (store *memStore) GetMessageAttachments(message_ids []int64) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	wanted := make(map[int64]bool)
+	for _, id := range message_ids {
+		wanted[id] = true
+	}
+
+	listOfRows := make([]map[string]string, 0)
+	for _, attachment := range store.attachments {
+		if attachment.messageId != 0 && wanted[attachment.messageId] {
+			listOfRows = append(listOfRows, attachment.row())
+		}
+	}
+
+	sort.Slice(listOfRows, func(i, j int) bool {
+		a, _ := strconv.ParseInt(listOfRows[i]["id"], 10, 64)
+		b, _ := strconv.ParseInt(listOfRows[j]["id"], 10, 64)
+		return a < b
+	})
+
+	return listOfRows, nil
+}
+
+func (store *memStore) GetAttachmentUsage(owner string) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var usage int64
+	for _, attachment := range store.attachments {
+		if attachment.owner == owner {
+			usage += attachment.size
+		}
+	}
+
+	return usage, nil
+}
+
+func (store *memStore) PurgeAttachments(unsentBefore time.Time) ([]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	candidates := make(map[string]bool)
+	for id, attachment := range store.attachments {
+		expired := attachment.messageId == 0 && attachment.created < unsentBefore.Unix()
+		orphaned := false
+		if attachment.messageId != 0 {
+			message := store.findMessage(attachment.messageId)
+			orphaned = message == nil || message.deletedAt != 0
+		}
+		if expired || orphaned {
+			candidates[attachment.sha256] = true
+			delete(store.attachments, id)
+		}
+	}
+
+	for _, attachment := range store.attachments {
+		delete(candidates, attachment.sha256)
+	}
+
+	unreferenced := make([]string, 0, len(candidates))
+	for sha256 := range candidates {
+		unreferenced = append(unreferenced, sha256)
+	}
+
+	return unreferenced, nil
+}
+
+/* schema */
+
+func (store *memStore) MigrateUp(target int) (int, error) {
+	return 0, nil
+}
+
+func (store *memStore) MigrateDown(steps int) (int, error) {
+	return 0, nil
+}
+
+func (store *memStore) MigrationStatus() ([]migrationStatus, error) {
+	return make([]migrationStatus, 0), nil
+}
+
+func (store *memStore) MigrateForce(version int) error {
+	return nil
+}
+
+/* contacts */
+
+// userRowLocked is the username, nickname and a time column of a contact
+// or friend request row, store.mu must be held.
+func (store *memStore) userRowLocked(username string, column string, at int64) map[string]string {
+	row := make(map[string]string)
+	row["username"] = username
+	row["nickname"] = ""
+	if account, exists := store.accounts[username]; exists {
+		row["nickname"] = account.nickname
+	}
+	row[column] = strconv.FormatInt(at, 10)
+	return row
+}
+
+func (store *memStore) GetContacts(username string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	contacts := make([]map[string]string, 0)
+	for pair, since := range store.contacts {
+		if pair.first == username {
+			contacts = append(contacts, store.userRowLocked(pair.second, "since", since))
+		}
+	}
+
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i]["username"] < contacts[j]["username"]
+	})
+
+	return contacts, nil
+}
+
+func (store *memStore) IsContact(username string, contact string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, exists := store.contacts[memUserPair{username, contact}]
+	return exists, nil
+}
+
+func (store *memStore) RemoveContact(username string, contact string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, exists := store.contacts[memUserPair{username, contact}]
+	delete(store.contacts, memUserPair{username, contact})
+	delete(store.contacts, memUserPair{contact, username})
+	return exists, nil
+}
+
+func (store *memStore) CreateFriendRequest(from_user string, to_user string, created time.Time) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pair := memUserPair{from_user, to_user}
+	if _, exists := store.friendRequests[pair]; exists {
+		return false, nil
+	}
+
+	store.friendRequests[pair] = created.Unix()
+	return true, nil
+}
+
+func (store *memStore) HasFriendRequest(from_user string, to_user string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, exists := store.friendRequests[memUserPair{from_user, to_user}]
+	return exists, nil
+}
+
+func (store *memStore) GetFriendRequests(username string) ([]map[string]string, []map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	incoming := make([]map[string]string, 0)
+	outgoing := make([]map[string]string, 0)
+
+	for pair, created := range store.friendRequests {
+		if pair.second == username {
+			incoming = append(incoming, store.userRowLocked(pair.first, "created", created))
+		} else if pair.first == username {
+			outgoing = append(outgoing, store.userRowLocked(pair.second, "created", created))
+		}
+	}
+
+	for _, requests := range [][]map[string]string{incoming, outgoing} {
+		sort.Slice(requests, func(i, j int) bool {
+			if requests[i]["created"] != requests[j]["created"] {
+				a, _ := strconv.ParseInt(requests[i]["created"], 10, 64)
+				b, _ := strconv.ParseInt(requests[j]["created"], 10, 64)
+				return a > b
+			}
+			return requests[i]["username"] < requests[j]["username"]
+		})
+	}
+
+	return incoming, outgoing, nil
+}
+
+func (store *memStore) DeleteFriendRequest(from_user string, to_user string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pair := memUserPair{from_user, to_user}
+	_, exists := store.friendRequests[pair]
+	delete(store.friendRequests, pair)
+	return exists, nil
+}
+
+func (store *memStore) AcceptFriendRequest(from_user string, to_user string, at time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, exists := store.friendRequests[memUserPair{from_user, to_user}]; !exists {
+		return errNoFriendRequest
+	}
+
+	delete(store.friendRequests, memUserPair{from_user, to_user})
+	delete(store.friendRequests, memUserPair{to_user, from_user})
+
+	for _, pair := range []memUserPair{{from_user, to_user}, {to_user, from_user}} {
+		if _, exists := store.contacts[pair]; !exists {
+			store.contacts[pair] = at.Unix()
+		}
+	}
+
+	return nil
+}
+
+func (store *memStore) GetPrivacySettings(username string) (privacySettings, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	account, exists := store.accounts[username]
+	if !exists {
+		return privacySettings{}, errUserNotFound
+	}
+
+	return privacySettings{contactsOnly: account.contactsOnly, dropBlocked: account.dropBlocked}, nil
+}
+
+func (store *memStore) SetPrivacySettings(username string, settings privacySettings) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		account.contactsOnly = settings.contactsOnly
+		account.dropBlocked = settings.dropBlocked
+	}
+	return nil
+}
+
+/* blocks */
+
+func (store *memStore) BlockUser(username string, blocked string, hideHistory bool, at time.Time) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pair := memUserPair{username, blocked}
+	reverse := memUserPair{blocked, username}
+
+	delete(store.contacts, pair)
+	delete(store.contacts, reverse)
+	delete(store.friendRequests, pair)
+	delete(store.friendRequests, reverse)
+
+	if block, exists := store.blocks[pair]; exists {
+		block.hideHistory = hideHistory
+		return false, nil
+	}
+
+	store.blocks[pair] = &memBlock{created: at.Unix(), hideHistory: hideHistory}
+	return true, nil
+}
+
+func (store *memStore) UnblockUser(username string, blocked string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pair := memUserPair{username, blocked}
+	_, exists := store.blocks[pair]
+	delete(store.blocks, pair)
+	return exists, nil
+}
+
+func (store *memStore) IsBlocked(username string, blocked string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, exists := store.blocks[memUserPair{username, blocked}]
+	return exists, nil
+}
+
+func (store *memStore) GetBlockedUsers(username string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	users := make([]map[string]string, 0)
+	for pair, block := range store.blocks {
+		if pair.first == username {
+			row := store.userRowLocked(pair.second, "since", block.created)
+			row["hide_history"] = strconv.Itoa(boolToInt(block.hideHistory))
+			users = append(users, row)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i]["username"] < users[j]["username"]
+	})
+
+	return users, nil
+}
+
+/* presence */
+
+func (store *memStore) GetPresence(usernames []string) ([]map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	rows := make([]map[string]string, 0, len(usernames))
+	for _, username := range usernames {
+		account, exists := store.accounts[username]
+		if !exists {
+			continue
+		}
+
+		row := make(map[string]string)
+		row["username"] = username
+		row["last_seen"] = ""
+		if account.lastSeen > 0 {
+			row["last_seen"] = strconv.FormatInt(account.lastSeen, 10)
+		}
+		row["status_text"] = account.statusText
+		row["invisible"] = strconv.Itoa(boolToInt(account.invisible))
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i]["username"] < rows[j]["username"]
+	})
+
+	return rows, nil
+}
+
+func (store *memStore) SetLastSeen(username string, at time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		account.lastSeen = at.Unix()
+	}
+	return nil
+}
+
+func (store *memStore) SetPresenceSettings(username string, status_text string, invisible bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if account, exists := store.accounts[username]; exists {
+		account.statusText = status_text
+		account.invisible = invisible
+	}
+	return nil
+}
+
+/* maintenance */
+
+func (store *memStore) PurgeMessages(before time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var removed int64
+
+	store.removeMessages(func(message *memMessage) bool {
+		if message.created < before.Unix() {
+			removed += 1
+			return true
+		}
+		return false
+	})
+
+	return removed, nil
+}
+
+func (store *memStore) GetStats() (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var disabled, messages, roomMessages, attachmentBytes int64
+
+	for _, account := range store.accounts {
+		if account.disabled {
+			disabled += 1
+		}
+	}
+
+	for _, message := range store.messages {
+		if message.roomId == 0 {
+			messages += 1
+		} else {
+			roomMessages += 1
+		}
+	}
+
+	for _, attachment := range store.attachments {
+		attachmentBytes += attachment.size
+	}
+
+	stats := make(map[string]string)
+	stats["accounts"] = strconv.Itoa(len(store.accounts))
+	stats["disabled_accounts"] = strconv.FormatInt(disabled, 10)
+	stats["messages"] = strconv.FormatInt(messages, 10)
+	stats["room_messages"] = strconv.FormatInt(roomMessages, 10)
+	stats["rooms"] = strconv.Itoa(len(store.rooms))
+	stats["sessions"] = strconv.Itoa(len(store.sessions))
+	stats["attachments"] = strconv.Itoa(len(store.attachments))
+	stats["attachment_bytes"] = strconv.FormatInt(attachmentBytes, 10)
+	return stats, nil
+}
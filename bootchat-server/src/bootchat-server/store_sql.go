@@ -0,0 +1,2117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+/*
+	sqlStore - the Store for SQL databases
+
+	Queries are written once with "?" placeholders in the subset of SQL that
+	SQLite and PostgreSQL share; the dialect rebinds placeholders for
+	postgres and covers the few places the two differ (returning the id of
+	an inserted row, migrations).
+*/
+
+type sqlDialect struct {
+	name     string // migrations/<name>
+	driver   string // database/sql driver
+	numbered bool   // $1, $2, ... placeholders
+}
+
+var dialectSqlite = &sqlDialect{name: "sqlite", driver: "sqlite3"}
+var dialectPostgres = &sqlDialect{name: "postgres", driver: "postgres", numbered: true}
+
+// rebind rewrites "?" placeholders for dialects that number them.
+func (dialect *sqlDialect) rebind(query string) string {
+	if !dialect.numbered {
+		return query
+	}
+
+	var builder strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n += 1
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(c)
+	}
+
+	return builder.String()
+}
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+// sqlRunner is satisfied by *sql.DB and *sql.Tx.
+type sqlRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func open_sql_store(dialect *sqlDialect, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if dialect == dialectSqlite {
+		// one writer at a time, avoids "database is locked" under concurrent requests
+		db.SetMaxOpenConns(1)
+	}
+
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+func (store *sqlStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *sqlStore) exec(runner sqlRunner, query string, args ...interface{}) (sql.Result, error) {
+	return runner.Exec(store.dialect.rebind(query), args...)
+}
+
+func (store *sqlStore) query(runner sqlRunner, query string, args ...interface{}) (*sql.Rows, error) {
+	return runner.Query(store.dialect.rebind(query), args...)
+}
+
+func (store *sqlStore) queryRow(runner sqlRunner, query string, args ...interface{}) *sql.Row {
+	return runner.QueryRow(store.dialect.rebind(query), args...)
+}
+
+// insert runs an INSERT and returns the id of the new row.
+func (store *sqlStore) insert(runner sqlRunner, query string, args ...interface{}) (int64, error) {
+	if store.dialect == dialectPostgres {
+		var id int64
+		err := store.queryRow(runner, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := store.exec(runner, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure in either driver.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+
+	return false
+}
+
+// nullIfEmpty stores "" as NULL, used for UNIQUE columns that are optional.
+func nullIfEmpty(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: len(value) > 0}
+}
+
+/* accounts */
+
+func (store *sqlStore) CreateAccount(username string, nickname string, question string, answer string, passwordHash string) error {
+	// the username of a deleted account is never given out again
+	statement := "INSERT INTO accounts(username,nickname,security_question,security_answer,password,new_message) " +
+		"SELECT ?,?,?,?,?,0 WHERE NOT EXISTS(SELECT username FROM deleted_usernames WHERE username = ?)"
+
+	result, err := store.exec(store.db, statement, username, nullIfEmpty(nickname), question, answer, passwordHash, username)
+	if isUniqueViolation(err) {
+		if strings.Contains(err.Error(), "nickname") {
+			return errNicknameTaken
+		}
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return errUserExists
+	}
+
+	return nil
+}
+
+func (store *sqlStore) UserExists(username string) bool {
+	var result bool
+
+	err := store.queryRow(store.db, "SELECT EXISTS(SELECT id FROM accounts WHERE username = ?)", username).Scan(&result)
+	if err != nil {
+		return false
+	}
+
+	return result
+}
+
+func (store *sqlStore) GetPasswordHash(username string) (string, error) {
+	var password string
+
+	err := store.queryRow(store.db, "SELECT COALESCE(password,'') FROM accounts WHERE username = ?", username).Scan(&password)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return password, err
+}
+
+func (store *sqlStore) SetPasswordHash(username string, encoded string) error {
+	_, err := store.exec(store.db, "UPDATE accounts SET password = ? WHERE username = ?", encoded, username)
+	return err
+}
+
+func (store *sqlStore) GetControlUserRow(username string) (map[string]string, error) {
+	statement := "SELECT id,COALESCE(security_question,''),COALESCE(security_answer,'') FROM accounts WHERE username = ?"
+
+	var id int64
+	var security_question string
+	var security_answer string
+
+	err := store.queryRow(store.db, statement, username).Scan(&id, &security_question, &security_answer)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	userRow := make(map[string]string)
+	userRow["id"] = strconv.FormatInt(id, 10)
+	userRow["security_question"] = security_question
+	userRow["security_answer"] = security_answer
+
+	return userRow, nil
+}
+
+func (store *sqlStore) GetUserRow(username string) (map[string]string, error) {
+	statement := "SELECT id,COALESCE(nickname,''),COALESCE(gender,''),COALESCE(new_message,0) FROM accounts WHERE username = ?"
+
+	var id int64
+	var nickname string
+	var gender string
+	var new_message int
+
+	err := store.queryRow(store.db, statement, username).Scan(&id, &nickname, &gender, &new_message)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	userRow := make(map[string]string)
+	userRow["id"] = strconv.FormatInt(id, 10)
+	userRow["nickname"] = nickname
+	userRow["gender"] = gender
+	userRow["new_message"] = strconv.Itoa(new_message)
+
+	return userRow, nil
+}
+
+func (store *sqlStore) DeleteUser(username string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM accounts WHERE username = ?", username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "INSERT INTO deleted_usernames(username,deleted) VALUES(?,?)", username, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM contacts WHERE username = ? OR contact = ?", username, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM friend_requests WHERE from_user = ? OR to_user = ?", username, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM blocks WHERE username = ? OR blocked = ?", username, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM hidden_messages WHERE username = ?", username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM conversation_deletions WHERE username = ?", username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM login_failures WHERE kind = ? AND name = ?", loginKindUser, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// leaving every room like leaveroom, the settings of rooms go with it
+	rooms := make([]int64, 0)
+
+	rows, err := store.query(tx, "SELECT room_id FROM room_members WHERE username = ?", username)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for rows.Next() {
+		var room_id int64
+		if err = rows.Scan(&room_id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		rooms = append(rooms, room_id)
+	}
+	rows.Close()
+
+	for _, room_id := range rooms {
+		if err = store.removeRoomMember(tx, room_id, username); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM conversation_settings WHERE username = ?", username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *sqlStore) ListAccounts() ([]map[string]string, error) {
+	rows, err := store.query(store.db, "SELECT id,username,COALESCE(nickname,''),COALESCE(password,''),COALESCE(disabled,0) FROM accounts ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var id int64
+	var username string
+	var nickname string
+	var password string
+	var disabled int
+
+	accounts := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&id, &username, &nickname, &password, &disabled); err != nil {
+			return nil, err
+		}
+		account := make(map[string]string)
+		account["id"] = strconv.FormatInt(id, 10)
+		account["username"] = username
+		account["nickname"] = nickname
+		account["password"] = password
+		account["disabled"] = strconv.Itoa(disabled)
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+func (store *sqlStore) SetAccountDisabled(username string, disabled bool) error {
+	result, err := store.exec(store.db, "UPDATE accounts SET disabled = ? WHERE username = ?", boolToInt(disabled), username)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errUserNotFound.withDetail(username)
+	}
+
+	return nil
+}
+
+func (store *sqlStore) AccountDisabled(username string) (bool, error) {
+	var disabled int
+
+	err := store.queryRow(store.db, "SELECT COALESCE(disabled,0) FROM accounts WHERE username = ?", username).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return disabled != 0, err
+}
+
+/* new message flag */
+
+func (store *sqlStore) SetNewMessageFlag(username string, value int) error {
+	_, err := store.exec(store.db, "UPDATE accounts SET new_message = ? WHERE username = ?", value, username)
+	return err
+}
+
+func (store *sqlStore) GetNewMessageFlag(username string) (int, error) {
+	var new_message int
+
+	err := store.queryRow(store.db, "SELECT COALESCE(new_message,0) FROM accounts WHERE username = ?", username).Scan(&new_message)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return new_message, err
+}
+
+/* one-to-one messages */
+
+// messageColumns is the select list read by scanMessageRows.
+const messageColumns = "id,to_user,from_user,body,time,room_id,delivered_at,read_at,edited_at,deleted_at"
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessageRows reads messageColumns rows into reply maps, see scanMessageRow.
+func scanMessageRows(rows *sql.Rows) ([]map[string]string, error) {
+	listOfRows := make([]map[string]string, 0)
+
+	for rows.Next() {
+		row, err := scanMessageRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		listOfRows = append(listOfRows, row)
+	}
+
+	return listOfRows, rows.Err()
+}
+
+// scanMessageRow reads one messageColumns row, extra receives any further
+// columns. room_id and the *_at times are only set when not NULL.
+func scanMessageRow(scanner rowScanner, extra ...interface{}) (map[string]string, error) {
+	var id int64
+	var to_user string
+	var from_user string
+	var body string
+	var msgtime string
+	var room_id sql.NullInt64
+	var delivered_at sql.NullInt64
+	var read_at sql.NullInt64
+	var edited_at sql.NullInt64
+	var deleted_at sql.NullInt64
+
+	dest := append([]interface{}{&id, &to_user, &from_user, &body, &msgtime, &room_id, &delivered_at, &read_at, &edited_at, &deleted_at}, extra...)
+	if err := scanner.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(id, 10)
+	row["to_user"] = to_user
+	row["from_user"] = from_user
+	row["body"] = body
+	row["date"] = msgtime
+	if room_id.Valid {
+		row["room_id"] = strconv.FormatInt(room_id.Int64, 10)
+	}
+	if delivered_at.Valid {
+		row["delivered_at"] = strconv.FormatInt(delivered_at.Int64, 10)
+	}
+	if read_at.Valid {
+		row["read_at"] = strconv.FormatInt(read_at.Int64, 10)
+	}
+	if edited_at.Valid {
+		row["edited_at"] = strconv.FormatInt(edited_at.Int64, 10)
+	}
+	if deleted_at.Valid {
+		row["deleted_at"] = strconv.FormatInt(deleted_at.Int64, 10)
+	}
+	return row, nil
+}
+
+func (store *sqlStore) SendMessage(to_user string, from_user string, body string, attachments []int64) (map[string]string, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	msgtime := now.String()
+
+	id, err := store.insert(tx, "INSERT INTO messages(to_user,from_user,body,time,created) VALUES(?,?,?,?,?)", to_user, from_user, body, msgtime, now.Unix())
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = store.exec(tx, "UPDATE accounts SET new_message = 1 WHERE username = ?", to_user); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = store.bindAttachments(tx, id, from_user, attachments); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(id, 10)
+	row["to_user"] = to_user
+	row["from_user"] = from_user
+	row["body"] = body
+	row["date"] = msgtime
+	if len(attachments) > 0 {
+		row["attachments"] = formatIdList(attachments)
+	}
+
+	return row, nil
+}
+
+// hiddenPeers selects the users whose history username hid by blocking them.
+const hiddenPeers = "SELECT blocked FROM blocks WHERE username = ? AND hide_history = 1"
+
+// deletedUpTo is username's deletion watermark in the conversation of a
+// one-to-one message, 0 without one. It takes username twice.
+const deletedUpTo = "COALESCE((SELECT upto_id FROM conversation_deletions WHERE username = ? AND peer = CASE WHEN to_user = ? THEN from_user ELSE to_user END), 0)"
+
+// notHidden keeps one-to-one messages out of hidden conversations and
+// from before username deleted them, it takes username four times.
+const notHidden = "to_user NOT IN (" + hiddenPeers + ") AND from_user NOT IN (" + hiddenPeers + ") AND id > " + deletedUpTo
+
+// notDeletedForUser keeps out the messages username deleted for themselves, it takes username.
+const notDeletedForUser = "id NOT IN (SELECT message_id FROM hidden_messages WHERE username = ?)"
+
+func (store *sqlStore) GetAllMessages(username string) ([]map[string]string, error) {
+	statement := "SELECT " + messageColumns + " FROM "
+	statement += "(SELECT " + messageColumns + " FROM messages WHERE (to_user = ? OR from_user = ?) AND room_id IS NULL AND " + notHidden + " AND " + notDeletedForUser + " ORDER BY id DESC LIMIT 100) AS newest "
+	statement += "ORDER BY id ASC"
+
+	rows, err := store.query(store.db, statement, username, username, username, username, username, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessageRows(rows)
+}
+
+func (store *sqlStore) GetMessages(username string, peer string, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error) {
+	if len(peer) > 0 {
+		where := "((to_user = ? AND from_user = ?) OR (to_user = ? AND from_user = ?)) AND room_id IS NULL AND " + notHidden + " AND " + notDeletedForUser
+		return store.queryMessagePage(where, []interface{}{username, peer, peer, username, username, username, username, username, username}, since_id, before_id, limit)
+	}
+
+	where := "(to_user = ? OR from_user = ?) AND room_id IS NULL AND " + notHidden + " AND " + notDeletedForUser
+	return store.queryMessagePage(where, []interface{}{username, username, username, username, username, username, username}, since_id, before_id, limit)
+}
+
+// queryMessagePage runs a paged messages query restricted by where, see get_messages.
+func (store *sqlStore) queryMessagePage(where string, whereArgs []interface{}, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error) {
+	statement := "SELECT " + messageColumns + " FROM messages WHERE " + where
+	args := append([]interface{}{}, whereArgs...)
+
+	forward := since_id > 0
+
+	if forward {
+		statement += " AND id > ? ORDER BY id ASC LIMIT ?"
+		args = append(args, since_id)
+	} else if before_id > 0 {
+		statement += " AND id < ? ORDER BY id DESC LIMIT ?"
+		args = append(args, before_id)
+	} else {
+		statement += " ORDER BY id DESC LIMIT ?"
+	}
+
+	// one extra row tells us whether there is another page
+	args = append(args, limit+1)
+
+	rows, err := store.query(store.db, statement, args...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	listOfRows, err := scanMessageRows(rows)
+	rows.Close()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	listOfRows, hasMore := trimMessagePage(listOfRows, limit, forward)
+	return listOfRows, hasMore, nil
+}
+
+// trimMessagePage drops the look-ahead row and puts a backward page in ascending order.
+func trimMessagePage(listOfRows []map[string]string, limit int, forward bool) ([]map[string]string, bool) {
+	hasMore := len(listOfRows) > limit
+	if hasMore {
+		listOfRows = listOfRows[:limit]
+	}
+
+	if !forward {
+		for i, j := 0, len(listOfRows)-1; i < j; i, j = i+1, j-1 {
+			listOfRows[i], listOfRows[j] = listOfRows[j], listOfRows[i]
+		}
+	}
+
+	return listOfRows, hasMore
+}
+
+/* conversation deletion */
+
+func (store *sqlStore) DeleteConversation(username string, peer string, at time.Time) (int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var newest int64
+	var upto_id int64
+	var deleted int64
+
+	statement := "SELECT COALESCE(MAX(id), 0) FROM messages WHERE ((to_user = ? AND from_user = ?) OR (to_user = ? AND from_user = ?)) AND room_id IS NULL"
+	if err = store.queryRow(tx, statement, peer, username, username, peer).Scan(&newest); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = store.queryRow(tx, "SELECT upto_id, deleted FROM conversation_deletions WHERE username = ? AND peer = ?", username, peer).Scan(&upto_id, &deleted)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// nothing new to delete, an undo would bring back the earlier deletion
+	if newest <= upto_id {
+		return newest, tx.Commit()
+	}
+
+	statement = "INSERT INTO conversation_deletions(username,peer,upto_id,previous_id,deleted,previous_deleted) VALUES(?,?,?,?,?,?) "
+	statement += "ON CONFLICT(username, peer) DO UPDATE SET upto_id = excluded.upto_id, previous_id = excluded.previous_id, "
+	statement += "deleted = excluded.deleted, previous_deleted = excluded.previous_deleted"
+
+	if _, err = store.exec(tx, statement, username, peer, newest, upto_id, at.Unix(), deleted); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return newest, tx.Commit()
+}
+
+func (store *sqlStore) RestoreConversation(username string, peer string, since time.Time) (bool, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var previous_id int64
+	var deleted int64
+
+	err = store.queryRow(tx, "SELECT previous_id, deleted FROM conversation_deletions WHERE username = ? AND peer = ?", username, peer).Scan(&previous_id, &deleted)
+	if err == sql.ErrNoRows || (err == nil && deleted < since.Unix()) {
+		return false, tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	// back to the deletion before, as of when it was made
+	if previous_id > 0 {
+		statement := "UPDATE conversation_deletions SET upto_id = previous_id, deleted = previous_deleted, previous_id = 0, previous_deleted = 0 "
+		statement += "WHERE username = ? AND peer = ?"
+		_, err = store.exec(tx, statement, username, peer)
+	} else {
+		_, err = store.exec(tx, "DELETE FROM conversation_deletions WHERE username = ? AND peer = ?", username, peer)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (store *sqlStore) PurgeConversations(before time.Time) (int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// every pair once, a conversation with oneself joins its own row
+	statement := "SELECT a.username, a.peer, CASE WHEN a.upto_id < b.upto_id THEN a.upto_id ELSE b.upto_id END "
+	statement += "FROM conversation_deletions a JOIN conversation_deletions b ON b.username = a.peer AND b.peer = a.username "
+	statement += "WHERE a.username <= a.peer AND a.deleted < ? AND b.deleted < ?"
+
+	rows, err := store.query(tx, statement, before.Unix(), before.Unix())
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	type purge struct {
+		username string
+		peer     string
+		upto_id  int64
+	}
+
+	purges := make([]purge, 0)
+	for rows.Next() {
+		var p purge
+		if err = rows.Scan(&p.username, &p.peer, &p.upto_id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		purges = append(purges, p)
+	}
+	rows.Close()
+
+	var removed int64
+
+	statement = "DELETE FROM messages WHERE ((to_user = ? AND from_user = ?) OR (to_user = ? AND from_user = ?)) AND room_id IS NULL AND id <= ?"
+	for _, p := range purges {
+		result, err := store.exec(tx, statement, p.peer, p.username, p.username, p.peer, p.upto_id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		removed += n
+	}
+
+	if removed > 0 {
+		if err = store.dropMessageLeftovers(tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return removed, tx.Commit()
+}
+
+// dropMessageLeftovers removes the revisions and hidden marks of messages that are gone.
+func (store *sqlStore) dropMessageLeftovers(tx *sql.Tx) error {
+	if _, err := store.exec(tx, "DELETE FROM message_revisions WHERE message_id NOT IN (SELECT id FROM messages)"); err != nil {
+		return err
+	}
+
+	_, err := store.exec(tx, "DELETE FROM hidden_messages WHERE message_id NOT IN (SELECT id FROM messages)")
+	return err
+}
+
+/* edits and deletions */
+
+func (store *sqlStore) GetMessage(id int64) (map[string]string, error) {
+	var created int64
+
+	statement := "SELECT " + messageColumns + ",COALESCE(created, 0) FROM messages WHERE id = ?"
+
+	row, err := scanMessageRow(store.queryRow(store.db, statement, id), &created)
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	row["created"] = strconv.FormatInt(created, 10)
+	return row, nil
+}
+
+func (store *sqlStore) EditMessage(id int64, body string, at time.Time) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	statement := "INSERT INTO message_revisions(message_id,body,replaced) SELECT id, body, ? FROM messages WHERE id = ?"
+	if _, err = store.exec(tx, statement, at.Unix(), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "UPDATE messages SET body = ?, edited_at = ? WHERE id = ?", body, at.Unix(), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *sqlStore) GetMessageRevisions(id int64) ([]map[string]string, error) {
+	rows, err := store.query(store.db, "SELECT body, replaced FROM message_revisions WHERE message_id = ? ORDER BY id ASC", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var body string
+	var replaced int64
+
+	revisions := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&body, &replaced); err != nil {
+			return nil, err
+		}
+		revision := make(map[string]string)
+		revision["body"] = body
+		revision["replaced"] = strconv.FormatInt(replaced, 10)
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (store *sqlStore) DeleteMessage(id int64, at time.Time) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = store.exec(tx, "UPDATE messages SET body = '', deleted_at = ? WHERE id = ?", at.Unix(), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM message_revisions WHERE message_id = ?", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *sqlStore) HideMessage(username string, id int64) error {
+	statement := "INSERT INTO hidden_messages(username,message_id) VALUES(?,?) ON CONFLICT(username, message_id) DO NOTHING"
+
+	_, err := store.exec(store.db, statement, username, id)
+	return err
+}
+
+/* receipts */
+
+func (store *sqlStore) MarkDelivered(username string, peer string, upto_id int64, at time.Time) (int64, int64, error) {
+	return store.markMessages("delivered_at", username, peer, upto_id, at)
+}
+
+func (store *sqlStore) MarkRead(username string, peer string, upto_id int64, at time.Time) (int64, int64, error) {
+	return store.markMessages("read_at", username, peer, upto_id, at)
+}
+
+// markMessages stamps column ("delivered_at" or "read_at") with at, see MarkDelivered.
+func (store *sqlStore) markMessages(column string, username string, peer string, upto_id int64, at time.Time) (int64, int64, error) {
+	set := column + " = ?"
+	setArgs := []interface{}{at.Unix()}
+
+	if column == "read_at" {
+		// a message read without a delivery receipt was delivered just now
+		set += ", delivered_at = COALESCE(delivered_at, ?)"
+		setArgs = append(setArgs, at.Unix())
+	}
+
+	where := "to_user = ? AND from_user = ? AND room_id IS NULL AND " + column + " IS NULL"
+	whereArgs := []interface{}{username, peer}
+
+	if upto_id > 0 {
+		where += " AND id <= ?"
+		whereArgs = append(whereArgs, upto_id)
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var last sql.NullInt64
+	if err = store.queryRow(tx, "SELECT MAX(id) FROM messages WHERE "+where, whereArgs...).Scan(&last); err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+
+	if !last.Valid {
+		return 0, 0, tx.Commit()
+	}
+
+	args := append(setArgs, whereArgs...)
+	args = append(args, last.Int64)
+
+	result, err := store.exec(tx, "UPDATE messages SET "+set+" WHERE "+where+" AND id <= ?", args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+
+	return n, last.Int64, tx.Commit()
+}
+
+func (store *sqlStore) GetUnreadCounts(username string) ([]map[string]string, error) {
+	statement := "SELECT from_user, COUNT(*), MAX(id) FROM messages "
+	statement += "WHERE to_user = ? AND read_at IS NULL AND room_id IS NULL AND from_user NOT IN (" + hiddenPeers + ") AND id > " + deletedUpTo + " AND " + notDeletedForUser + " "
+	statement += "GROUP BY from_user ORDER BY MAX(id) DESC"
+
+	rows, err := store.query(store.db, statement, username, username, username, username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peer string
+	var unread int64
+	var last_id int64
+
+	counts := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&peer, &unread, &last_id); err != nil {
+			return nil, err
+		}
+		count := make(map[string]string)
+		count["peer"] = peer
+		count["unread"] = strconv.FormatInt(unread, 10)
+		count["last_id"] = strconv.FormatInt(last_id, 10)
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
+
+/* search */
+
+func (store *sqlStore) SearchMessages(username string, query *searchQuery, before_id int64, limit int) ([]map[string]string, bool, error) {
+	columns := "m." + strings.ReplaceAll(messageColumns, ",", ",m.")
+
+	var statement string
+	var args []interface{}
+
+	if store.dialect == dialectPostgres {
+		headline := "StartSel=" + searchMarkStart + ", StopSel=" + searchMarkEnd + ", MaxWords=" + strconv.Itoa(searchSnippetWords) + ", MinWords=4, ShortWord=1"
+		statement = "SELECT " + columns + ", ts_headline('simple', m.body, q, '" + headline + "') "
+		statement += "FROM messages m, to_tsquery('simple', ?) q WHERE to_tsvector('simple', m.body) @@ q"
+		args = append(args, tsQuery(query.terms))
+	} else {
+		statement = "SELECT " + columns + ", snippet(messages_fts, 0, ?, ?, '…', ?) "
+		statement += "FROM messages_fts JOIN messages m ON m.id = messages_fts.rowid WHERE messages_fts MATCH ?"
+		args = append(args, searchMarkStart, searchMarkEnd, searchSnippetWords, ftsMatch(query.terms))
+	}
+
+	// only conversations username takes part in
+	statement += " AND ((m.room_id IS NULL AND (m.to_user = ? OR m.from_user = ?)) OR m.room_id IN (SELECT room_id FROM room_members WHERE username = ?))"
+	statement += " AND (m.room_id IS NOT NULL OR (m.to_user NOT IN (" + hiddenPeers + ") AND m.from_user NOT IN (" + hiddenPeers + ") AND m.id > " + deletedUpTo + "))"
+	statement += " AND m." + notDeletedForUser
+	args = append(args, username, username, username, username, username, username, username, username)
+
+	if len(query.peer) > 0 {
+		statement += " AND m.room_id IS NULL AND (m.to_user = ? OR m.from_user = ?)"
+		args = append(args, query.peer, query.peer)
+	}
+	if query.room_id > 0 {
+		statement += " AND m.room_id = ?"
+		args = append(args, query.room_id)
+	}
+	if query.since > 0 {
+		statement += " AND m.created >= ?"
+		args = append(args, query.since)
+	}
+	if query.until > 0 {
+		statement += " AND m.created < ?"
+		args = append(args, query.until)
+	}
+	if before_id > 0 {
+		statement += " AND m.id < ?"
+		args = append(args, before_id)
+	}
+
+	// one extra row tells us whether there is another page
+	statement += " ORDER BY m.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := store.query(store.db, statement, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	listOfRows := make([]map[string]string, 0)
+	for rows.Next() {
+		var snippet string
+		row, err := scanMessageRow(rows, &snippet)
+		if err != nil {
+			return nil, false, err
+		}
+		row["snippet"] = snippet
+		listOfRows = append(listOfRows, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(listOfRows) > limit
+	if hasMore {
+		listOfRows = listOfRows[:limit]
+	}
+
+	return listOfRows, hasMore, nil
+}
+
+/* conversation list */
+
+func (store *sqlStore) GetConversations(username string) ([]map[string]string, error) {
+	snippet := "SUBSTR(m.body, 1, " + strconv.Itoa(conversationSnippetLength) + ")"
+
+	// the newest message per peer, from whichever side sent it last
+	statement := "SELECT latest.peer, m.id, m.from_user, " + snippet + ", m.time, "
+	statement += "(SELECT COUNT(*) FROM messages u WHERE u.to_user = ? AND u.from_user = latest.peer AND u.room_id IS NULL AND u.read_at IS NULL "
+	statement += "AND u.id > COALESCE((SELECT upto_id FROM conversation_deletions WHERE username = ? AND peer = latest.peer), 0) AND u." + notDeletedForUser + "), "
+	statement += "COALESCE(s.muted, 0), COALESCE(s.archived, 0) "
+	statement += "FROM (SELECT peer, MAX(id) AS id FROM ("
+	statement += "SELECT from_user AS peer, MAX(id) AS id FROM messages WHERE to_user = ? AND room_id IS NULL AND id > " + deletedUpTo + " GROUP BY from_user "
+	statement += "UNION ALL "
+	statement += "SELECT to_user AS peer, MAX(id) AS id FROM messages WHERE from_user = ? AND room_id IS NULL AND id > " + deletedUpTo + " GROUP BY to_user"
+	statement += ") AS sides GROUP BY peer) AS latest "
+	statement += "JOIN messages m ON m.id = latest.id "
+	statement += "LEFT JOIN conversation_settings s ON s.username = ? AND s.peer = latest.peer AND s.room_id = 0 "
+	statement += "WHERE latest.peer NOT IN (" + hiddenPeers + ")"
+
+	conversations, err := store.queryConversations(false, statement, username, username, username, username, username, username, username, username, username, username, username)
+	if err != nil {
+		return nil, err
+	}
+
+	statement = "SELECT r.id, r.name, COALESCE(m.id, 0), COALESCE(m.from_user, ''), COALESCE(" + snippet + ", ''), COALESCE(m.time, ''), "
+	statement += "(SELECT COUNT(*) FROM messages u WHERE u.room_id = r.id AND u.id > COALESCE(rm.last_read_id, 0) AND u.from_user <> ? AND u." + notDeletedForUser + "), "
+	statement += "COALESCE(s.muted, 0), COALESCE(s.archived, 0) "
+	statement += "FROM room_members rm JOIN rooms r ON r.id = rm.room_id "
+	statement += "LEFT JOIN messages m ON m.id = (SELECT MAX(id) FROM messages WHERE room_id = r.id) "
+	statement += "LEFT JOIN conversation_settings s ON s.username = rm.username AND s.peer = '' AND s.room_id = r.id "
+	statement += "WHERE rm.username = ?"
+
+	rooms, err := store.queryConversations(true, statement, username, username, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortConversations(append(conversations, rooms...)), nil
+}
+
+// queryConversations reads GetConversations rows, which start with the peer or the room id and name.
+func (store *sqlStore) queryConversations(rooms bool, statement string, args ...interface{}) ([]map[string]string, error) {
+	rows, err := store.query(store.db, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peer string
+	var room_id int64
+	var name string
+	var last_id int64
+	var last_from string
+	var snippet string
+	var date string
+	var unread int64
+	var muted int
+	var archived int
+
+	conversations := make([]map[string]string, 0)
+	for rows.Next() {
+		if rooms {
+			err = rows.Scan(&room_id, &name, &last_id, &last_from, &snippet, &date, &unread, &muted, &archived)
+		} else {
+			err = rows.Scan(&peer, &last_id, &last_from, &snippet, &date, &unread, &muted, &archived)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		conversation := make(map[string]string)
+		if rooms {
+			conversation["type"] = "room"
+			conversation["room_id"] = strconv.FormatInt(room_id, 10)
+			conversation["name"] = name
+		} else {
+			conversation["type"] = "peer"
+			conversation["peer"] = peer
+		}
+		conversation["last_id"] = strconv.FormatInt(last_id, 10)
+		conversation["last_from"] = last_from
+		conversation["snippet"] = snippet
+		conversation["date"] = date
+		conversation["unread"] = strconv.FormatInt(unread, 10)
+		conversation["muted"] = strconv.Itoa(muted)
+		conversation["archived"] = strconv.Itoa(archived)
+		conversations = append(conversations, conversation)
+	}
+
+	return conversations, rows.Err()
+}
+
+func (store *sqlStore) GetConversationState(username string, peer string, room_id int64) (bool, bool, error) {
+	var muted int
+	var archived int
+
+	statement := "SELECT COALESCE(muted, 0), COALESCE(archived, 0) FROM conversation_settings WHERE username = ? AND peer = ? AND room_id = ?"
+
+	err := store.queryRow(store.db, statement, username, peer, room_id).Scan(&muted, &archived)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+
+	return muted != 0, archived != 0, err
+}
+
+func (store *sqlStore) SetConversationState(username string, peer string, room_id int64, muted bool, archived bool) error {
+	statement := "INSERT INTO conversation_settings(username,peer,room_id,muted,archived) VALUES(?,?,?,?,?) "
+	statement += "ON CONFLICT(username, peer, room_id) DO UPDATE SET muted = excluded.muted, archived = excluded.archived"
+
+	_, err := store.exec(store.db, statement, username, peer, room_id, boolToInt(muted), boolToInt(archived))
+	return err
+}
+
+func (store *sqlStore) MarkRoomRead(room_id int64, username string, upto_id int64) (int64, int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var marker int64
+	var newest int64
+
+	statement := "SELECT COALESCE(last_read_id, 0), (SELECT COALESCE(MAX(id), 0) FROM messages WHERE room_id = ?) "
+	statement += "FROM room_members WHERE room_id = ? AND username = ?"
+
+	if err = store.queryRow(tx, statement, room_id, room_id, username).Scan(&marker, &newest); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return 0, 0, errNotRoomMember
+		}
+		return 0, 0, err
+	}
+
+	if upto_id == 0 || upto_id > newest {
+		upto_id = newest
+	}
+
+	if upto_id <= marker {
+		return 0, marker, tx.Commit()
+	}
+
+	var count int64
+
+	statement = "SELECT COUNT(*) FROM messages WHERE room_id = ? AND id > ? AND id <= ? AND from_user <> ?"
+	if err = store.queryRow(tx, statement, room_id, marker, upto_id, username).Scan(&count); err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+
+	if _, err = store.exec(tx, "UPDATE room_members SET last_read_id = ? WHERE room_id = ? AND username = ?", upto_id, room_id, username); err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+
+	return count, upto_id, tx.Commit()
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+/* sessions */
+
+func (store *sqlStore) CreateSession(tokenHash string, username string, created time.Time, expires time.Time) error {
+	statement := "INSERT INTO sessions(token_hash,username,created,expires,last_seen) VALUES(?,?,?,?,?)"
+
+	_, err := store.exec(store.db, statement, tokenHash, username, created.Unix(), expires.Unix(), created.Unix())
+	return err
+}
+
+func (store *sqlStore) GetSession(tokenHash string) (string, time.Time, time.Time, error) {
+	var username string
+	var expires int64
+	var lastSeen int64
+
+	err := store.queryRow(store.db, "SELECT username,expires,last_seen FROM sessions WHERE token_hash = ?", tokenHash).Scan(&username, &expires, &lastSeen)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, time.Time{}, errInvalidSession
+	}
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+
+	return username, time.Unix(expires, 0), time.Unix(lastSeen, 0), nil
+}
+
+func (store *sqlStore) TouchSession(tokenHash string, lastSeen time.Time) error {
+	_, err := store.exec(store.db, "UPDATE sessions SET last_seen = ? WHERE token_hash = ?", lastSeen.Unix(), tokenHash)
+	return err
+}
+
+func (store *sqlStore) DeleteSession(tokenHash string) (bool, error) {
+	result, err := store.exec(store.db, "DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) DeleteUserSessions(username string) (int64, error) {
+	result, err := store.exec(store.db, "DELETE FROM sessions WHERE username = ?", username)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (store *sqlStore) PurgeExpiredSessions(now time.Time) error {
+	_, err := store.exec(store.db, "DELETE FROM sessions WHERE expires <= ?", now.Unix())
+	return err
+}
+
+/* failed logins */
+
+func (store *sqlStore) GetLoginFailures(kind string, name string) (int, time.Time, error) {
+	var failures int
+	var last int64
+
+	statement := "SELECT failures,last_failure FROM login_failures WHERE kind = ? AND name = ?"
+
+	err := store.queryRow(store.db, statement, kind, name).Scan(&failures, &last)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return failures, time.Unix(last, 0), nil
+}
+
+func (store *sqlStore) RecordLoginFailure(kind string, name string, at time.Time, forgetBefore time.Time) (int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	statement := "INSERT INTO login_failures(kind,name,failures,last_failure) VALUES(?,?,1,?) "
+	statement += "ON CONFLICT(kind, name) DO UPDATE SET failures = CASE WHEN login_failures.last_failure < ? THEN 1 "
+	statement += "ELSE login_failures.failures + 1 END, last_failure = excluded.last_failure"
+
+	if _, err = store.exec(tx, statement, kind, name, at.Unix(), forgetBefore.Unix()); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var failures int
+	err = store.queryRow(tx, "SELECT failures FROM login_failures WHERE kind = ? AND name = ?", kind, name).Scan(&failures)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return failures, tx.Commit()
+}
+
+func (store *sqlStore) ClearLoginFailures(kind string, name string) (bool, error) {
+	result, err := store.exec(store.db, "DELETE FROM login_failures WHERE kind = ? AND name = ?", kind, name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) ListLoginFailures(since time.Time) ([]map[string]string, error) {
+	statement := "SELECT kind,name,failures,last_failure FROM login_failures WHERE last_failure >= ? ORDER BY last_failure DESC"
+
+	rows, err := store.query(store.db, statement, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]map[string]string, 0)
+	for rows.Next() {
+		var kind, name string
+		var failures, last int64
+
+		if err = rows.Scan(&kind, &name, &failures, &last); err != nil {
+			return nil, err
+		}
+
+		list = append(list, map[string]string{
+			"kind":         kind,
+			"name":         name,
+			"failures":     strconv.FormatInt(failures, 10),
+			"last_failure": strconv.FormatInt(last, 10),
+		})
+	}
+
+	return list, rows.Err()
+}
+
+func (store *sqlStore) PurgeLoginFailures(before time.Time) error {
+	_, err := store.exec(store.db, "DELETE FROM login_failures WHERE last_failure < ?", before.Unix())
+	return err
+}
+
+/* rooms */
+
+func (store *sqlStore) CreateRoom(name string, owner string, public bool, members []string) (int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+
+	room_id, err := store.insert(tx, "INSERT INTO rooms(name,owner,public,created) VALUES(?,?,?,?)", name, owner, boolToInt(public), now)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	statement := "INSERT INTO room_members(room_id,username,role,joined) VALUES(?,?,?,?) ON CONFLICT DO NOTHING"
+
+	if _, err = store.exec(tx, statement, room_id, owner, roomRoleOwner, now); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, member := range members {
+		if _, err = store.exec(tx, statement, room_id, member, roomRoleMember, now); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return room_id, tx.Commit()
+}
+
+func (store *sqlStore) GetRoom(room_id int64) (map[string]string, error) {
+	var name string
+	var owner string
+	var public int
+	var created int64
+
+	err := store.queryRow(store.db, "SELECT name,owner,public,created FROM rooms WHERE id = ?", room_id).Scan(&name, &owner, &public, &created)
+	if err == sql.ErrNoRows {
+		return nil, errRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	room := make(map[string]string)
+	room["id"] = strconv.FormatInt(room_id, 10)
+	room["name"] = name
+	room["owner"] = owner
+	room["public"] = strconv.Itoa(public)
+	room["created"] = strconv.FormatInt(created, 10)
+
+	return room, nil
+}
+
+func (store *sqlStore) GetRoomRole(room_id int64, username string) (string, error) {
+	var role string
+
+	err := store.queryRow(store.db, "SELECT role FROM room_members WHERE room_id = ? AND username = ?", room_id, username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return role, err
+}
+
+func (store *sqlStore) GetRoomMembers(room_id int64) ([]map[string]string, error) {
+	statement := "SELECT username,role,joined FROM room_members WHERE room_id = ? "
+	statement += "ORDER BY CASE WHEN role = 'owner' THEN 0 ELSE 1 END, joined ASC, username ASC"
+
+	rows, err := store.query(store.db, statement, room_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var username string
+	var role string
+	var joined int64
+
+	members := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&username, &role, &joined); err != nil {
+			return nil, err
+		}
+		member := make(map[string]string)
+		member["username"] = username
+		member["role"] = role
+		member["joined"] = strconv.FormatInt(joined, 10)
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (store *sqlStore) GetUserRooms(username string) ([]map[string]string, error) {
+	statement := "SELECT r.id,r.name,r.owner,r.public,m.role,"
+	statement += "(SELECT COUNT(*) FROM room_members c WHERE c.room_id = r.id) "
+	statement += "FROM rooms r JOIN room_members m ON m.room_id = r.id "
+	statement += "WHERE m.username = ? ORDER BY r.name ASC"
+
+	rows, err := store.query(store.db, statement, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var id int64
+	var name string
+	var owner string
+	var public int
+	var role string
+	var count int
+
+	rooms := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&id, &name, &owner, &public, &role, &count); err != nil {
+			return nil, err
+		}
+		room := make(map[string]string)
+		room["id"] = strconv.FormatInt(id, 10)
+		room["name"] = name
+		room["owner"] = owner
+		room["public"] = strconv.Itoa(public)
+		room["role"] = role
+		room["members"] = strconv.Itoa(count)
+		rooms = append(rooms, room)
+	}
+
+	return rooms, rows.Err()
+}
+
+func (store *sqlStore) AddRoomMember(room_id int64, username string, role string) (bool, error) {
+	// history from before joining is visible but not unread
+	statement := "INSERT INTO room_members(room_id,username,role,joined,last_read_id) "
+	statement += "VALUES(?,?,?,?,(SELECT COALESCE(MAX(id),0) FROM messages WHERE room_id = ?)) ON CONFLICT DO NOTHING"
+
+	result, err := store.exec(store.db, statement, room_id, username, role, time.Now().Unix(), room_id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) SetRoomRole(room_id int64, username string, role string) error {
+	_, err := store.exec(store.db, "UPDATE room_members SET role = ? WHERE room_id = ? AND username = ?", role, room_id, username)
+	return err
+}
+
+func (store *sqlStore) RemoveRoomMember(room_id int64, username string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = store.removeRoomMember(tx, room_id, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// removeRoomMember is RemoveRoomMember inside tx: the last member leaving
+// deletes the room, the last owner leaving promotes the longest member.
+func (store *sqlStore) removeRoomMember(tx *sql.Tx, room_id int64, username string) error {
+	if _, err := store.exec(tx, "DELETE FROM room_members WHERE room_id = ? AND username = ?", room_id, username); err != nil {
+		return err
+	}
+
+	if _, err := store.exec(tx, "DELETE FROM conversation_settings WHERE username = ? AND room_id = ?", username, room_id); err != nil {
+		return err
+	}
+
+	var members int
+	var owners int
+
+	statement := "SELECT COUNT(*), COALESCE(SUM(CASE WHEN role = 'owner' THEN 1 ELSE 0 END), 0) FROM room_members WHERE room_id = ?"
+	if err := store.queryRow(tx, statement, room_id).Scan(&members, &owners); err != nil {
+		return err
+	}
+
+	if members == 0 {
+		if _, err := store.exec(tx, "DELETE FROM messages WHERE room_id = ?", room_id); err != nil {
+			return err
+		}
+		if err := store.dropMessageLeftovers(tx); err != nil {
+			return err
+		}
+		if _, err := store.exec(tx, "DELETE FROM rooms WHERE id = ?", room_id); err != nil {
+			return err
+		}
+		if verbose {
+			log.Printf("Deleted empty room %d\n", room_id)
+		}
+	} else if owners == 0 {
+		statement = "UPDATE room_members SET role = 'owner' WHERE room_id = ? AND username = "
+		statement += "(SELECT username FROM room_members WHERE room_id = ? ORDER BY joined ASC, username ASC LIMIT 1)"
+		if _, err := store.exec(tx, statement, room_id, room_id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *sqlStore) SendRoomMessage(room_id int64, from_user string, body string, attachments []int64) (map[string]string, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	msgtime := now.String()
+
+	id, err := store.insert(tx, "INSERT INTO messages(to_user,from_user,body,time,created,room_id) VALUES('',?,?,?,?,?)", from_user, body, msgtime, now.Unix(), room_id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	statement := "UPDATE accounts SET new_message = 1 WHERE username IN "
+	statement += "(SELECT username FROM room_members WHERE room_id = ? AND username != ?)"
+
+	if _, err = store.exec(tx, statement, room_id, from_user); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = store.bindAttachments(tx, id, from_user, attachments); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(id, 10)
+	row["room_id"] = strconv.FormatInt(room_id, 10)
+	row["to_user"] = ""
+	row["from_user"] = from_user
+	row["body"] = body
+	row["date"] = msgtime
+	if len(attachments) > 0 {
+		row["attachments"] = formatIdList(attachments)
+	}
+
+	return row, nil
+}
+
+func (store *sqlStore) GetRoomMessages(room_id int64, username string, since_id int64, before_id int64, limit int) ([]map[string]string, bool, error) {
+	return store.queryMessagePage("room_id = ? AND "+notDeletedForUser, []interface{}{room_id, username}, since_id, before_id, limit)
+}
+
+/* attachments */
+
+const attachmentColumns = "id,owner,message_id,sha256,size,content_type,filename,created"
+
+// scanAttachmentRow reads one attachmentColumns row, extra receives any further columns.
+func scanAttachmentRow(scanner rowScanner, extra ...interface{}) (map[string]string, error) {
+	var id int64
+	var owner string
+	var message_id int64
+	var sha256 string
+	var size int64
+	var content_type string
+	var filename string
+	var created int64
+
+	dest := append([]interface{}{&id, &owner, &message_id, &sha256, &size, &content_type, &filename, &created}, extra...)
+	if err := scanner.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(id, 10)
+	row["owner"] = owner
+	row["message_id"] = strconv.FormatInt(message_id, 10)
+	row["sha256"] = sha256
+	row["size"] = strconv.FormatInt(size, 10)
+	row["content_type"] = content_type
+	row["filename"] = filename
+	row["created"] = strconv.FormatInt(created, 10)
+	return row, nil
+}
+
+// bindAttachments attaches the unsent uploads of owner to a new message.
+func (store *sqlStore) bindAttachments(tx *sql.Tx, message_id int64, owner string, attachments []int64) error {
+	for _, id := range attachments {
+		result, err := store.exec(tx, "UPDATE attachments SET message_id = ? WHERE id = ? AND owner = ? AND message_id = 0", message_id, id, owner)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n != 1 {
+			return errAttachmentNotFound.withDetail(strconv.FormatInt(id, 10))
+		}
+	}
+
+	return nil
+}
+
+func (store *sqlStore) CreateAttachment(owner string, sha256 string, size int64, content_type string, filename string, created time.Time) (map[string]string, error) {
+	statement := "INSERT INTO attachments(owner,message_id,sha256,size,content_type,filename,created) VALUES(?,0,?,?,?,?,?)"
+
+	id, err := store.insert(store.db, statement, owner, sha256, size, content_type, filename, created.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string)
+	row["id"] = strconv.FormatInt(id, 10)
+	row["owner"] = owner
+	row["message_id"] = "0"
+	row["sha256"] = sha256
+	row["size"] = strconv.FormatInt(size, 10)
+	row["content_type"] = content_type
+	row["filename"] = filename
+	row["created"] = strconv.FormatInt(created.Unix(), 10)
+	return row, nil
+}
+
+func (store *sqlStore) GetAttachment(id int64) (map[string]string, error) {
+	var sent sql.NullInt64
+	var to_user sql.NullString
+	var from_user sql.NullString
+	var room_id sql.NullInt64
+
+	statement := "SELECT a.id,a.owner,a.message_id,a.sha256,a.size,a.content_type,a.filename,a.created,m.id,m.to_user,m.from_user,m.room_id "
+	statement += "FROM attachments a LEFT JOIN messages m ON m.id = a.message_id WHERE a.id = ?"
+
+	row, err := scanAttachmentRow(store.queryRow(store.db, statement, id), &sent, &to_user, &from_user, &room_id)
+	if err == sql.ErrNoRows {
+		return nil, errAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sent.Valid {
+		row["to_user"] = to_user.String
+		row["from_user"] = from_user.String
+		if room_id.Valid {
+			row["room_id"] = strconv.FormatInt(room_id.Int64, 10)
+		}
+	}
+
+	return row, nil
+}
+
+func (store *sqlStore) GetMessageAttachments(message_ids []int64) ([]map[string]string, error) {
+	listOfRows := make([]map[string]string, 0)
+	if len(message_ids) == 0 {
+		return listOfRows, nil
+	}
+
+	args := make([]interface{}, len(message_ids))
+	for i, id := range message_ids {
+		args[i] = id
+	}
+
+	statement := "SELECT " + attachmentColumns + " FROM attachments WHERE message_id IN (?" + strings.Repeat(",?", len(args)-1) + ") ORDER BY id ASC"
+
+	rows, err := store.query(store.db, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row, err := scanAttachmentRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		listOfRows = append(listOfRows, row)
+	}
+
+	return listOfRows, rows.Err()
+}
+
+func (store *sqlStore) GetAttachmentUsage(owner string) (int64, error) {
+	var usage int64
+	err := store.queryRow(store.db, "SELECT COALESCE(SUM(size), 0) FROM attachments WHERE owner = ?", owner).Scan(&usage)
+	return usage, err
+}
+
+func (store *sqlStore) PurgeAttachments(unsentBefore time.Time) ([]string, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	where := "(message_id = 0 AND created < ?) OR "
+	where += "(message_id <> 0 AND NOT EXISTS (SELECT 1 FROM messages WHERE messages.id = attachments.message_id AND messages.deleted_at IS NULL))"
+
+	rows, err := store.query(tx, "SELECT DISTINCT sha256 FROM attachments WHERE "+where, unsentBefore.Unix())
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	candidates := make([]string, 0)
+	for rows.Next() {
+		var sha256 string
+		if err = rows.Scan(&sha256); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		candidates = append(candidates, sha256)
+	}
+	rows.Close()
+
+	if len(candidates) == 0 {
+		return candidates, tx.Commit()
+	}
+
+	if _, err = store.exec(tx, "DELETE FROM attachments WHERE "+where, unsentBefore.Unix()); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	unreferenced := make([]string, 0, len(candidates))
+	for _, sha256 := range candidates {
+		var count int
+		if err = store.queryRow(tx, "SELECT COUNT(*) FROM attachments WHERE sha256 = ?", sha256).Scan(&count); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if count == 0 {
+			unreferenced = append(unreferenced, sha256)
+		}
+	}
+
+	return unreferenced, tx.Commit()
+}
+
+/* contacts */
+
+func (store *sqlStore) GetContacts(username string) ([]map[string]string, error) {
+	statement := "SELECT c.contact,COALESCE(a.nickname,''),c.created FROM contacts c "
+	statement += "LEFT JOIN accounts a ON a.username = c.contact WHERE c.username = ? ORDER BY c.contact ASC"
+
+	rows, err := store.query(store.db, statement, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contact string
+	var nickname string
+	var created int64
+
+	contacts := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&contact, &nickname, &created); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string)
+		row["username"] = contact
+		row["nickname"] = nickname
+		row["since"] = strconv.FormatInt(created, 10)
+		contacts = append(contacts, row)
+	}
+
+	return contacts, rows.Err()
+}
+
+func (store *sqlStore) IsContact(username string, contact string) (bool, error) {
+	var count int
+	err := store.queryRow(store.db, "SELECT COUNT(*) FROM contacts WHERE username = ? AND contact = ?", username, contact).Scan(&count)
+	return count > 0, err
+}
+
+func (store *sqlStore) RemoveContact(username string, contact string) (bool, error) {
+	statement := "DELETE FROM contacts WHERE (username = ? AND contact = ?) OR (username = ? AND contact = ?)"
+
+	result, err := store.exec(store.db, statement, username, contact, contact, username)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) CreateFriendRequest(from_user string, to_user string, created time.Time) (bool, error) {
+	statement := "INSERT INTO friend_requests(from_user,to_user,created) VALUES(?,?,?) ON CONFLICT DO NOTHING"
+
+	result, err := store.exec(store.db, statement, from_user, to_user, created.Unix())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) HasFriendRequest(from_user string, to_user string) (bool, error) {
+	var count int
+	err := store.queryRow(store.db, "SELECT COUNT(*) FROM friend_requests WHERE from_user = ? AND to_user = ?", from_user, to_user).Scan(&count)
+	return count > 0, err
+}
+
+func (store *sqlStore) GetFriendRequests(username string) ([]map[string]string, []map[string]string, error) {
+	incoming, err := store.queryFriendRequests("from_user", "to_user", username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outgoing, err := store.queryFriendRequests("to_user", "from_user", username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return incoming, outgoing, nil
+}
+
+// queryFriendRequests lists the requests whose column "self" is username, the other side is in "other".
+func (store *sqlStore) queryFriendRequests(other string, self string, username string) ([]map[string]string, error) {
+	statement := "SELECT r." + other + ",COALESCE(a.nickname,''),r.created FROM friend_requests r "
+	statement += "LEFT JOIN accounts a ON a.username = r." + other + " WHERE r." + self + " = ? "
+	statement += "ORDER BY r.created DESC, r." + other + " ASC"
+
+	rows, err := store.query(store.db, statement, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peer string
+	var nickname string
+	var created int64
+
+	requests := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&peer, &nickname, &created); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string)
+		row["username"] = peer
+		row["nickname"] = nickname
+		row["created"] = strconv.FormatInt(created, 10)
+		requests = append(requests, row)
+	}
+
+	return requests, rows.Err()
+}
+
+func (store *sqlStore) DeleteFriendRequest(from_user string, to_user string) (bool, error) {
+	result, err := store.exec(store.db, "DELETE FROM friend_requests WHERE from_user = ? AND to_user = ?", from_user, to_user)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) AcceptFriendRequest(from_user string, to_user string, at time.Time) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	result, err := store.exec(tx, "DELETE FROM friend_requests WHERE from_user = ? AND to_user = ?", from_user, to_user)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return errNoFriendRequest
+	}
+
+	// a crossed request in the other direction is settled too
+	if _, err = store.exec(tx, "DELETE FROM friend_requests WHERE from_user = ? AND to_user = ?", to_user, from_user); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	statement := "INSERT INTO contacts(username,contact,created) VALUES(?,?,?),(?,?,?) ON CONFLICT DO NOTHING"
+	if _, err = store.exec(tx, statement, from_user, to_user, at.Unix(), to_user, from_user, at.Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *sqlStore) GetPrivacySettings(username string) (privacySettings, error) {
+	var settings privacySettings
+	var contactsOnly int
+	var dropBlocked int
+
+	statement := "SELECT COALESCE(contacts_only, 0), COALESCE(drop_blocked, 0) FROM accounts WHERE username = ?"
+
+	err := store.queryRow(store.db, statement, username).Scan(&contactsOnly, &dropBlocked)
+	if err == sql.ErrNoRows {
+		return settings, errUserNotFound
+	}
+
+	settings.contactsOnly = contactsOnly != 0
+	settings.dropBlocked = dropBlocked != 0
+	return settings, err
+}
+
+func (store *sqlStore) SetPrivacySettings(username string, settings privacySettings) error {
+	statement := "UPDATE accounts SET contacts_only = ?, drop_blocked = ? WHERE username = ?"
+
+	_, err := store.exec(store.db, statement, boolToInt(settings.contactsOnly), boolToInt(settings.dropBlocked), username)
+	return err
+}
+
+/* blocks */
+
+func (store *sqlStore) BlockUser(username string, blocked string, hideHistory bool, at time.Time) (bool, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	if err = store.queryRow(tx, "SELECT COUNT(*) FROM blocks WHERE username = ? AND blocked = ?", username, blocked).Scan(&count); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	statement := "INSERT INTO blocks(username,blocked,created,hide_history) VALUES(?,?,?,?) "
+	statement += "ON CONFLICT(username, blocked) DO UPDATE SET hide_history = excluded.hide_history"
+
+	if _, err = store.exec(tx, statement, username, blocked, at.Unix(), boolToInt(hideHistory)); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	statement = "DELETE FROM contacts WHERE (username = ? AND contact = ?) OR (username = ? AND contact = ?)"
+	if _, err = store.exec(tx, statement, username, blocked, blocked, username); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	statement = "DELETE FROM friend_requests WHERE (from_user = ? AND to_user = ?) OR (from_user = ? AND to_user = ?)"
+	if _, err = store.exec(tx, statement, username, blocked, blocked, username); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return count == 0, tx.Commit()
+}
+
+func (store *sqlStore) UnblockUser(username string, blocked string) (bool, error) {
+	result, err := store.exec(store.db, "DELETE FROM blocks WHERE username = ? AND blocked = ?", username, blocked)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (store *sqlStore) IsBlocked(username string, blocked string) (bool, error) {
+	var count int
+	err := store.queryRow(store.db, "SELECT COUNT(*) FROM blocks WHERE username = ? AND blocked = ?", username, blocked).Scan(&count)
+	return count > 0, err
+}
+
+func (store *sqlStore) GetBlockedUsers(username string) ([]map[string]string, error) {
+	statement := "SELECT b.blocked,COALESCE(a.nickname,''),b.hide_history,b.created FROM blocks b "
+	statement += "LEFT JOIN accounts a ON a.username = b.blocked WHERE b.username = ? ORDER BY b.blocked ASC"
+
+	rows, err := store.query(store.db, statement, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocked string
+	var nickname string
+	var hideHistory int
+	var created int64
+
+	users := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(&blocked, &nickname, &hideHistory, &created); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string)
+		row["username"] = blocked
+		row["nickname"] = nickname
+		row["hide_history"] = strconv.Itoa(hideHistory)
+		row["since"] = strconv.FormatInt(created, 10)
+		users = append(users, row)
+	}
+
+	return users, rows.Err()
+}
+
+/* presence */
+
+func (store *sqlStore) GetPresence(usernames []string) ([]map[string]string, error) {
+	rows := make([]map[string]string, 0, len(usernames))
+	if len(usernames) == 0 {
+		return rows, nil
+	}
+
+	args := make([]interface{}, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+
+	statement := "SELECT username,last_seen,COALESCE(status_text,''),COALESCE(invisible,0) FROM accounts "
+	statement += "WHERE username IN (?" + strings.Repeat(",?", len(usernames)-1) + ") ORDER BY username ASC"
+
+	result, err := store.query(store.db, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var username string
+	var last_seen sql.NullInt64
+	var status_text string
+	var invisible int
+
+	for result.Next() {
+		if err := result.Scan(&username, &last_seen, &status_text, &invisible); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string)
+		row["username"] = username
+		row["last_seen"] = ""
+		if last_seen.Valid {
+			row["last_seen"] = strconv.FormatInt(last_seen.Int64, 10)
+		}
+		row["status_text"] = status_text
+		row["invisible"] = strconv.Itoa(invisible)
+		rows = append(rows, row)
+	}
+
+	return rows, result.Err()
+}
+
+func (store *sqlStore) SetLastSeen(username string, at time.Time) error {
+	_, err := store.exec(store.db, "UPDATE accounts SET last_seen = ? WHERE username = ?", at.Unix(), username)
+	return err
+}
+
+func (store *sqlStore) SetPresenceSettings(username string, status_text string, invisible bool) error {
+	_, err := store.exec(store.db, "UPDATE accounts SET status_text = ?, invisible = ? WHERE username = ?", status_text, boolToInt(invisible), username)
+	return err
+}
+
+/* maintenance */
+
+func (store *sqlStore) PurgeMessages(before time.Time) (int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// created stays NULL for legacy rows whose time did not parse, see
+	// backfillMessageCreated, they are older than any cutoff
+	result, err := store.exec(tx, "DELETE FROM messages WHERE created < ? OR created IS NULL", before.Unix())
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	removed, _ := result.RowsAffected()
+
+	if removed > 0 {
+		if err = store.dropMessageLeftovers(tx); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return removed, tx.Commit()
+}
+
+func (store *sqlStore) GetStats() (map[string]string, error) {
+	counts := []struct {
+		name      string
+		statement string
+	}{
+		{"accounts", "SELECT COUNT(*) FROM accounts"},
+		{"disabled_accounts", "SELECT COUNT(*) FROM accounts WHERE disabled = 1"},
+		{"messages", "SELECT COUNT(*) FROM messages WHERE room_id IS NULL"},
+		{"room_messages", "SELECT COUNT(*) FROM messages WHERE room_id IS NOT NULL"},
+		{"rooms", "SELECT COUNT(*) FROM rooms"},
+		{"sessions", "SELECT COUNT(*) FROM sessions"},
+		{"attachments", "SELECT COUNT(*) FROM attachments"},
+		{"attachment_bytes", "SELECT COALESCE(SUM(size), 0) FROM attachments"},
+	}
+
+	stats := make(map[string]string)
+	for _, count := range counts {
+		var n int64
+		if err := store.queryRow(store.db, count.statement).Scan(&n); err != nil {
+			return nil, err
+		}
+		stats[count.name] = strconv.FormatInt(n, 10)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+	Store conformance
+
+	Every test here runs against each backend: the memory store, SQLite in a
+	temporary file and PostgreSQL when BOOTCHAT_TEST_POSTGRES_DSN names a
+	database the tests may wipe. The backends have to agree on everything a
+	handler can see.
+*/
+
+const testPostgresEnv = "BOOTCHAT_TEST_POSTGRES_DSN"
+
+// forEachStore runs test on a fresh store of every backend, with the users alice, bob and carol.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	backends := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return newMemStore() },
+		"sqlite": func(t *testing.T) Store {
+			return openTestStore(t, dialectSqlite, filepath.Join(t.TempDir(), "bootchat.db"))
+		},
+	}
+
+	if dsn := os.Getenv(testPostgresEnv); len(dsn) > 0 {
+		backends["postgres"] = func(t *testing.T) Store { return openTestStore(t, dialectPostgres, dsn) }
+	}
+
+	for _, name := range []string{"memory", "sqlite", "postgres"} {
+		open, exists := backends[name]
+		if !exists {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			for _, username := range []string{"alice", "bob", "carol"} {
+				if err := store.CreateAccount(username, username, "question", "answer", "x"); err != nil {
+					t.Fatalf("CreateAccount %s: %s", username, err.Error())
+				}
+			}
+			test(t, store)
+		})
+	}
+}
+
+// openTestStore opens an SQL store with the schema rolled back and migrated up again.
+func openTestStore(t *testing.T, dialect *sqlDialect, dsn string) Store {
+	store, err := open_sql_store(dialect, dsn)
+	if err != nil {
+		t.Fatalf("open %s: %s", dialect.name, err.Error())
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if _, err = store.MigrateDown(1 << 30); err != nil {
+		t.Fatalf("migrate down: %s", err.Error())
+	}
+	if _, err = store.MigrateUp(0); err != nil {
+		t.Fatalf("migrate up: %s", err.Error())
+	}
+
+	return store
+}
+
+// send stores a one-to-one message and returns its id.
+func send(t *testing.T, store Store, from_user string, to_user string, body string) int64 {
+	t.Helper()
+
+	message, err := store.SendMessage(to_user, from_user, body, nil)
+	if err != nil {
+		t.Fatalf("SendMessage: %s", err.Error())
+	}
+
+	id, _ := strconv.ParseInt(message["id"], 10, 64)
+	return id
+}
+
+// bodies lists the bodies of message rows in order.
+func bodies(rows []map[string]string) []string {
+	list := make([]string, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, row["body"])
+	}
+	return list
+}
+
+// history returns the bodies of a GetMessages page and whether there is more.
+func history(t *testing.T, store Store, username string, peer string, since_id int64, before_id int64, limit int) ([]string, bool) {
+	t.Helper()
+
+	rows, more, err := store.GetMessages(username, peer, since_id, before_id, limit)
+	if err != nil {
+		t.Fatalf("GetMessages: %s", err.Error())
+	}
+
+	return bodies(rows), more
+}
+
+// expect fails the test when got is not want, what names the list.
+func expect(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+
+	if !reflect.DeepEqual(got, append(make([]string, 0), want...)) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store Store)
+	}{
+		{"send, get and page", testSendAndPage},
+		{"delete, restore and purge a conversation", testDeleteConversation},
+		{"undo keeps the earlier deletion", testRestoreKeepsEarlierDeletion},
+		{"hidden messages", testHiddenMessages},
+		{"unread counts", testUnreadCounts},
+		{"a deleted username is not registered again", testDeletedUsername},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, test.test)
+		})
+	}
+}
+
+func testSendAndPage(t *testing.T, store Store) {
+	ids := make(map[string]int64)
+	for i, body := range []string{"1", "2", "3", "4", "5"} {
+		if i%2 == 0 {
+			ids[body] = send(t, store, "alice", "bob", body)
+		} else {
+			ids[body] = send(t, store, "bob", "alice", body)
+		}
+	}
+	send(t, store, "alice", "carol", "c")
+
+	page, more := history(t, store, "alice", "bob", 0, 0, 2)
+	expect(t, "newest page", page, "4", "5")
+	if !more {
+		t.Errorf("newest page: no more before it")
+	}
+
+	page, more = history(t, store, "alice", "bob", 0, ids["4"], 2)
+	expect(t, "before 4", page, "2", "3")
+	if !more {
+		t.Errorf("before 4: no more before it")
+	}
+
+	page, more = history(t, store, "alice", "bob", 0, ids["2"], 2)
+	expect(t, "before 2", page, "1")
+	if more {
+		t.Errorf("before 2: more before the first message")
+	}
+
+	page, more = history(t, store, "bob", "alice", ids["1"], 0, 2)
+	expect(t, "since 1", page, "2", "3")
+	if !more {
+		t.Errorf("since 1: no more after it")
+	}
+
+	page, more = history(t, store, "bob", "alice", ids["3"], 0, 2)
+	expect(t, "since 3", page, "4", "5")
+	if more {
+		t.Errorf("since 3: more after the newest message")
+	}
+
+	page, _ = history(t, store, "alice", "", 0, 0, 10)
+	expect(t, "every peer", page, "1", "2", "3", "4", "5", "c")
+
+	rows, err := store.GetAllMessages("bob")
+	if err != nil {
+		t.Fatalf("GetAllMessages: %s", err.Error())
+	}
+	expect(t, "all of bob", bodies(rows), "1", "2", "3", "4", "5")
+
+	// optional columns are left out, not empty
+	keys := make([]string, 0)
+	for _, key := range []string{"id", "to_user", "from_user", "body", "date", "room_id", "delivered_at", "read_at", "edited_at", "deleted_at"} {
+		if _, exists := rows[0][key]; exists {
+			keys = append(keys, key)
+		}
+	}
+	expect(t, "row keys", keys, "id", "to_user", "from_user", "body", "date")
+
+	if rows[0]["from_user"] != "alice" || rows[0]["to_user"] != "bob" || rows[0]["id"] != strconv.FormatInt(ids["1"], 10) {
+		t.Errorf("first row of bob: %v", rows[0])
+	}
+
+	if flag, _ := store.GetNewMessageFlag("carol"); flag != 1 {
+		t.Errorf("new message flag of carol is %d", flag)
+	}
+}
+
+func testDeleteConversation(t *testing.T, store Store) {
+	now := time.Now()
+
+	send(t, store, "alice", "bob", "1")
+	last := send(t, store, "bob", "alice", "2")
+
+	upto_id, err := store.DeleteConversation("alice", "bob", now)
+	if err != nil || upto_id != last {
+		t.Fatalf("DeleteConversation: %d %v, want %d", upto_id, err, last)
+	}
+
+	page, _ := history(t, store, "alice", "bob", 0, 0, 10)
+	expect(t, "alice after deleting", page)
+	page, _ = history(t, store, "bob", "alice", 0, 0, 10)
+	expect(t, "bob after alice deleted", page, "1", "2")
+
+	rows, _ := store.GetAllMessages("alice")
+	expect(t, "all of alice after deleting", bodies(rows))
+
+	send(t, store, "bob", "alice", "3")
+	page, _ = history(t, store, "alice", "bob", 0, 0, 10)
+	expect(t, "alice after a new message", page, "3")
+
+	restored, err := store.RestoreConversation("alice", "bob", now.Add(-time.Minute))
+	if err != nil || !restored {
+		t.Fatalf("RestoreConversation: %v %v", restored, err)
+	}
+	page, _ = history(t, store, "alice", "bob", 0, 0, 10)
+	expect(t, "alice after the undo", page, "1", "2", "3")
+
+	if restored, _ = store.RestoreConversation("alice", "bob", now.Add(-time.Minute)); restored {
+		t.Errorf("a second undo restored something")
+	}
+
+	// one side deleting is not enough to purge
+	old := now.Add(-2 * time.Hour)
+	store.DeleteConversation("alice", "bob", old)
+	if removed, _ := store.PurgeConversations(now.Add(-time.Hour)); removed != 0 {
+		t.Errorf("purged %d message(s) only alice deleted", removed)
+	}
+
+	send(t, store, "alice", "carol", "c")
+	store.DeleteConversation("bob", "alice", old)
+
+	removed, err := store.PurgeConversations(now.Add(-time.Hour))
+	if err != nil || removed != 3 {
+		t.Errorf("PurgeConversations: %d %v, want 3", removed, err)
+	}
+
+	page, _ = history(t, store, "bob", "", 0, 0, 10)
+	expect(t, "bob after the purge", page)
+	page, _ = history(t, store, "carol", "alice", 0, 0, 10)
+	expect(t, "carol after the purge", page, "c")
+}
+
+func testHiddenMessages(t *testing.T, store Store) {
+	send(t, store, "alice", "bob", "one fish")
+	hidden := send(t, store, "alice", "bob", "two fish")
+	send(t, store, "alice", "bob", "red fish")
+
+	if err := store.HideMessage("bob", hidden); err != nil {
+		t.Fatalf("HideMessage: %s", err.Error())
+	}
+
+	page, _ := history(t, store, "bob", "alice", 0, 0, 10)
+	expect(t, "bob", page, "one fish", "red fish")
+	page, _ = history(t, store, "alice", "bob", 0, 0, 10)
+	expect(t, "alice", page, "one fish", "two fish", "red fish")
+
+	rows, _ := store.GetAllMessages("bob")
+	expect(t, "all of bob", bodies(rows), "one fish", "red fish")
+
+	terms, _ := parse_search_query("fish")
+	rows, _, err := store.SearchMessages("bob", &searchQuery{terms: terms}, 0, 10)
+	if err != nil {
+		t.Fatalf("SearchMessages: %s", err.Error())
+	}
+	expect(t, "bob searching", bodies(rows), "red fish", "one fish")
+
+	room_id, err := store.CreateRoom("r", "alice", false, []string{"bob"})
+	if err != nil {
+		t.Fatalf("CreateRoom: %s", err.Error())
+	}
+
+	message, _ := store.SendRoomMessage(room_id, "alice", "hi", nil)
+	store.SendRoomMessage(room_id, "alice", "there", nil)
+	id, _ := strconv.ParseInt(message["id"], 10, 64)
+	store.HideMessage("bob", id)
+
+	rows, _, err = store.GetRoomMessages(room_id, "bob", 0, 0, 10)
+	if err != nil {
+		t.Fatalf("GetRoomMessages: %s", err.Error())
+	}
+	expect(t, "bob in the room", bodies(rows), "there")
+
+	rows, _, _ = store.GetRoomMessages(room_id, "alice", 0, 0, 10)
+	expect(t, "alice in the room", bodies(rows), "hi", "there")
+}
+
+// unreadOf maps the peers (or room names) of GetUnreadCounts or GetConversations rows to their unread count.
+func unreadOf(rows []map[string]string) map[string]string {
+	unread := make(map[string]string)
+	for _, row := range rows {
+		if len(row["peer"]) > 0 {
+			unread[row["peer"]] = row["unread"]
+		} else {
+			unread[row["name"]] = row["unread"]
+		}
+	}
+	return unread
+}
+
+func testUnreadCounts(t *testing.T, store Store) {
+	hidden := send(t, store, "alice", "bob", "1")
+	send(t, store, "alice", "bob", "2")
+	send(t, store, "alice", "bob", "3")
+	store.HideMessage("bob", hidden)
+	send(t, store, "carol", "bob", "c")
+	send(t, store, "bob", "alice", "reply")
+
+	counts, err := store.GetUnreadCounts("bob")
+	if err != nil {
+		t.Fatalf("GetUnreadCounts: %s", err.Error())
+	}
+	if len(counts) != 2 || counts[0]["peer"] != "carol" {
+		t.Errorf("unread counts not newest first: %v", counts)
+	}
+	if unread := unreadOf(counts); !reflect.DeepEqual(unread, map[string]string{"alice": "2", "carol": "1"}) {
+		t.Errorf("unread counts: %v", unread)
+	}
+
+	room_id, _ := store.CreateRoom("r", "alice", false, []string{"bob"})
+	hiddenInRoom, _ := store.SendRoomMessage(room_id, "alice", "a", nil)
+	store.SendRoomMessage(room_id, "alice", "b", nil)
+	store.SendRoomMessage(room_id, "bob", "mine", nil)
+	id, _ := strconv.ParseInt(hiddenInRoom["id"], 10, 64)
+	store.HideMessage("bob", id)
+
+	conversations, err := store.GetConversations("bob")
+	if err != nil {
+		t.Fatalf("GetConversations: %s", err.Error())
+	}
+	if unread := unreadOf(conversations); !reflect.DeepEqual(unread, map[string]string{"alice": "2", "carol": "1", "r": "1"}) {
+		t.Errorf("conversation unread: %v", unread)
+	}
+
+	if _, _, err = store.MarkRead("bob", "alice", 0, time.Now()); err != nil {
+		t.Fatalf("MarkRead: %s", err.Error())
+	}
+	if _, _, err = store.MarkRoomRead(room_id, "bob", 0); err != nil {
+		t.Fatalf("MarkRoomRead: %s", err.Error())
+	}
+	store.DeleteConversation("bob", "carol", time.Now())
+
+	counts, _ = store.GetUnreadCounts("bob")
+	if len(counts) != 0 {
+		t.Errorf("unread counts after reading and deleting: %v", counts)
+	}
+
+	conversations, _ = store.GetConversations("bob")
+	if unread := unreadOf(conversations); !reflect.DeepEqual(unread, map[string]string{"alice": "0", "r": "0"}) {
+		t.Errorf("conversation unread after reading and deleting: %v", unread)
+	}
+}
+
+func testRestoreKeepsEarlierDeletion(t *testing.T, store Store) {
+	now := time.Now()
+	first := now.Add(-time.Hour)
+
+	send(t, store, "alice", "bob", "one")
+	if _, err := store.DeleteConversation("bob", "alice", now.Add(-2*time.Hour)); err != nil {
+		t.Fatalf("DeleteConversation: %s", err.Error())
+	}
+	if _, err := store.DeleteConversation("alice", "bob", first); err != nil {
+		t.Fatalf("DeleteConversation: %s", err.Error())
+	}
+
+	send(t, store, "alice", "bob", "two")
+	if _, err := store.DeleteConversation("alice", "bob", now); err != nil {
+		t.Fatalf("DeleteConversation: %s", err.Error())
+	}
+
+	// undo the second deletion, the first one stays
+	restored, err := store.RestoreConversation("alice", "bob", now.Add(-time.Minute))
+	if err != nil || !restored {
+		t.Fatalf("RestoreConversation: %v %v", restored, err)
+	}
+
+	rows, _, err := store.GetMessages("alice", "bob", 0, 0, 10)
+	if err != nil {
+		t.Fatalf("GetMessages: %s", err.Error())
+	}
+	if got := bodies(rows); len(got) != 1 || got[0] != "two" {
+		t.Errorf("alice sees %v after the undo, want [two]", got)
+	}
+
+	// the first deletion is as old as it was, too old to undo
+	if restored, _ = store.RestoreConversation("alice", "bob", first.Add(time.Minute)); restored {
+		t.Errorf("the first deletion was undone after its window")
+	}
+
+	// and not yet purgeable before its own time
+	removed, err := store.PurgeConversations(first.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("PurgeConversations: %s", err.Error())
+	}
+	if removed != 0 {
+		t.Errorf("purge before the first deletion removed %d message(s)", removed)
+	}
+
+	if removed, _ = store.PurgeConversations(first.Add(time.Minute)); removed != 1 {
+		t.Errorf("purge after the first deletion removed %d message(s), want 1", removed)
+	}
+
+	// while it is in its window the first deletion can be undone in turn
+	if restored, _ = store.RestoreConversation("alice", "bob", first.Add(-time.Minute)); !restored {
+		t.Errorf("the first deletion could not be undone within its window")
+	}
+}
+
+func testDeletedUsername(t *testing.T, store Store) {
+	send(t, store, "alice", "bob", "1")
+	send(t, store, "bob", "alice", "2")
+
+	if err := store.DeleteUser("bob"); err != nil {
+		t.Fatalf("DeleteUser: %s", err.Error())
+	}
+
+	// whoever registers the name would read the conversation with alice
+	if err := store.CreateAccount("bob", "robert", "question", "answer", "x"); err != errUserExists {
+		t.Errorf("CreateAccount of a deleted username: %v", err)
+	}
+	useHasher(t, newBcryptHasher(4))
+	if err := add_user(store, "bob", "robert", "question", "answer", "123456"); err != errUserExists {
+		t.Errorf("add_user of a deleted username: %v", err)
+	}
+	if store.UserExists("bob") {
+		t.Errorf("the deleted username exists again")
+	}
+
+	got, _ := history(t, store, "alice", "bob", 0, 0, 10)
+	expect(t, "the history of alice", got, "1", "2")
+
+	// the nickname is free, only the username is kept
+	if err := store.CreateAccount("dave", "bob", "question", "answer", "x"); err != nil {
+		t.Errorf("CreateAccount with the nickname of a deleted account: %v", err)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	TLS
+
+	The server speaks https unless tls.enabled is false. The certificate
+	and key (tls.cert, tls.key) are loaded again on SIGHUP and when either
+	file changes, checked every tlsReloadCheckInterval. New connections get
+	the new certificate, open ones keep theirs. A pair that does not load
+	is logged and the previous one stays in use.
+
+	With tls.client_ca set every client must present a certificate signed
+	by one of the CAs in that file (mutual TLS). The file is reloaded with
+	the certificate.
+
+	For development gen-cert creates a CA and a server certificate signed
+	by it, and client certificates for mutual TLS:
+
+	 gen-cert [-force] [host ...]   ca.crt and ca.key next to tls.cert, then
+	                                tls.cert and tls.key for localhost,
+	                                127.0.0.1, ::1 and every host given
+	 gen-cert client <name>         <name>.crt and <name>.key next to
+	                                tls.cert, signed by ca.crt
+*/
+
+const tlsReloadCheckInterval = 10 * time.Second
+
+const devCALifetime = 10 * 365 * 24 * time.Hour
+const devCertLifetime = 365 * 24 * time.Hour
+
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu       sync.RWMutex
+	config   *tls.Config
+	modified time.Time // newest modification time of the files loaded
+}
+
+/*
+	newTLSReloader - load the certificate, key and client CAs of config
+	 config *serverConfig
+
+	 returns (*tlsReloader, error)
+*/
+func newTLSReloader(config *serverConfig) (*tlsReloader, error) {
+	reloader := &tlsReloader{
+		certFile:     config.tlsCert,
+		keyFile:      config.tlsKey,
+		clientCAFile: config.tlsClientCA,
+	}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// files lists what the reloader loads.
+func (reloader *tlsReloader) files() []string {
+	files := []string{reloader.certFile, reloader.keyFile}
+	if len(reloader.clientCAFile) > 0 {
+		files = append(files, reloader.clientCAFile)
+	}
+	return files
+}
+
+// lastModified is the newest modification time of the files.
+func (reloader *tlsReloader) lastModified() (time.Time, error) {
+	var newest time.Time
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// reload builds a new tls.Config from the files, the current one stays
+// when that fails.
+func (reloader *tlsReloader) reload() error {
+	modified, err := reloader.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load %s and %s: %s", reloader.certFile, reloader.keyFile, err.Error())
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(reloader.clientCAFile) > 0 {
+		pool, err := loadCertPool(reloader.clientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().After(leaf.NotAfter) {
+		log.Printf("Warning: %s expired on %s, run gen-cert for a new one", reloader.certFile, leaf.NotAfter.Format("2006-01-02"))
+	}
+
+	reloader.mu.Lock()
+	reloader.config = config
+	reloader.modified = modified
+	reloader.mu.Unlock()
+
+	return nil
+}
+
+// configForClient is tls.Config.GetConfigForClient, every handshake gets
+// the config loaded last.
+func (reloader *tlsReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.config, nil
+}
+
+// tlsConfig is the config to serve with.
+func (reloader *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: reloader.configForClient}
+}
+
+// watch reloads on SIGHUP and when a file changed, it never returns.
+func (reloader *tlsReloader) watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(tlsReloadCheckInterval)
+	defer ticker.Stop()
+
+	// a pair that failed to load is only tried again once it changes
+	reloader.mu.RLock()
+	seen := reloader.modified
+	reloader.mu.RUnlock()
+
+	for {
+		select {
+		case <-hangup:
+			reloader.reloadAndLog("SIGHUP")
+
+		case <-ticker.C:
+			modified, err := reloader.lastModified()
+			if err == nil && !modified.Equal(seen) {
+				seen = modified
+				reloader.reloadAndLog("file change")
+			}
+		}
+	}
+}
+
+func (reloader *tlsReloader) reloadAndLog(reason string) {
+	if err := reloader.reload(); err != nil {
+		log.Printf("TLS reload (%s) failed, keeping the previous certificate: %s", reason, err.Error())
+		return
+	}
+	log.Printf("TLS certificate reloaded (%s).", reason)
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+/* gen-cert */
+
+/*
+	runGenCertCommand - the "gen-cert" subcommand
+	 config *serverConfig
+	 args []string ([-force] [host ...] | client <name>)
+
+	 returns (process exit code)
+*/
+func runGenCertCommand(config *serverConfig, args []string) int {
+	const usage = "usage: bootchat-server [flags] gen-cert [-force] [host ...] | client <name>"
+
+	dir := filepath.Dir(config.tlsCert)
+	caCert := filepath.Join(dir, "ca.crt")
+	caKey := filepath.Join(dir, "ca.key")
+
+	if len(args) > 0 && args[0] == "client" {
+		if len(args) != 2 || !isConfigKey(args[1]) {
+			fmt.Println(usage)
+			return 2
+		}
+
+		certFile := filepath.Join(dir, args[1]+".crt")
+		keyFile := filepath.Join(dir, args[1]+".key")
+
+		if err := generate_client_cert(caCert, caKey, args[1], certFile, keyFile); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+
+		fmt.Printf("Wrote %s and %s, signed by %s.\n", certFile, keyFile, caCert)
+		return 0
+	}
+
+	force := false
+	if len(args) > 0 && args[0] == "-force" {
+		force = true
+		args = args[1:]
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	for _, host := range args {
+		if strings.HasPrefix(host, "-") {
+			fmt.Println(usage)
+			return 2
+		}
+		hosts = append(hosts, host)
+	}
+
+	if !force {
+		for _, file := range []string{caCert, caKey, config.tlsCert, config.tlsKey} {
+			if _, err := os.Stat(file); err == nil {
+				fmt.Printf("%s exists, -force replaces it\n", file)
+				return 1
+			}
+		}
+	}
+
+	if err := generate_dev_certs(caCert, caKey, config.tlsCert, config.tlsKey, hosts); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	fmt.Printf("Wrote %s and %s, and %s and %s for %s.\n", caCert, caKey, config.tlsCert, config.tlsKey, strings.Join(hosts, ", "))
+	return 0
+}
+
+/*
+	generate_dev_certs - create a CA and a server certificate signed by it
+	 caCertFile, caKeyFile string
+	 certFile, keyFile string
+	 hosts []string (names and addresses the server certificate is valid for)
+
+	 returns (error)
+*/
+func generate_dev_certs(caCertFile string, caKeyFile string, certFile string, keyFile string, hosts []string) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	caTemplate, err := newCertTemplate("bootchat development CA", devCALifetime)
+	if err != nil {
+		return err
+	}
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return err
+	}
+
+	if err = writeCertAndKey(caCertFile, caKeyFile, caDer, caKey); err != nil {
+		return err
+	}
+
+	template, err := newCertTemplate(hosts[0], devCertLifetime)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return signCert(template, ca, caKey, certFile, keyFile)
+}
+
+/*
+	generate_client_cert - create a client certificate for mutual TLS
+	 caCertFile, caKeyFile string (made by generate_dev_certs)
+	 name string (the common name)
+	 certFile, keyFile string
+
+	 returns (error)
+*/
+func generate_client_cert(caCertFile string, caKeyFile string, name string, certFile string, keyFile string) error {
+	pair, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the CA, run gen-cert first: %s", err.Error())
+	}
+
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	caKey, isEcdsa := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ca.IsCA || !isEcdsa {
+		return errors.New(caCertFile + " is not a CA made by gen-cert")
+	}
+
+	template, err := newCertTemplate(name, devCertLifetime)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return signCert(template, ca, caKey, certFile, keyFile)
+}
+
+func newCertTemplate(commonName string, lifetime time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"bootchat"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(lifetime),
+	}, nil
+}
+
+// signCert creates a key for template, signs it with the CA and writes both.
+func signCert(template *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	return writeCertAndKey(certFile, keyFile, der, key)
+}
+
+// writeCertAndKey writes PEM files, the key readable by the owner only.
+func writeCertAndKey(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+
+	// a server reloading between the two writes gets a mismatched pair,
+	// keeps its certificate and loads both at the next check
+	if err = writePemFile(keyFile, "PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+
+	return writePemFile(certFile, "CERTIFICATE", der, 0644)
+}
+
+// writePemFile replaces path with a rename, a reader sees the old or the
+// new file, never a partial one.
+func writePemFile(path string, blockType string, der []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	Typing indicators
+
+	A client signals that its user is composing with the typing request,
+	either as a normal request or as a frame on its websocket:
+
+	 {"request":"typing","peer":"<user>"|"room_id":..,"state":"typing"|"stopped"}
+
+	The other side of the conversation (every other member for a room) gets
+
+	 {"event":"typing","username":..,"peer":..|"room_id":..,"state":"typing"|"stopped"}
+
+	"typing" is pushed when the user starts, "stopped" when they say so,
+	when they send a message there or when typingTimeout passes without
+	another typing signal, so a client keeps repeating typing while the user
+	composes. Nothing of this is ever stored.
+
+	At most one typing signal per typingMinInterval and conversation is
+	taken from a websocket connection (from plain requests: per user),
+	extra ones are ignored. Websocket frames get no reply, a frame that
+	fails is dropped.
+*/
+
+const typingTimeout = 6 * time.Second
+const typingMinInterval = time.Second
+
+const typingStateTyping = "typing"
+const typingStateStopped = "stopped"
+
+// typingKey names who is typing where, peer "" for rooms and room 0 for peers.
+type typingKey struct {
+	username string
+	peer     string
+	room_id  int64
+}
+
+// typingLimits remembers when each conversation last accepted a typing signal.
+type typingLimits map[typingKey]time.Time
+
+// allow reports whether a typing signal for key may be taken now and records it.
+func (limits typingLimits) allow(key typingKey, now time.Time) bool {
+	if last, exists := limits[key]; exists && now.Sub(last) < typingMinInterval {
+		return false
+	}
+
+	// forget conversations that have been quiet for a while
+	if len(limits) >= 64 {
+		for other, last := range limits {
+			if now.Sub(last) >= typingMinInterval {
+				delete(limits, other)
+			}
+		}
+	}
+
+	limits[key] = now
+	return true
+}
+
+// typingTracker holds the expiry timer of every indicator currently shown.
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*time.Timer
+
+	limitsMu      sync.Mutex
+	requestLimits typingLimits // for the typing request, per user
+}
+
+var typingIndicators = newTypingTracker()
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{
+		active:        make(map[typingKey]*time.Timer),
+		requestLimits: make(typingLimits),
+	}
+}
+
+/*
+	start - show or refresh key's indicator
+	 store Store
+	 key typingKey
+*/
+func (tracker *typingTracker) start(store Store, key typingKey) {
+	tracker.mu.Lock()
+
+	if timer, exists := tracker.active[key]; exists {
+		timer.Reset(typingTimeout)
+		tracker.mu.Unlock()
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTimeout, func() {
+		tracker.mu.Lock()
+		current := tracker.active[key] == timer
+		if current {
+			delete(tracker.active, key)
+		}
+		tracker.mu.Unlock()
+
+		if current {
+			publish_typing(store, key, typingStateStopped)
+		}
+	})
+	tracker.active[key] = timer
+	tracker.mu.Unlock()
+
+	publish_typing(store, key, typingStateTyping)
+}
+
+/*
+	stop - clear key's indicator, the others are told only if it was shown
+	 store Store
+	 key typingKey
+*/
+func (tracker *typingTracker) stop(store Store, key typingKey) {
+	tracker.mu.Lock()
+	timer, exists := tracker.active[key]
+	if exists {
+		timer.Stop()
+		delete(tracker.active, key)
+	}
+	tracker.mu.Unlock()
+
+	if exists {
+		publish_typing(store, key, typingStateStopped)
+	}
+}
+
+func typingEvent(key typingKey, state string) map[string]interface{} {
+	event := map[string]interface{}{"event": "typing", "username": key.username, "state": state}
+	if key.room_id > 0 {
+		event["room_id"] = key.room_id
+	} else {
+		event["peer"] = key.peer
+	}
+	return event
+}
+
+// publish_typing tells the other side of key's conversation.
+func publish_typing(store Store, key typingKey, state string) {
+	event := typingEvent(key, state)
+
+	if key.room_id == 0 {
+		eventHub.publish(key.peer, event)
+		return
+	}
+
+	members, err := get_room_member_names(store, key.room_id)
+	if err != nil {
+		log.Printf("Unable to load members of room %d: %s", key.room_id, err.Error())
+		return
+	}
+
+	for _, member := range members {
+		if member != key.username {
+			eventHub.publish(member, event)
+		}
+	}
+}
+
+/*
+	parse_typing - read a typing signal
+	 username string
+	 params typingParams
+
+	 returns (typingKey, state string, error)
+*/
+func parse_typing(username string, params typingParams) (typingKey, string, error) {
+	key := typingKey{username: username, peer: params.Peer, room_id: params.RoomId}
+
+	if (len(key.peer) > 0) == (key.room_id > 0) {
+		return key, "", errMissingParameter.withDetail("exactly one of peer and room_id")
+	}
+
+	// the validate tag only lets typing and stopped through
+	state := params.State
+	if len(state) == 0 {
+		state = typingStateTyping
+	}
+
+	return key, state, nil
+}
+
+/*
+	apply_typing - check and apply a typing signal that passed the rate limit
+	 store Store
+	 key typingKey
+	 state string
+
+	 returns (error)
+*/
+func apply_typing(store Store, key typingKey, state string) error {
+	if state == typingStateStopped {
+		typingIndicators.stop(store, key)
+		return nil
+	}
+
+	if key.room_id > 0 {
+		if err := requireRoomRole(store, key.room_id, key.username, false); err != nil {
+			return err
+		}
+	} else {
+		if err := lookup_user(store, key.username, key.peer); err != nil {
+			return err
+		}
+
+		// whoever may not message the peer may not show them typing either
+		drop, err := check_blocked(store, key.username, key.peer)
+		if err != nil || drop {
+			return err
+		}
+
+		if err = check_contacts_only(store, key.username, key.peer); err != nil {
+			return err
+		}
+	}
+
+	typingIndicators.start(store, key)
+	return nil
+}
+
+/* request handlers */
+
+/*
+	typing - signal composing in a conversation, see above
+	 peer or room_id  the conversation
+	 state            "typing" (default) or "stopped"
+*/
+func handleTypingRequest(store Store, username string, params interface{}) map[string]interface{} {
+	replyMap := make(map[string]interface{})
+
+	key, state, err := parse_typing(username, params.(typingParams))
+	if err != nil {
+		return errorReply(err)
+	}
+
+	typingIndicators.limitsMu.Lock()
+	allowed := state == typingStateStopped || typingIndicators.requestLimits.allow(key, time.Now())
+	typingIndicators.limitsMu.Unlock()
+
+	if allowed {
+		if err = apply_typing(store, key, state); err != nil {
+			return errorReply(err)
+		}
+	}
+
+	replyMap["success"] = true
+	return replyMap
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	Request validation
+
+	Every registered request names a struct of its parameters (params.go).
+	Before the handler runs, run_request decodes the parameters into a new
+	one, field by field with the getXParam helpers, so a field takes what
+	the handlers always took:
+
+	 string        a JSON string
+	 int64         a JSON number or a numeric string (path and query values)
+	 bool          true/false, 1/0, "1"/"0" or "true"/"false"
+	 *string       a string, nil when absent (absent and "" differ)
+	 *bool         a bool, nil when absent
+	 []int64       an array of ids or a comma separated string
+	 []string      an array of usernames or a comma separated string
+	 timeParam     unix seconds, YYYY-MM-DD or RFC 3339
+	 endTimeParam  the same, a bare date means the end of that day
+
+	and then checks the rules of its validate tag:
+
+	 required      present, and not an empty string or list
+	 min=N, max=N  the length of a string in characters, the value of an
+	               integer, the length of a list
+	 maxbytes=N    the length of a string in bytes (new passwords, see
+	               maxPasswordBytes)
+	 charset=C     username  letters, digits, "_", "." and "-"
+	               line      no control characters
+	               text      no control characters but tab and newlines
+	 oneof=a|b     a string is one of these
+
+	Parameters no struct field names are refused with
+	requests.unknown_params = "reject" (the default) and skipped with
+	"ignore". "request", "token" and "remote_addr" (set by the server) are
+	always allowed, and the username and password of an authenticated
+	request signed in with credentials.
+
+	Every problem found is reported at once, in "fields" of the reply:
+
+	 {"success":false,"code":"request.invalid_parameter","exception":"...",
+	  "fields":{"body":"must be at most 8192 characters","scope":"must be one of me, everyone"}}
+
+	The code is request.missing_parameter when only required parameters
+	are missing and request.invalid_parameter otherwise. Otherwise the
+	handler gets the struct and never looks at postData, what it checks
+	beyond these rules it reports with its own error.
+*/
+
+// rejectUnknownParams can be changed in the config, see config.go
+var rejectUnknownParams = true
+
+// timeParam is a date, see getSearchTimeParam.
+type timeParam int64
+
+// endTimeParam is a date that includes all of a bare day.
+type endTimeParam int64
+
+var (
+	stringType    = reflect.TypeOf("")
+	int64Type     = reflect.TypeOf(int64(0))
+	boolType      = reflect.TypeOf(false)
+	optStringType = reflect.TypeOf((*string)(nil))
+	optBoolType   = reflect.TypeOf((*bool)(nil))
+	idsType       = reflect.TypeOf([]int64(nil))
+	namesType     = reflect.TypeOf([]string(nil))
+	timeType      = reflect.TypeOf(timeParam(0))
+	endTimeType   = reflect.TypeOf(endTimeParam(0))
+)
+
+/*
+	decode_request - decode and check the parameters of a request
+	 name string (the registered request)
+	 handler requestHandler
+	 postData map[string]interface{}
+
+	 returns (params interface{}, error)
+	 params is a filled struct of the type of handler.params, nil for a
+	 request without one. errMissingParameter or errInvalidParameter with
+	 the fields that failed.
+*/
+func decode_request(name string, handler requestHandler, postData map[string]interface{}) (interface{}, error) {
+	var params interface{}
+	fields := make(map[string]string)
+	known := map[string]bool{"request": true, "token": true, "remote_addr": true}
+
+	if handler.auth {
+		known["username"] = true
+		known["password"] = true
+	}
+
+	if handler.params != nil {
+		params = decode_params(postData, handler.params, fields, known)
+	}
+
+	if rejectUnknownParams {
+		for key := range postData {
+			if !known[key] {
+				fields[key] = "is not a parameter of " + name
+			}
+		}
+	}
+
+	if len(fields) == 0 {
+		return params, nil
+	}
+
+	base := errMissingParameter
+	for _, reason := range fields {
+		if reason != "is required" {
+			base = errInvalidParameter
+		}
+	}
+
+	return nil, base.withFields(fields)
+}
+
+/*
+	decode_params - fill a new params struct from postData
+	 postData map[string]interface{}
+	 params interface{} (a request struct, see params.go)
+	 fields map[string]string (every problem found is added, by parameter)
+	 known map[string]bool (every parameter of the struct is added)
+
+	 returns (the struct, of the type of params)
+	 Only use it when no problem was added to fields.
+*/
+func decode_params(postData map[string]interface{}, params interface{}, fields map[string]string, known map[string]bool) interface{} {
+	structType := reflect.TypeOf(params)
+	value := reflect.New(structType).Elem()
+
+	// VisibleFields also walks embedded structs like pageFields
+	for _, field := range reflect.VisibleFields(structType) {
+		if field.Anonymous {
+			continue
+		}
+
+		key := field.Tag.Get("param")
+		known[key] = true
+		target := value.FieldByIndex(field.Index)
+
+		raw, present := postData[key]
+		present = present && raw != nil
+
+		if present {
+			if reason := decodeParam(postData, key, target); len(reason) > 0 {
+				fields[key] = reason
+				continue
+			}
+		}
+
+		if reason := checkParamRules(field.Tag.Get("validate"), present, target); len(reason) > 0 {
+			fields[key] = reason
+		}
+	}
+
+	return value.Interface()
+}
+
+// decodeParam stores postData[key] in target, or says why it can not.
+func decodeParam(postData map[string]interface{}, key string, target reflect.Value) string {
+	switch target.Type() {
+	case stringType:
+		s, isString := postData[key].(string)
+		if !isString {
+			return "must be a string"
+		}
+		target.SetString(s)
+
+	case int64Type:
+		n, err := getIntParam(postData, key)
+		if err != nil {
+			return "must be an integer"
+		}
+		target.SetInt(n)
+
+	case boolType:
+		b, _, err := getBoolParam(postData, key)
+		if err != nil {
+			return "must be a boolean"
+		}
+		target.SetBool(b)
+
+	case optStringType:
+		s, isString := postData[key].(string)
+		if !isString {
+			return "must be a string"
+		}
+		target.Set(reflect.ValueOf(&s))
+
+	case optBoolType:
+		b, _, err := getBoolParam(postData, key)
+		if err != nil {
+			return "must be a boolean"
+		}
+		target.Set(reflect.ValueOf(&b))
+
+	case idsType:
+		ids, err := getIdListParam(postData, key)
+		if err != nil {
+			return "must be a list of ids"
+		}
+		target.Set(reflect.ValueOf(ids))
+
+	case namesType:
+		names, err := getNameListParam(postData, key)
+		if err != nil {
+			return "must be a list of usernames"
+		}
+		target.Set(reflect.ValueOf(names))
+
+	case timeType:
+		t, err := getSearchTimeParam(postData, key, false)
+		if err != nil {
+			return "must be unix seconds, YYYY-MM-DD or RFC 3339"
+		}
+		target.SetInt(t)
+
+	case endTimeType:
+		t, err := getSearchTimeParam(postData, key, true)
+		if err != nil {
+			return "must be unix seconds, YYYY-MM-DD or RFC 3339"
+		}
+		target.SetInt(t)
+
+	default:
+		panic("unsupported parameter type " + target.Type().String())
+	}
+
+	return ""
+}
+
+// checkParamRules applies a validate tag to a decoded value.
+func checkParamRules(tag string, present bool, value reflect.Value) string {
+	if len(tag) == 0 {
+		return ""
+	}
+
+	// rules apply to what an optional parameter points to
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			present = false
+		} else {
+			value = value.Elem()
+		}
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		if name == "required" {
+			// a 0 is left to min, false is a value
+			empty := (value.Kind() == reflect.String || value.Kind() == reflect.Slice) && value.Len() == 0
+			if !present || empty {
+				return "is required"
+			}
+			continue
+		}
+
+		if !present {
+			continue
+		}
+
+		var reason string
+		switch name {
+		case "min", "max":
+			reason = checkParamBound(name, arg, value)
+		case "maxbytes":
+			if bound, _ := strconv.Atoi(arg); value.Len() > bound {
+				reason = "must be at most " + arg + " bytes"
+			}
+		case "charset":
+			reason = checkParamCharset(arg, value.String())
+		case "oneof":
+			if !contains(strings.Split(arg, "|"), value.String()) {
+				reason = "must be one of " + strings.Replace(arg, "|", ", ", -1)
+			}
+		default:
+			panic("unknown validation rule " + rule)
+		}
+
+		if len(reason) > 0 {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+func checkParamBound(name string, arg string, value reflect.Value) string {
+	bound, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		panic("bad validation bound " + name + "=" + arg)
+	}
+
+	var size int64
+	var unit string
+
+	switch value.Kind() {
+	case reflect.String:
+		size, unit = int64(utf8.RuneCountInString(value.String())), " characters"
+	case reflect.Slice:
+		size, unit = int64(value.Len()), " items"
+	default:
+		size = value.Int()
+	}
+
+	if name == "min" && size < bound {
+		return fmt.Sprintf("must be at least %d%s", bound, unit)
+	}
+	if name == "max" && size > bound {
+		return fmt.Sprintf("must be at most %d%s", bound, unit)
+	}
+
+	return ""
+}
+
+func checkParamCharset(charset string, s string) string {
+	if !utf8.ValidString(s) {
+		return "must be valid UTF-8"
+	}
+
+	for _, c := range s {
+		switch charset {
+		case "username":
+			if !(c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.' || c == '-')) {
+				return "may only contain letters, digits, _, . and -"
+			}
+		case "line":
+			if unicode.IsControl(c) {
+				return "must not contain control characters"
+			}
+		case "text":
+			if unicode.IsControl(c) && c != '\t' && c != '\n' && c != '\r' {
+				return "must not contain control characters"
+			}
+		default:
+			panic("unknown charset " + charset)
+		}
+	}
+
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+/* recovery */
+
+// recoverRequest turns a panic of a handler into an internal.error reply,
+// use it deferred with the reply variables of the caller.
+func recoverRequest(name string, replyMap *map[string]interface{}, status *int) {
+	if recovered := recover(); recovered != nil {
+		log.Printf("Panic in %s request: %v\n%s", name, recovered, debug.Stack())
+		*replyMap = errorReply(errInternal)
+		*status = errInternal.status
+	}
+}
+
+// recoverPanics keeps a panic below handler from taking the connection
+// down without a reply, the client gets internal.error.
+func recoverPanics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			log.Printf("Panic serving %s %s: %v\n%s", request.Method, request.URL.Path, recovered, debug.Stack())
+			writeJsonReply(response, errInternal.status, errorReply(errInternal))
+		}()
+
+		handler.ServeHTTP(response, request)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type ruleParams struct {
+	Name  string   `param:"name" validate:"required,max=5,charset=username"`
+	Pass  string   `param:"pass" validate:"maxbytes=4"`
+	Count int64    `param:"count" validate:"min=1,max=10"`
+	Text  *string  `param:"text" validate:"max=3,charset=line"`
+	Flag  *bool    `param:"flag"`
+	Mode  string   `param:"mode" validate:"oneof=a|b"`
+	Users []string `param:"users" validate:"max=2"`
+}
+
+func TestDecodeRequestRules(t *testing.T) {
+	handler := requestHandler{params: ruleParams{}}
+
+	tests := []struct {
+		name     string
+		postData map[string]interface{}
+		code     string            // "" when the request is valid
+		fields   map[string]string // the reasons expected in fields
+	}{
+		{"valid", map[string]interface{}{"name": "a.b-c", "count": 3.0}, "", nil},
+		{"server keys", map[string]interface{}{"request": "rules", "token": "t", "remote_addr": "::1", "name": "a"}, "", nil},
+
+		{"required missing", map[string]interface{}{}, errMissingParameter.code, map[string]string{"name": "is required"}},
+		{"required empty", map[string]interface{}{"name": ""}, errMissingParameter.code, map[string]string{"name": "is required"}},
+		{"required null", map[string]interface{}{"name": nil}, errMissingParameter.code, map[string]string{"name": "is required"}},
+		{"required wrong type", map[string]interface{}{"name": 5.0}, errInvalidParameter.code, map[string]string{"name": "must be a string"}},
+
+		{"max string", map[string]interface{}{"name": "abcdef"}, errInvalidParameter.code, map[string]string{"name": "must be at most 5 characters"}},
+		{"max counts characters", map[string]interface{}{"name": "a", "text": "äöü"}, "", nil},
+		{"max optional string", map[string]interface{}{"name": "a", "text": "abcd"}, errInvalidParameter.code, map[string]string{"text": "must be at most 3 characters"}},
+		{"max integer", map[string]interface{}{"name": "a", "count": "11"}, errInvalidParameter.code, map[string]string{"count": "must be at most 10"}},
+		{"min integer", map[string]interface{}{"name": "a", "count": 0.0}, errInvalidParameter.code, map[string]string{"count": "must be at least 1"}},
+		{"maxbytes", map[string]interface{}{"name": "a", "pass": "abcd"}, "", nil},
+		{"maxbytes counts bytes", map[string]interface{}{"name": "a", "pass": "äöü"}, errInvalidParameter.code, map[string]string{"pass": "must be at most 4 bytes"}},
+		{"max list", map[string]interface{}{"name": "a", "users": "x,y,z"}, errInvalidParameter.code, map[string]string{"users": "must be at most 2 items"}},
+		{"not an integer", map[string]interface{}{"name": "a", "count": 1.5}, errInvalidParameter.code, map[string]string{"count": "must be an integer"}},
+
+		{"charset username", map[string]interface{}{"name": "a b"}, errInvalidParameter.code, map[string]string{"name": "may only contain letters, digits, _, . and -"}},
+		{"charset username ascii", map[string]interface{}{"name": "ä"}, errInvalidParameter.code, map[string]string{"name": "may only contain letters, digits, _, . and -"}},
+		{"charset line", map[string]interface{}{"name": "a", "text": "a\nb"}, errInvalidParameter.code, map[string]string{"text": "must not contain control characters"}},
+
+		{"oneof", map[string]interface{}{"name": "a", "mode": "c"}, errInvalidParameter.code, map[string]string{"mode": "must be one of a, b"}},
+		{"boolean", map[string]interface{}{"name": "a", "flag": "yes"}, errInvalidParameter.code, map[string]string{"flag": "must be a boolean"}},
+
+		{"unknown", map[string]interface{}{"name": "a", "nmae": "a"}, errInvalidParameter.code, map[string]string{"nmae": "is not a parameter of rules"}},
+		{"credentials without auth", map[string]interface{}{"name": "a", "password": "p"}, errInvalidParameter.code, map[string]string{"password": "is not a parameter of rules"}},
+		{"every problem", map[string]interface{}{"count": 20.0, "x": 1.0}, errInvalidParameter.code, map[string]string{
+			"name":  "is required",
+			"count": "must be at most 10",
+			"x":     "is not a parameter of rules",
+		}},
+	}
+
+	for _, test := range tests {
+		params, err := decode_request("rules", handler, test.postData)
+
+		if len(test.code) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err.Error())
+			} else if _, isRules := params.(ruleParams); !isRules {
+				t.Errorf("%s: params is a %T", test.name, params)
+			}
+			continue
+		}
+
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.code)
+			continue
+		}
+
+		if apiErr.code != test.code {
+			t.Errorf("%s: got code %s, want %s", test.name, apiErr.code, test.code)
+		}
+
+		if !reflect.DeepEqual(apiErr.fields, test.fields) {
+			t.Errorf("%s: got fields %v, want %v", test.name, apiErr.fields, test.fields)
+		}
+
+		if params != nil {
+			t.Errorf("%s: params %v with an error", test.name, params)
+		}
+	}
+}
+
+func TestDecodeRequestUnknownParams(t *testing.T) {
+	defer func(reject bool) { rejectUnknownParams = reject }(rejectUnknownParams)
+
+	handler := requestHandler{auth: true, params: ruleParams{}}
+	postData := map[string]interface{}{"name": "a", "username": "u", "password": "p", "extra": 1.0}
+
+	rejectUnknownParams = true
+	if _, err := decode_request("rules", handler, postData); err == nil {
+		t.Errorf("extra was accepted")
+	}
+
+	rejectUnknownParams = false
+	if _, err := decode_request("rules", handler, postData); err != nil {
+		t.Errorf("extra was refused with ignore: %s", err.Error())
+	}
+
+	// a request without parameters takes none
+	rejectUnknownParams = true
+	params, err := decode_request("none", requestHandler{}, map[string]interface{}{"request": "none", "x": 1.0})
+	if err == nil || params != nil {
+		t.Errorf("x was accepted by a request without parameters")
+	}
+}
+
+func TestDecodeRequestValues(t *testing.T) {
+	handler := requestHandler{params: ruleParams{}}
+
+	params, err := decode_request("rules", handler, map[string]interface{}{
+		"name": "a", "count": "7", "text": "", "flag": "0", "users": []interface{}{"x", " y", "x"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	p := params.(ruleParams)
+	if p.Name != "a" || p.Count != 7 || len(p.Mode) != 0 {
+		t.Errorf("got %+v", p)
+	}
+
+	// an optional parameter sent empty is not an absent one
+	if p.Text == nil || len(*p.Text) != 0 || p.Flag == nil || *p.Flag {
+		t.Errorf("got text %v and flag %v", p.Text, p.Flag)
+	}
+
+	if !reflect.DeepEqual(p.Users, []string{"x", "y"}) {
+		t.Errorf("got users %v", p.Users)
+	}
+
+	params, _ = decode_request("rules", handler, map[string]interface{}{"name": "a"})
+	if p = params.(ruleParams); p.Text != nil || p.Flag != nil {
+		t.Errorf("absent optional parameters are set: %+v", p)
+	}
+}
+
+func TestEndTimeParam(t *testing.T) {
+	handler := requestHandler{params: searchParams{}}
+
+	params, err := decode_request("search", handler, map[string]interface{}{"since": "2020-01-02", "until": "2020-01-02"})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	p := params.(searchParams)
+	if p.Since != 1577923200 || p.Until != 1577923200+86400 {
+		t.Errorf("got since %d and until %d", p.Since, p.Until)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+	Websocket endpoint (/ws)
+
+	A client authenticates with its session token, either as the "token"
+	query parameter or an "Authorization: Bearer" header, and then receives
+	JSON events pushed by the hub:
+
+	 {"event":"hello","username":"..."}
+	 {"event":"message","message":{"id":..,"to_user":..,"from_user":..,"body":..,"date":..[,"attachments":"12,13"]}}
+	 {"event":"message_edited","message":{..,"edited_at":..}}
+	 {"event":"message_deleted","id":..,"scope":"me"|"everyone"}
+	 {"event":"convo_deleted","peer":"...","up_to_id":..}
+	 {"event":"convo_restored","peer":"..."}
+	 {"event":"new_message","value":0|1}
+	 {"event":"room_member","room_id":..,"username":..,"action":"created"|"joined"|"added"|"left"|"kicked"|"owner"|"member"}
+	 {"event":"receipt","status":"delivered"|"read","peer":..,"up_to_id":..,"at":..}
+	 {"event":"conversation_read","peer":..|"room_id":..,"up_to_id":..}
+	 {"event":"friend_request","username":..,"action":"received"|"accepted"|"declined"|"cancelled"}
+	 {"event":"contact","username":..,"action":"added"|"removed"}
+	 {"event":"block","username":..,"action":"blocked"|"unblocked"}
+	 {"event":"typing","username":..,"peer":..|"room_id":..,"state":"typing"|"stopped"}
+	 {"event":"presence","username":..,"status":"online"|"away"|"offline","last_seen":..,"status_text":..}
+
+	The server pings every wsPingPeriod, a client that does not answer with
+	a pong within wsPongWait is disconnected. So is one whose session is
+	revoked or expires, see hub.go, it has to log in again.
+*/
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = (wsPongWait * 9) / 10
+	wsMaxMessageSize = 4096
+	wsSendQueueSize  = 64
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// native clients do not send an Origin, authentication is by token
+	CheckOrigin: func(request *http.Request) bool { return true },
+}
+
+type wsClient struct {
+	username string
+	session  string // the hash of the token it connected with
+	conn     *websocket.Conn
+	send     chan []byte
+
+	typingLimits typingLimits // only touched by readPump
+}
+
+func (sqlobject *SqlObject) handleWebsocket(response http.ResponseWriter, request *http.Request) {
+	token := request.URL.Query().Get("token")
+	if len(token) == 0 {
+		token = bearerToken(request)
+	}
+
+	username, err := lookup_session(sqlobject.store, token)
+	if err != nil {
+		http.Error(response, getErrorJson(err), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(response, request, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		log.Printf("Websocket upgrade failed for %s: %s", username, err.Error())
+		return
+	}
+
+	client := &wsClient{
+		username: username,
+		session:  hashSessionToken(token),
+		conn:     conn,
+		send:     make(chan []byte, wsSendQueueSize),
+
+		typingLimits: make(typingLimits),
+	}
+
+	eventHub.register(client)
+
+	wsConnections.Add(1)
+	go client.writePump(sqlobject.store)
+	go client.readPump(sqlobject.store)
+
+	eventHub.publish(username, map[string]interface{}{"event": "hello", "username": username})
+	presence.touch(sqlobject.store, username)
+}
+
+// readPump drains incoming frames so control frames (pong, close) are
+// processed, any other frame counts as activity for presence and may
+// carry a request (see handleFrame).
+func (client *wsClient) readPump(store Store) {
+	defer func() {
+		eventHub.unregister(client)
+		client.conn.Close()
+		presence.update(store, client.username)
+		wsConnections.Done()
+	}()
+
+	client.conn.SetReadLimit(wsMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	for {
+		_, payload, err := client.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) && verbose {
+				log.Printf("Websocket read error for %s: %s", client.username, err.Error())
+			}
+			return
+		}
+
+		presence.touch(store, client.username)
+		client.handleFrame(store, payload)
+	}
+}
+
+// handleFrame runs a request a client sent over its websocket, only
+// typing is taken this way and nothing is replied.
+func (client *wsClient) handleFrame(store Store, payload []byte) {
+	defer func() {
+		// readPump runs outside of the HTTP server, nothing else recovers here
+		if recovered := recover(); recovered != nil {
+			log.Printf("Panic in a websocket frame from %s: %v\n%s", client.username, recovered, debug.Stack())
+		}
+	}()
+
+	var postData map[string]interface{}
+	if err := json.Unmarshal(payload, &postData); err != nil {
+		return
+	}
+
+	if name, _ := postData["request"].(string); name != "typing" {
+		return
+	}
+
+	params, err := decode_request("typing", requestHandlers["typing"], postData)
+	if err != nil {
+		if verbose {
+			log.Printf("Dropped typing frame from %s: %s", client.username, err.Error())
+		}
+		return
+	}
+
+	key, state, err := parse_typing(client.username, params.(typingParams))
+	if err == nil && (state == typingStateStopped || client.typingLimits.allow(key, time.Now())) {
+		err = apply_typing(store, key, state)
+	}
+
+	if err != nil && verbose {
+		log.Printf("Dropped typing frame from %s: %s", client.username, err.Error())
+	}
+}
+
+// writePump is the only writer on the connection, it owns the ping ticker.
+func (client *wsClient) writePump(store Store) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				// the hub closed the queue (slow consumer or shutdown)
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := client.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+
+			// revoked by another process or expired, the hub never heard of it
+			if check_session(store, client.session) == errInvalidSession {
+				client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session ended"))
+				return
+			}
+
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}